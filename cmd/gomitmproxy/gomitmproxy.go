@@ -8,6 +8,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
@@ -33,12 +34,45 @@ func main() {
 	ListenAddr := flag.String("listen_addr", p.ListenAddr, "network address bind to")
 	HTTPSPorts := flag.String("https_ports", intsToString(p.HTTPSPorts), "ports to listen for https requests")
 	HTTPPorts := flag.String("http_ports", intsToString(p.HTTPPorts), "ports to listen for http requests")
+	QUICPorts := flag.String("quic_ports", intsToString(p.QUICPorts), "udp ports to listen for http/3 requests")
+	AltSvc := flag.String("alt_svc", string(p.AltSvc), "inject, or strip the alt-svc header of https responses")
+	AltSvcPort := flag.Int("alt_svc_port", p.AltSvcPort, "quic port advertised in injected alt-svc headers, defaults to the first quic port")
+	HTTPSListenAddrs := flag.String("https_listen_addrs", strings.Join(p.HTTPSListenAddrs, ","), "addresses, or interface names for https servers, replacing listen_addr")
+	HTTPListenAddrs := flag.String("http_listen_addrs", strings.Join(p.HTTPListenAddrs, ","), "addresses, or interface names for http servers, replacing listen_addr")
+	DNSListenAddrs := flag.String("dns_listen_addrs", strings.Join(p.DNSListenAddrs, ","), "addresses, or interface names for dns servers, replacing listen_addr")
+	DNSAdvertisedAddr := flag.String("dns_advertised_addr", p.DNSAdvertisedAddr, "ip returned in dns answers redirected to the proxy")
 	DNSPort := flag.Int("dns_port", p.DNSPort, "port to listen for dns requests")
+	DNSTLSPort := flag.Int("dns_tls_port", p.DNSTLSPort, "port to listen for dns over tls requests")
+	DNSHTTPSPort := flag.Int("dns_https_port", p.DNSHTTPSPort, "port to listen for dns over https requests")
 	DNSResolverOverride := flag.String("dns_resolver_override", p.DNSResolverOverride, "use the supplied dns resolver, instead of system defaults")
 	ForwardDNSServer := flag.String("forward_dns_server", p.ForwardDNSServer, "use the supplied dns resolver, instead of system defaults")
+	ForwardDNSServers := flag.String("forward_dns_servers", strings.Join(p.ForwardDNSServers, ","), "fallback dns forwarders, ip[:port], tls://host[:port], or https:// urls")
+	DNSHealthCheckInterval := flag.Int("dns_health_check_interval", p.DNSHealthCheckInterval, "seconds between dns forwarder health checks")
+	DNSRecordFile := flag.String("dns_record_file", p.DNSRecordFile, "file to record forwarded dns answers to")
+	DNSReplayFile := flag.String("dns_replay_file", p.DNSReplayFile, "file of recorded dns answers to replay instead of forwarding")
+	DNSCacheSize := flag.Int("dns_cache_size", p.DNSCacheSize, "maximum cached dns answers, a negative value disables the cache")
+	DNSCacheMinTTL := flag.Int("dns_cache_min_ttl", p.DNSCacheMinTTL, "lowest ttl in seconds forwarded dns answers are cached for")
+	DNSCacheMaxTTL := flag.Int("dns_cache_max_ttl", p.DNSCacheMaxTTL, "highest ttl in seconds forwarded dns answers are cached for")
+	DNSNegativeCacheTTL := flag.Int("dns_negative_cache_ttl", p.DNSNegativeCacheTTL, "ttl in seconds of cached nxdomain answers, the soa minimum if zero")
+	DNSCacheStatsInterval := flag.Int("dns_cache_stats_interval", p.DNSCacheStatsInterval, "seconds between dns cache stats log messages")
+	DNSRewriteTTL := flag.Int("dns_rewrite_ttl", p.DNSRewriteTTL, "ttl in seconds of dns answers redirected to the proxy")
 	DNSRegex := flag.String("dns_regex", p.DNSRegex, "domains matching this regex pattern will return the proxy address")
+	DNSHostsFile := flag.String("dns_hosts_file", p.DNSHostsFile, "hosts format file of records the dns server answers locally")
+	GRPCDescriptorSets := flag.String("grpc_descriptor_sets", strings.Join(p.GRPCDescriptorSets, ","), "protobuf descriptor set files used to decode logged grpc messages")
+	UpstreamProtocol := flag.String("upstream_protocol", string(p.UpstreamProtocol), "force the upstream http version, http1, h2, h2c, or mirror")
+	UpstreamProxy := flag.String("upstream_proxy", p.UpstreamProxy, "parent proxy url, http://, https://, or socks5://, with optional user:password")
+	UpstreamProxyBypass := flag.String("upstream_proxy_bypass", strings.Join(p.UpstreamProxyBypass, ","), "pac style host, or url patterns connected without the parent proxy")
+	UpstreamNoProxy := flag.String("upstream_no_proxy", strings.Join(p.UpstreamNoProxy, ","), "no_proxy style hosts, domains, and cidrs connected without the parent proxy")
+	ProxyAuthFile := flag.String("proxy_auth_file", p.ProxyAuthFile, "file of user:password lines clients authenticate against with proxy basic auth")
+	ProxyAuthExemptRedirected := flag.Bool("proxy_auth_exempt_redirected", p.ProxyAuthExemptRedirected, "skip proxy auth of origin form http requests, redirected to the proxy by dns")
+	AllowClients := flag.String("allow_clients", strings.Join(p.AllowClients, ","), "client ips, and cidrs allowed to connect, all clients if empty")
+	DenyClients := flag.String("deny_clients", strings.Join(p.DenyClients, ","), "client ips, and cidrs refused connections")
 	logResponses := flag.Bool("log_responses", p.LogResponses, "enable logging upstream server responses")
 	requestLogFile := flag.String("request_log_file", logConfig.RequestLogFile, "file to log dns, and http requests")
+	requestLogMaxSize := flag.Int64("request_log_max_size", logConfig.RequestLogMaxSize, "rotate the request log file before it grows over this size in bytes")
+	requestLogRotateInterval := flag.Int("request_log_rotate_interval", logConfig.RequestLogRotateInterval, "rotate the request log file after this many seconds")
+	requestLogMaxFiles := flag.Int("request_log_max_files", logConfig.RequestLogMaxFiles, "number of rotated request log files kept, all if 0")
+	requestLogCompress := flag.Bool("request_log_compress", logConfig.RequestLogCompress, "gzip rotated request log files")
 	webHookURL := flag.String("webhook_url", logConfig.WebHookURL, "url to post request, and dns logs")
 	logJSON := flag.Bool("json", false, "output json log format to standard out")
 	logDebug := flag.Bool("debug", false, "enable debug logging")
@@ -100,18 +134,87 @@ func main() {
 			if err != nil {
 				log.WithError(err).WithField("http_ports", *HTTPPorts).Fatal("flag parse failure")
 			}
+		case "quic_ports":
+			p.QUICPorts, err = listToInts(*QUICPorts, ",")
+			if err != nil {
+				log.WithError(err).WithField("quic_ports", *QUICPorts).Fatal("flag parse failure")
+			}
+		case "alt_svc":
+			p.AltSvc = proxy.AltSvcMode(*AltSvc)
+		case "alt_svc_port":
+			p.AltSvcPort = *AltSvcPort
+		case "https_listen_addrs":
+			p.HTTPSListenAddrs = strings.Split(*HTTPSListenAddrs, ",")
+		case "http_listen_addrs":
+			p.HTTPListenAddrs = strings.Split(*HTTPListenAddrs, ",")
+		case "dns_listen_addrs":
+			p.DNSListenAddrs = strings.Split(*DNSListenAddrs, ",")
+		case "dns_advertised_addr":
+			p.DNSAdvertisedAddr = *DNSAdvertisedAddr
+		case "grpc_descriptor_sets":
+			p.GRPCDescriptorSets = strings.Split(*GRPCDescriptorSets, ",")
+		case "upstream_protocol":
+			p.UpstreamProtocol = proxy.UpstreamProtocol(*UpstreamProtocol)
+		case "upstream_proxy":
+			p.UpstreamProxy = *UpstreamProxy
+		case "upstream_proxy_bypass":
+			p.UpstreamProxyBypass = strings.Split(*UpstreamProxyBypass, ",")
+		case "upstream_no_proxy":
+			p.UpstreamNoProxy = strings.Split(*UpstreamNoProxy, ",")
+		case "proxy_auth_file":
+			p.ProxyAuthFile = *ProxyAuthFile
+		case "proxy_auth_exempt_redirected":
+			p.ProxyAuthExemptRedirected = *ProxyAuthExemptRedirected
+		case "allow_clients":
+			p.AllowClients = strings.Split(*AllowClients, ",")
+		case "deny_clients":
+			p.DenyClients = strings.Split(*DenyClients, ",")
 		case "dns_port":
 			p.DNSPort = *DNSPort
+		case "dns_tls_port":
+			p.DNSTLSPort = *DNSTLSPort
+		case "dns_https_port":
+			p.DNSHTTPSPort = *DNSHTTPSPort
 		case "forward_dns_server":
 			p.ForwardDNSServer = *ForwardDNSServer
+		case "forward_dns_servers":
+			p.ForwardDNSServers = strings.Split(*ForwardDNSServers, ",")
+		case "dns_health_check_interval":
+			p.DNSHealthCheckInterval = *DNSHealthCheckInterval
+		case "dns_record_file":
+			p.DNSRecordFile = *DNSRecordFile
+		case "dns_replay_file":
+			p.DNSReplayFile = *DNSReplayFile
+		case "dns_cache_size":
+			p.DNSCacheSize = *DNSCacheSize
+		case "dns_cache_min_ttl":
+			p.DNSCacheMinTTL = *DNSCacheMinTTL
+		case "dns_cache_max_ttl":
+			p.DNSCacheMaxTTL = *DNSCacheMaxTTL
+		case "dns_negative_cache_ttl":
+			p.DNSNegativeCacheTTL = *DNSNegativeCacheTTL
+		case "dns_cache_stats_interval":
+			p.DNSCacheStatsInterval = *DNSCacheStatsInterval
+		case "dns_rewrite_ttl":
+			p.DNSRewriteTTL = *DNSRewriteTTL
 		case "dns_resolver_override":
 			p.DNSResolverOverride = *DNSResolverOverride
 		case "dns_regex":
 			p.DNSRegex = *DNSRegex
+		case "dns_hosts_file":
+			p.DNSHostsFile = *DNSHostsFile
 		case "log_responses":
 			p.LogResponses = *logResponses
 		case "webhook_url":
 			logConfig.WebHookURL = *webHookURL
+		case "request_log_max_size":
+			logConfig.RequestLogMaxSize = *requestLogMaxSize
+		case "request_log_rotate_interval":
+			logConfig.RequestLogRotateInterval = *requestLogRotateInterval
+		case "request_log_max_files":
+			logConfig.RequestLogMaxFiles = *requestLogMaxFiles
+		case "request_log_compress":
+			logConfig.RequestLogCompress = *requestLogCompress
 		case "log_level":
 			logConfig.Level.Parse(*logLevel)
 		}
@@ -127,26 +230,93 @@ func main() {
 	if *logDebug {
 		logConfig.Level = log.DEBUG
 	}
+	if err := logConfig.Load(); err != nil {
+		log.WithError(err).Fatal("invalid log config")
+	}
 	logger, requestWriter := logConfig.GetLogger()
 	log.DefaultLogger = logger
 	if requestWriter != nil {
 		defer func() { _ = requestWriter.Close() }()
+		reopenOnSignal(requestWriter)
 	}
 
 	// Output config values for debugging
 	log.WithField("log_level", logConfig.Level).Debug("")
 	log.WithField("log_format", logConfig.Format).Debug("")
 	log.WithField("request_log_file", logConfig.RequestLogFile).Debug("")
+	log.WithField("request_log_max_size", logConfig.RequestLogMaxSize).Debug("")
+	log.WithField("request_log_rotate_interval", logConfig.RequestLogRotateInterval).Debug("")
+	log.WithField("request_log_max_files", logConfig.RequestLogMaxFiles).Debug("")
+	log.WithField("request_log_compress", logConfig.RequestLogCompress).Debug("")
 	log.WithField("webhook_url", logConfig.WebHookURL).Debug("")
+	if logConfig.Redact != nil {
+		log.WithField("redact_headers", logConfig.Redact.Headers).
+			WithField("redact_form_fields", logConfig.Redact.FormFields).
+			WithField("redact_json_paths", logConfig.Redact.JSONPaths).
+			WithField("redact_patterns", len(logConfig.Redact.Patterns)).
+			WithField("redact_hash", logConfig.Redact.Hash).
+			Debug("")
+	}
+	if logConfig.Capture != nil {
+		log.WithField("capture_max_size", logConfig.Capture.MaxSize).
+			WithField("capture_include_content_types", logConfig.Capture.IncludeContentTypes).
+			WithField("capture_exclude_content_types", logConfig.Capture.ExcludeContentTypes).
+			WithField("capture_spill_dir", logConfig.Capture.SpillDir).
+			WithField("capture_spill_size", logConfig.Capture.SpillSize).
+			Debug("")
+	}
 	log.WithField("ca_key_file", p.CAKeyFile).Debug("")
 	log.WithField("ca_cert_file", p.CACertFile).Debug("")
 	log.WithField("listen_addr", p.ListenAddr).Debug("")
 	log.WithField("https_ports", p.HTTPSPorts).Debug("")
+	log.WithField("quic_ports", p.QUICPorts).Debug("")
+	log.WithField("alt_svc", p.AltSvc).Debug("")
+	log.WithField("alt_svc_port", p.AltSvcPort).Debug("")
 	log.WithField("http_ports", p.HTTPPorts).Debug("")
+	log.WithField("https_listen_addrs", p.HTTPSListenAddrs).Debug("")
+	log.WithField("http_listen_addrs", p.HTTPListenAddrs).Debug("")
+	log.WithField("dns_listen_addrs", p.DNSListenAddrs).Debug("")
+	log.WithField("dns_advertised_addr", p.DNSAdvertisedAddr).Debug("")
+	log.WithField("grpc_descriptor_sets", p.GRPCDescriptorSets).Debug("")
+	log.WithField("upstream_protocol", p.UpstreamProtocol).Debug("")
+	log.WithField("upstream_proxy", redactURL(p.UpstreamProxy)).Debug("")
+	log.WithField("upstream_proxy_bypass", p.UpstreamProxyBypass).Debug("")
+	log.WithField("upstream_no_proxy", p.UpstreamNoProxy).Debug("")
+	log.WithField("proxy_auth_file", p.ProxyAuthFile).Debug("")
+	log.WithField("proxy_auth_exempt_redirected", p.ProxyAuthExemptRedirected).Debug("")
+	log.WithField("allow_clients", p.AllowClients).Debug("")
+	log.WithField("deny_clients", p.DenyClients).Debug("")
 	log.WithField("dns_port", p.DNSPort).Debug("")
+	log.WithField("dns_tls_port", p.DNSTLSPort).Debug("")
+	log.WithField("dns_https_port", p.DNSHTTPSPort).Debug("")
 	log.WithField("forward_dns_server", p.ForwardDNSServer).Debug("")
+	log.WithField("forward_dns_servers", p.ForwardDNSServers).Debug("")
+	log.WithField("dns_health_check_interval", p.DNSHealthCheckInterval).Debug("")
+	log.WithField("dns_record_file", p.DNSRecordFile).Debug("")
+	log.WithField("dns_replay_file", p.DNSReplayFile).Debug("")
+	log.WithField("dns_cache_size", p.DNSCacheSize).Debug("")
+	log.WithField("dns_cache_min_ttl", p.DNSCacheMinTTL).Debug("")
+	log.WithField("dns_cache_max_ttl", p.DNSCacheMaxTTL).Debug("")
+	log.WithField("dns_negative_cache_ttl", p.DNSNegativeCacheTTL).Debug("")
+	log.WithField("dns_cache_stats_interval", p.DNSCacheStatsInterval).Debug("")
+	log.WithField("dns_rewrite_ttl", p.DNSRewriteTTL).Debug("")
 	log.WithField("dns_resolver_override", p.DNSResolverOverride).Debug("")
 	log.WithField("dns_regex", p.DNSRegex).Debug("")
+	log.WithField("dns_static_records", len(p.DNSStaticRecords)).Debug("")
+	log.WithField("routes", len(p.Routes)).Debug("")
+	if p.Filter != nil {
+		log.WithField("filter_allow", len(p.Filter.Allow)).
+			WithField("filter_block", len(p.Filter.Block)).
+			WithField("filter_block_lists", p.Filter.BlockLists).
+			Debug("")
+	}
+	log.WithField("shaping_rules", len(p.Shaping)).Debug("")
+	log.WithField("limits", len(p.Limits)).Debug("")
+	if p.Faults != nil {
+		log.WithField("fault_rules", len(p.Faults.Rules)).WithField("faults_disabled", p.Faults.Disabled).Debug("")
+		toggleFaultsOnSignal(p.Faults)
+	}
+	log.WithField("dns_hosts_file", p.DNSHostsFile).Debug("")
 	log.WithField("log_responses", p.LogResponses).Debug("")
 
 	// Start the proxy
@@ -162,12 +332,12 @@ func GenerateCA(KeyAge int, CACertFile, CAKeyFile string) {
 	}
 	_, _, err := c.GenerateCAPair()
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Fatal("%s", err.Error())
 	}
 
 	err = c.WriteCA(CACertFile, CAKeyFile)
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Fatal("%s", err.Error())
 	}
 
 	os.Exit(0)
@@ -188,6 +358,17 @@ func listToInts(s, sep string) (ints []int, err error) {
 	return ints, nil
 }
 
+// redactURL hides the password of a url for logging
+func redactURL(rawURL string) string {
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	return parsed.Redacted()
+}
+
 func intsToString(ints []int) (intString string) {
 
 	strInts := make([]string, len(ints))
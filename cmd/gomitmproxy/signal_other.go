@@ -0,0 +1,17 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+
+package main
+
+import (
+	"github.com/jmizell/GoMITMProxy/proxy"
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// toggleFaultsOnSignal is not supported without SIGUSR1, fault injection keeps the state from the config file.
+func toggleFaultsOnSignal(*proxy.FaultInjector) {}
+
+// reopenOnSignal is not supported without SIGHUP, the request log file is reopened only by restarting.
+func reopenOnSignal(*log.RequestWriter) {}
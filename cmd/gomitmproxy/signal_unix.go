@@ -0,0 +1,46 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jmizell/GoMITMProxy/proxy"
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// toggleFaultsOnSignal switches fault injection on, or off each time the process receives SIGUSR1.
+func toggleFaultsOnSignal(faults *proxy.FaultInjector) {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			log.WithField("faults_enabled", faults.Toggle()).Info("fault injection toggled")
+		}
+	}()
+}
+
+// reopenOnSignal reopens the request log file each time the process receives SIGHUP, after external log rotation has
+// moved the file.
+func reopenOnSignal(requestWriter *log.RequestWriter) {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if err := requestWriter.Reopen(); err != nil {
+				log.WithError(err).Error("failed to reopen request log")
+				continue
+			}
+			log.WithField("request_log_file", requestWriter.RequestLogFile).Info("request log reopened")
+		}
+	}()
+}
@@ -1,7 +1,20 @@
 module github.com/jmizell/GoMITMProxy
 
+go 1.24
+
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/benburkert/dns v0.0.0-20190225204957-d356cf78cdfc
+	github.com/klauspost/compress v1.18.0
+	github.com/quic-go/quic-go v0.59.0
 	github.com/tebeka/selenium v0.9.3
-	golang.org/x/net v0.0.0-20190311183353-d8887717615a
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.43.0
+	google.golang.org/protobuf v1.28.1
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
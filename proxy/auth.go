@@ -0,0 +1,310 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// DefaultProxyAuthRealm is the realm sent in Proxy-Authenticate challenges, if Realm is left unset
+const DefaultProxyAuthRealm = "GoMITMProxy"
+
+// Error client allow, or deny list entry could not be parsed
+const ERRClientACLInvalid = ErrorStr("invalid client acl")
+
+// Error proxy credential file could not be read, or parsed
+const ERRProxyAuthFile = ErrorStr("invalid proxy credential file")
+
+// Error request has missing, or invalid proxy credentials
+const ERRProxyAuthFailed = ErrorStr("proxy authentication failed")
+
+// ProxyAuth requires clients of the http listeners to authenticate with Proxy-Authorization basic auth, against the
+// users in CredentialFile.
+//
+// The credential file has a user:password line for each user, with blank lines, and lines starting with # ignored.
+// Passwords are htpasswd style bcrypt hashes, {SHA} base64 sha1 hashes, or plain text.
+type ProxyAuth struct {
+	CredentialFile string `json:"credential_file"`
+	Realm          string `json:"realm"` // Realm of the Proxy-Authenticate challenge, DefaultProxyAuthRealm if empty
+
+	// ExemptRedirected skips authentication of origin form requests, sent by clients redirected to the proxy by dns,
+	// which can't send proxy credentials. Any client can send an origin form request, so this leaves the http
+	// listeners open to every client the acl allows.
+	ExemptRedirected bool `json:"exempt_redirected"`
+
+	users map[string]string
+}
+
+// Load reads the users from CredentialFile.
+func (a *ProxyAuth) Load() error {
+
+	file, err := os.Open(a.CredentialFile)
+	if err != nil {
+		return ERRProxyAuthFile.Err().WithError(err)
+	}
+	defer func() { _ = file.Close() }()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i <= 0 || i == len(line)-1 {
+			return ERRProxyAuthFile.Err().WithReason("%s line %d, expected user:password", a.CredentialFile, lineNumber)
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return ERRProxyAuthFile.Err().WithError(err)
+	}
+
+	a.users = users
+	log.WithField("credential_file", a.CredentialFile).WithField("users", len(users)).Info("proxy credentials loaded")
+
+	return nil
+}
+
+// required returns true if the request must be authenticated. Every request on the http listeners is, unless
+// ExemptRedirected is set, and the request is in origin form. Requests on the tls, and quic listeners were redirected
+// to the proxy by dns, and never carry proxy credentials.
+func (a *ProxyAuth) required(req *http.Request) bool {
+
+	if req.TLS != nil {
+		return false
+	}
+	if !a.ExemptRedirected {
+		return true
+	}
+
+	return strings.HasPrefix(req.RequestURI, "http://") || strings.HasPrefix(req.RequestURI, "https://")
+}
+
+// authenticate returns the user of the request Proxy-Authorization credentials.
+func (a *ProxyAuth) authenticate(req *http.Request) (string, error) {
+
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return "", ERRProxyAuthFailed.Err().WithReason("missing credentials")
+	}
+
+	const prefix = "basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", ERRProxyAuthFailed.Err().WithReason("unsupported scheme")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", ERRProxyAuthFailed.Err().WithReason("malformed credentials")
+	}
+
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", ERRProxyAuthFailed.Err().WithReason("malformed credentials")
+	}
+
+	hash, ok := a.users[user]
+	if !ok || !checkPassword(hash, password) {
+		return user, ERRProxyAuthFailed.Err().WithReason("invalid credentials for user %s", user)
+	}
+
+	return user, nil
+}
+
+// challenge writes the 407 response asking the client for credentials.
+func (a *ProxyAuth) challenge(resp http.ResponseWriter) int {
+
+	realm := a.Realm
+	if realm == "" {
+		realm = DefaultProxyAuthRealm
+	}
+
+	resp.Header().Add(GoMITMProxyHeader, Version)
+	resp.Header().Set("Proxy-Authenticate", `Basic realm="`+strings.Replace(realm, `"`, `\"`, -1)+`"`)
+	resp.WriteHeader(http.StatusProxyAuthRequired)
+
+	return http.StatusProxyAuthRequired
+}
+
+// checkPassword compares a password to a bcrypt, {SHA}, or plain text credential file entry.
+func checkPassword(hash, password string) bool {
+
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(encoded)) == 1
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+}
+
+// proxyUserKey is the request context key of the authenticated user
+type proxyUserKey struct{}
+
+// withProxyUser returns the request with the authenticated user set on its context.
+func withProxyUser(req *http.Request, user string) *http.Request {
+
+	return req.WithContext(context.WithValue(req.Context(), proxyUserKey{}, user))
+}
+
+// proxyUser returns the authenticated user of the request, or an empty string.
+func proxyUser(req *http.Request) string {
+
+	user, _ := req.Context().Value(proxyUserKey{}).(string)
+
+	return user
+}
+
+// ClientACL allows, or denies clients by address. Deny entries are checked first, and when Allow is not empty, only
+// clients matching an Allow entry are accepted. Entries are ips, or cidrs.
+type ClientACL struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// Load parses the allow, and deny lists.
+func (a *ClientACL) Load() error {
+
+	a.allow, a.deny = nil, nil
+	for _, entry := range a.Allow {
+		network, err := parseCIDR(strings.TrimSpace(entry))
+		if err != nil {
+			return ERRClientACLInvalid.Err().WithReason("allow %q, %s", entry, err.Error())
+		}
+		a.allow = append(a.allow, network)
+	}
+	for _, entry := range a.Deny {
+		network, err := parseCIDR(strings.TrimSpace(entry))
+		if err != nil {
+			return ERRClientACLInvalid.Err().WithReason("deny %q, %s", entry, err.Error())
+		}
+		a.deny = append(a.deny, network)
+	}
+
+	return nil
+}
+
+// Allowed returns true if the client address is accepted. A nil ACL allows every client.
+func (a *ClientACL) Allowed(addr net.Addr) bool {
+
+	if a == nil {
+		return true
+	}
+
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		host, _ := splitHostPort(addr.String())
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range a.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, network := range a.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listener wraps the listener, closing accepted connections from denied clients. The listener is returned unchanged
+// when the ACL is nil.
+func (a *ClientACL) listener(ln net.Listener) net.Listener {
+
+	if a == nil {
+		return ln
+	}
+
+	return &aclListener{Listener: ln, acl: a}
+}
+
+// packetConn wraps the packet conn, dropping packets from denied clients. The conn is returned unchanged when the ACL
+// is nil.
+func (a *ClientACL) packetConn(conn net.PacketConn) net.PacketConn {
+
+	if a == nil {
+		return conn
+	}
+
+	return &aclPacketConn{PacketConn: conn, acl: a}
+}
+
+// aclListener closes accepted connections from clients denied by the acl
+type aclListener struct {
+	net.Listener
+	acl *ClientACL
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		if l.acl.Allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+
+		log.WithField("client", conn.RemoteAddr().String()).
+			WithField("addr", l.Addr().String()).
+			Warning("client connection denied")
+		_ = conn.Close()
+	}
+}
+
+// aclPacketConn drops packets from clients denied by the acl
+type aclPacketConn struct {
+	net.PacketConn
+	acl *ClientACL
+}
+
+func (c *aclPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.acl.Allowed(addr) {
+			return n, addr, err
+		}
+
+		log.WithField("client", addr.String()).
+			WithField("addr", c.LocalAddr().String()).
+			Debug("client packet denied")
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeCredentialFile writes a temp credential file, and returns its name.
+func writeCredentialFile(t *testing.T, content string) string {
+
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatalf("failed to create temp file, %s", err.Error())
+	}
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatalf("failed to write temp file, %s", err.Error())
+	}
+	_ = f.Close()
+
+	return f.Name()
+}
+
+func basicCredentials(user, password string) string {
+
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestProxyAuth_authenticate(t *testing.T) {
+
+	t.Parallel()
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	sum := sha1.Sum([]byte("sha-secret"))
+
+	filename := writeCredentialFile(t, "# users\n\nalice:"+string(bcryptHash)+
+		"\nbob:{SHA}"+base64.StdEncoding.EncodeToString(sum[:])+
+		"\ncarol:plain:secret\n")
+	defer func() { _ = os.Remove(filename) }()
+
+	auth := &ProxyAuth{CredentialFile: filename}
+	if err := auth.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	for _, test := range []struct {
+		name   string
+		header string
+		user   string
+		valid  bool
+	}{
+		{"bcrypt", basicCredentials("alice", "bcrypt-secret"), "alice", true},
+		{"sha", basicCredentials("bob", "sha-secret"), "bob", true},
+		{"plain", basicCredentials("carol", "plain:secret"), "carol", true},
+		{"scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("carol:plain:secret")), "carol", true},
+		{"wrong_password", basicCredentials("alice", "sha-secret"), "alice", false},
+		{"unknown_user", basicCredentials("mallory", "plain:secret"), "mallory", false},
+		{"missing", "", "", false},
+		{"bearer", "Bearer token", "", false},
+		{"malformed", "Basic not-base64", "", false},
+	} {
+		test := test
+		t.Run(test.name, func(subTest *testing.T) {
+
+			subTest.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if test.header != "" {
+				req.Header.Set("Proxy-Authorization", test.header)
+			}
+
+			user, err := auth.authenticate(req)
+			if user != test.user {
+				subTest.Fatalf("expected user %q, but received %q", test.user, user)
+			}
+			if test.valid && err != nil {
+				subTest.Fatalf("expected no error, received %s", err.Error())
+			}
+			if !test.valid && (err == nil || !ERRProxyAuthFailed.Err().Match(err.(*ProxyError))) {
+				subTest.Fatalf("expected error %s, but received %v", ERRProxyAuthFailed, err)
+			}
+		})
+	}
+}
+
+func TestProxyAuth_Load(t *testing.T) {
+
+	t.Parallel()
+
+	filename := writeCredentialFile(t, "alice:secret\nbob\n")
+	defer func() { _ = os.Remove(filename) }()
+
+	for _, auth := range []*ProxyAuth{
+		{CredentialFile: filename},
+		{CredentialFile: filename + ".missing"},
+	} {
+		err := auth.Load()
+		if err == nil || !ERRProxyAuthFile.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s for %s, but received %v", ERRProxyAuthFile, auth.CredentialFile, err)
+		}
+	}
+}
+
+func TestReverseProxy_ServeHTTP_auth(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Proxy-Authorization") != "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = writer.Write([]byte("okay"))
+	}))
+	defer upstream.Close()
+
+	filename := writeCredentialFile(t, "alice:secret\n")
+	defer func() { _ = os.Remove(filename) }()
+
+	p := &ReverseProxy{Auth: &ProxyAuth{CredentialFile: filename, Realm: "test"}}
+	if err := p.Auth.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	forwardURL := "http://" + upstream.Listener.Addr().String() + "/"
+
+	req := httptest.NewRequest(http.MethodGet, forwardURL, nil)
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("expected status code %d, but received %d", http.StatusProxyAuthRequired, recorder.Code)
+	}
+	if challenge := recorder.Header().Get("Proxy-Authenticate"); challenge != `Basic realm="test"` {
+		t.Fatalf("expected a basic challenge for realm test, but received %s", challenge)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, forwardURL, nil)
+	req.Header.Set("Proxy-Authorization", basicCredentials("alice", "secret"))
+	recorder = httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "okay" {
+		t.Fatalf("expected status code %d okay, but received %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	// Any client can send an origin form request with a Host header, so it must authenticate as well
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = upstream.Listener.Addr().String()
+	recorder = httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("expected status code %d, but received %d", http.StatusProxyAuthRequired, recorder.Code)
+	}
+
+	// Origin form requests redirected to the proxy by dns are only exempt when opted in
+	p.Auth.ExemptRedirected = true
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = upstream.Listener.Addr().String()
+	recorder = httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "okay" {
+		t.Fatalf("expected status code %d okay, but received %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, forwardURL, nil)
+	recorder = httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("expected status code %d, but received %d", http.StatusProxyAuthRequired, recorder.Code)
+	}
+}
+
+func TestTLSServer_ListenAndServe_auth(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("okay"))
+	}))
+	defer upstream.Close()
+
+	filename := writeCredentialFile(t, "alice:secret\n")
+	defer func() { _ = os.Remove(filename) }()
+
+	p := &ReverseProxy{
+		Auth:   &ProxyAuth{CredentialFile: filename},
+		Routes: []*Route{{Pattern: "intercepted.test", Upstream: upstream.URL}},
+	}
+	if err := p.Auth.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if err := p.LoadRoutes(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	certs := &Certs{}
+	if _, _, err := certs.GenerateCAPair(); err != nil {
+		t.Fatalf("failed to generate ca, %s", err.Error())
+	}
+
+	srv := &TLSServer{ListenAddr: "127.0.0.1", Certs: certs}
+	ready := make(chan bool, 1)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe(ready, p)
+	}()
+
+	select {
+	case <-ready:
+	case err := <-serverErr:
+		t.Fatalf("tls server failed to start, %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for tls server")
+	}
+	defer func() { _ = srv.Shutdown() }()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(certs.caCert)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs, ServerName: "intercepted.test"}},
+		Timeout:   10 * time.Second,
+	}
+
+	// A client redirected by dns sends no proxy credentials
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://127.0.0.1:%d/", srv.GetPort()), nil)
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	req.Host = "intercepted.test"
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to make a tls connection to test proxy, %s", err.Error())
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "okay" {
+		t.Fatalf("expected status code %d okay, but received %d %s", http.StatusOK, resp.StatusCode, body)
+	}
+}
+
+func TestClientACL_Allowed(t *testing.T) {
+
+	t.Parallel()
+
+	acl := &ClientACL{Allow: []string{"10.0.0.0/8", "192.0.2.1"}, Deny: []string{"10.0.66.0/24"}}
+	if err := acl.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	for _, test := range []struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, true},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.66.1"), Port: 1234}, false},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}, false},
+	} {
+		if allowed := acl.Allowed(test.addr); allowed != test.allowed {
+			t.Fatalf("expected %s allowed %t, but received %t", test.addr, test.allowed, allowed)
+		}
+	}
+
+	var nilACL *ClientACL
+	if !nilACL.Allowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}) {
+		t.Fatalf("expected a nil acl to allow every client")
+	}
+
+	for _, invalid := range []*ClientACL{{Allow: []string{"10.0.0"}}, {Deny: []string{"not an ip"}}} {
+		err := invalid.Load()
+		if err == nil || !ERRClientACLInvalid.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s for %+v, but received %v", ERRClientACLInvalid, invalid, err)
+		}
+	}
+}
+
+func TestClientACL_listener(t *testing.T) {
+
+	t.Parallel()
+
+	for _, test := range []struct {
+		name    string
+		acl     *ClientACL
+		allowed bool
+	}{
+		{"allowed", &ClientACL{Allow: []string{"127.0.0.0/8"}}, true},
+		{"denied", &ClientACL{Deny: []string{"127.0.0.1"}}, false},
+	} {
+		test := test
+		t.Run(test.name, func(subTest *testing.T) {
+
+			subTest.Parallel()
+
+			if err := test.acl.Load(); err != nil {
+				subTest.Fatalf("expected no error, received %s", err.Error())
+			}
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				_, _ = writer.Write([]byte("okay"))
+			}))
+			server.Listener = test.acl.listener(server.Listener)
+			server.Start()
+			defer server.Close()
+
+			client := &http.Client{Timeout: 2 * time.Second}
+			resp, err := client.Get(server.URL)
+			if test.allowed && err != nil {
+				subTest.Fatalf("expected no error, received %s", err.Error())
+			}
+			if !test.allowed && err == nil {
+				_ = resp.Body.Close()
+				subTest.Fatalf("expected the connection to be closed, but received %s", resp.Status)
+			}
+			if resp != nil {
+				_ = resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestClientACL_packetConn(t *testing.T) {
+
+	t.Parallel()
+
+	acl := &ClientACL{Deny: []string{"127.0.0.1"}}
+	if err := acl.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	filtered := acl.packetConn(conn)
+	defer func() { _ = filtered.Close() }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	defer func() { _ = client.Close() }()
+	_, _ = client.Write([]byte("denied"))
+
+	_ = filtered.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, addr, err := filtered.ReadFrom(make([]byte, 16)); err == nil {
+		t.Fatalf("expected packets from a denied client to be dropped, but received %d bytes from %s", n, addr)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"sync"
 	"time"
 
@@ -164,7 +165,8 @@ func (c *Certs) GenerateCAPair() (key *rsa.PrivateKey, cert *x509.Certificate, e
 	return key, cert, nil
 }
 
-// GenerateHostKey returns a tls.Certificate for a given virtual host, signed by the CA.
+// GenerateHostKey returns a tls.Certificate for a given virtual host, signed by the CA. When the virtual host is an
+// ip address, it's also added to the certificate ip addresses.
 func (c *Certs) GenerateHostKey(vhost string) (*tls.Certificate, error) {
 
 	if c.caKey == nil || c.caCert == nil {
@@ -185,6 +187,11 @@ func (c *Certs) GenerateHostKey(vhost string) (*tls.Certificate, error) {
 		IsCA:                  false,
 	}
 
+	// Clients connecting by ip address, such as dns over tls, verify the ip against the certificate ip addresses
+	if ip := net.ParseIP(vhost); ip != nil {
+		hostCertTemplate.IPAddresses = []net.IP{ip}
+	}
+
 	key, cert, err := genCerts(hostCertTemplate, c.caCert, c.caKey, DefaultKeyAge)
 	if err != nil {
 		return nil, ERRCertGenHostKey.Err().WithError(err)
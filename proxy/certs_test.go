@@ -90,7 +90,7 @@ func TestCerts_Get(t *testing.T) {
 			defer wg.Done()
 			hostKey1, err = certStore.Get("example.com")
 			if err != nil {
-				t.Fatalf("expected Certs.Get to not return an error, received %s", err.Error())
+				t.Errorf("expected Certs.Get to not return an error, received %s", err.Error())
 			}
 		}()
 
@@ -99,7 +99,7 @@ func TestCerts_Get(t *testing.T) {
 			defer wg.Done()
 			hostKey2, err = certStore.Get("example.com")
 			if err != nil {
-				t.Fatalf("expected Certs.Get to not return an error, received %s", err.Error())
+				t.Errorf("expected Certs.Get to not return an error, received %s", err.Error())
 			}
 		}()
 
@@ -260,3 +260,27 @@ func testingCAPair() (certFilename string, keyFilename string, err error) {
 
 	return certFilename, keyFilename, nil
 }
+
+func TestCerts_GenerateHostKey_ipAddress(t *testing.T) {
+
+	t.Parallel()
+
+	certStore, err := getTestCertStore()
+	if err != nil {
+		t.Fatalf("expected GenerateCAPair to not return an error, received %s", err.Error())
+	}
+
+	hostKey, err := certStore.GenerateHostKey("127.0.0.1")
+	if err != nil {
+		t.Fatalf("expected GenerateHostKey to not return an error, received %s", err.Error())
+	}
+
+	cert, err := x509.ParseCertificate(hostKey.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse host certificate, %s", err.Error())
+	}
+
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Fatalf("expected certificate to be valid for 127.0.0.1, %s", err.Error())
+	}
+}
@@ -7,28 +7,82 @@ import (
 	"encoding/json"
 	"os"
 
+	"github.com/jmizell/GoMITMProxy/proxy"
 	"github.com/jmizell/GoMITMProxy/proxy/log"
 )
 
 type Config struct {
 
 	// MITMProxy Config
-	LogResponses        bool   `json:"log_responses"`
-	CAKeyFile           string `json:"ca_key_file"`
-	CACertFile          string `json:"ca_cert_file"`
-	ListenAddr          string `json:"listen_addr"`
-	HTTPSPorts          []int  `json:"https_ports"`
-	HTTPPorts           []int  `json:"http_ports"`
-	ForwardDNSServer    string `json:"forward_dns_server"`
-	DNSPort             int    `json:"dns_port"`
-	DNSRegex            string `json:"dns_regex"`
-	DNSResolverOverride string `json:"dns_resolver_override"`
+	LogResponses        bool                     `json:"log_responses"`
+	CAKeyFile           string                   `json:"ca_key_file"`
+	CACertFile          string                   `json:"ca_cert_file"`
+	ListenAddr          string                   `json:"listen_addr"`
+	HTTPSPorts          []int                    `json:"https_ports"`
+	HTTPPorts           []int                    `json:"http_ports"`
+	ForwardDNSServer    string                   `json:"forward_dns_server"`
+	DNSPort             int                      `json:"dns_port"`
+	DNSTLSPort          int                      `json:"dns_tls_port"`
+	DNSHTTPSPort        int                      `json:"dns_https_port"`
+	DNSRegex            string                   `json:"dns_regex"`
+	DNSResolverOverride string                   `json:"dns_resolver_override"`
+	DNSRules            []*proxy.DNSRule         `json:"dns_rules"`
+	DNSStaticRecords    []*proxy.DNSStaticRecord `json:"dns_static_records"`
+	DNSHostsFile        string                   `json:"dns_hosts_file"`
+
+	HTTPSListenAddrs  []string `json:"https_listen_addrs"`
+	HTTPListenAddrs   []string `json:"http_listen_addrs"`
+	DNSListenAddrs    []string `json:"dns_listen_addrs"`
+	DNSAdvertisedAddr string   `json:"dns_advertised_addr"`
+
+	ForwardDNSServers      []string `json:"forward_dns_servers"`
+	DNSHealthCheckInterval int      `json:"dns_health_check_interval"`
+	DNSRecordFile          string   `json:"dns_record_file"`
+	DNSReplayFile          string   `json:"dns_replay_file"`
+
+	DNSCacheSize          int `json:"dns_cache_size"`
+	DNSCacheMinTTL        int `json:"dns_cache_min_ttl"`
+	DNSCacheMaxTTL        int `json:"dns_cache_max_ttl"`
+	DNSNegativeCacheTTL   int `json:"dns_negative_cache_ttl"`
+	DNSCacheStatsInterval int `json:"dns_cache_stats_interval"`
+	DNSRewriteTTL         int `json:"dns_rewrite_ttl"`
+
+	GRPCDescriptorSets []string               `json:"grpc_descriptor_sets"`
+	UpstreamProtocol   proxy.UpstreamProtocol `json:"upstream_protocol"`
+
+	QUICPorts  []int            `json:"quic_ports"`
+	AltSvc     proxy.AltSvcMode `json:"alt_svc"`
+	AltSvcPort int              `json:"alt_svc_port"`
+
+	UpstreamProxy       string   `json:"upstream_proxy"`
+	UpstreamProxyBypass []string `json:"upstream_proxy_bypass"`
+	UpstreamNoProxy     []string `json:"upstream_no_proxy"`
+
+	Routes []*proxy.Route       `json:"routes"`
+	Faults *proxy.FaultInjector `json:"faults"`
+	Filter *proxy.HostFilter    `json:"filter"`
+
+	Shaping []*proxy.ShapingRule `json:"shaping"`
+	Limits  []*proxy.RateLimit   `json:"limits"`
+
+	ProxyAuthFile             string   `json:"proxy_auth_file"`
+	ProxyAuthExemptRedirected bool     `json:"proxy_auth_exempt_redirected"`
+	AllowClients              []string `json:"allow_clients"`
+	DenyClients               []string `json:"deny_clients"`
 
 	// Log Config
 	Level          log.Level  `json:"log_level"`
 	Format         log.Format `json:"log_format"`
 	RequestLogFile string     `json:"request_log_file"`
 	WebHookURL     string     `json:"webhook_url"`
+
+	RequestLogMaxSize        int64 `json:"request_log_max_size"`
+	RequestLogRotateInterval int   `json:"request_log_rotate_interval"`
+	RequestLogMaxFiles       int   `json:"request_log_max_files"`
+	RequestLogCompress       bool  `json:"request_log_compress"`
+
+	Redact  *log.Redactor    `json:"redact"`
+	Capture *log.BodyCapture `json:"capture"`
 }
 
 func (c *Config) Write(filepath string) (err error) {
@@ -7,7 +7,6 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"regexp"
 	"time"
 
 	"github.com/benburkert/dns"
@@ -21,87 +20,452 @@ const DefaultDNSServer = "8.8.8.8"
 // DNSServer is a forwarding dns server, that can redirect arbitrary A record requests back to the MITMProxy listening
 // address. DNSServer only returns requests for valid dns entries, any request that cannot be answered by the forward
 // dns server is returned nxdomain.
+//
+// Names found in StaticRecords, or HostsFile are answered locally, and never forwarded. All other questions are
+// matched against Rules in order, and the first match decides how the question is answered. Questions that match no
+// rule are redirected to AdvertisedAddr when they match DNSRegex. The DNSRegex redirect only rewrites A answers the
+// upstream returns, so names the upstream doesn't know stay nxdomain.
+//
+// The server listens on every address in ListenAddrs, or ListenAddr when ListenAddrs is empty. Addresses may be ips,
+// 0.0.0.0, ::, or network interface names. AdvertisedAddr defaults to the first listen address that is a specific ip,
+// and should be set when clients reach the proxy on a different address than it binds to, such as behind a port
+// mapping.
+//
+// Setting TLSPort, or HTTPSPort also serves queries as dns over tls, and dns over https, using certificates from
+// Certs. Clients that trust the MITMProxy certificate authority will accept these servers.
 type DNSServer struct {
-	server    *dns.Server
-	dnsRegex  *regexp.Regexp
-	record    *dns.A
-	dnsClient *dns.Client
+	rules         []*DNSRule
+	forwarder     dns.RoundTripper
+	staticRecords dnsZone
+	cache         *dnsCache
 
 	ListenAddr       string `json:"listen_addr"`        // UDP address to listen for dns requests
 	Port             int    `json:"port"`               // UDP Port to listen for dns requests
 	ForwardDNSServer string `json:"forward_dns_server"` // Forward DNS server to query for each request
-	DNSRegex         string `json:"dns_regex"`          // A record requests that match this pattern will return the proxy ip
+
+	ListenAddrs    []string `json:"listen_addrs"`    // Addresses, or interface names to listen on, replacing ListenAddr
+	AdvertisedAddr string   `json:"advertised_addr"` // IP returned in redirected answers
+
+	// ForwardDNSServers are additional forwarders, used in order when ForwardDNSServer fails. Forwarders are either
+	// an ip address with an optional port, tls:// for dns over tls, or https:// for dns over https.
+	ForwardDNSServers   []string `json:"forward_dns_servers"`
+	HealthCheckInterval int      `json:"health_check_interval"` // Seconds between forwarder health checks
+
+	DNSRegex      string             `json:"dns_regex"`      // A record requests that match this pattern will return the proxy ip
+	Rules         []*DNSRule         `json:"rules"`          // Ordered rules, evaluated before DNSRegex
+	StaticRecords []*DNSStaticRecord `json:"static_records"` // Records answered locally
+	HostsFile     string             `json:"hosts_file"`     // Hosts format file of A and AAAA records answered locally
+	TLSPort       int                `json:"tls_port"`       // TCP Port to listen for dns over tls requests, a zero value disables the server
+	HTTPSPort     int                `json:"https_port"`     // TCP Port to listen for dns over https requests, a zero value disables the server
+	HTTPSPath     string             `json:"https_path"`     // URL path of dns over https requests, DefaultDNSHTTPSPath if empty
+	Certs         *Certs             `json:"-"`              // Certificate cache for dns over tls, and dns over https
+
+	// RecordFile is a file every forwarded answer is appended to. ReplayFile is a file previously written to
+	// RecordFile, that answers are served from without forwarding. When only ReplayFile is set, queries without a
+	// recorded answer fail, and no upstream forwarder is contacted. When both are set, queries without a recorded
+	// answer are forwarded, and recorded.
+	RecordFile string `json:"record_file"`
+	ReplayFile string `json:"replay_file"`
+
+	// Forwarded answers are cached for the lowest ttl of the answer, clamped to CacheMinTTL, and CacheMaxTTL when
+	// they are set. Nxdomain, and no data answers are cached for NegativeCacheTTL, or the SOA minimum of the answer
+	// when NegativeCacheTTL is zero. A negative CacheSize disables the cache, and a negative NegativeCacheTTL
+	// disables negative caching. All ttls are in seconds.
+	CacheSize          int `json:"cache_size"`           // Maximum cached answers, DefaultDNSCacheSize if zero
+	CacheMinTTL        int `json:"cache_min_ttl"`        // Lowest ttl an answer is cached, and returned with
+	CacheMaxTTL        int `json:"cache_max_ttl"`        // Highest ttl an answer is cached, and returned with
+	NegativeCacheTTL   int `json:"negative_cache_ttl"`   // Seconds nxdomain, and no data answers are cached
+	CacheStatsInterval int `json:"cache_stats_interval"` // Seconds between cache stats log messages, negative disables
+	RewriteTTL         int `json:"rewrite_ttl"`          // TTL of redirected answers, DefaultDNSRewriteTTL if zero
+
+	// Faults delay, or fail questions matching fault rules without a path. Call Faults.Load after setting.
+	Faults *FaultInjector `json:"faults"`
+
+	// Filter answers questions for blocked hosts with nxdomain, or refused. Call Filter.Load after setting.
+	Filter *HostFilter `json:"filter"`
+
+	// ClientACL drops queries, and closes connections from denied clients on every listener. Call ClientACL.Load
+	// after setting.
+	ClientACL *ClientACL `json:"client_acl"`
 }
 
-// ListenAndServe starts a forwarding DNS server on both the TCP and UDP network address ListenAddr.
+// ListenAndServe starts a forwarding DNS server on both the TCP and UDP network address of each listen address, and
+// the dns over tls, and dns over https servers if configured. It blocks until the first server returns an error.
 func (d *DNSServer) ListenAndServe() (err error) {
 
-	d.record = &dns.A{A: net.ParseIP(d.ListenAddr).To4()}
-	d.dnsRegex, err = regexp.Compile(d.DNSRegex)
+	if (d.TLSPort > 0 || d.HTTPSPort > 0) && d.Certs == nil {
+		return ERRDNSNoCerts.Err()
+	}
+
+	listenAddrs, err := resolveListenAddrs(d.ListenAddrs, d.ListenAddr)
+	if err != nil {
+		return err
+	}
 
-	if d.ForwardDNSServer == "" {
+	advertisedAddr := d.AdvertisedAddr
+	if advertisedAddr == "" {
+		advertisedAddr = advertisableAddr(listenAddrs)
+	}
+
+	d.rules = append([]*DNSRule{}, d.Rules...)
+	if net.ParseIP(advertisedAddr) != nil {
+		d.rules = append(d.rules, &DNSRule{Pattern: d.DNSRegex, Action: DNSActionRedirect, Target: advertisedAddr})
+	} else {
+		log.WithField("listen_addrs", listenAddrs).
+			WithField("advertised_addr", d.AdvertisedAddr).
+			Warning("no advertised ip address, dns_regex redirect disabled")
+	}
+	for _, rule := range d.rules {
+		if err = rule.compile(); err != nil {
+			return err
+		}
+	}
+
+	d.staticRecords = dnsZone{}
+	if err = d.staticRecords.addRecords(d.StaticRecords); err != nil {
+		return err
+	}
+	if d.HostsFile != "" {
+		if err = d.staticRecords.addHostsFile(d.HostsFile); err != nil {
+			return err
+		}
+	}
+
+	if d.ForwardDNSServer == "" && len(d.ForwardDNSServers) == 0 {
 		d.ForwardDNSServer = DefaultDNSServer
 	}
 
-	d.dnsClient = &dns.Client{
-		Transport: &dns.Transport{
-			Proxy: dns.NameServers{
-				&net.TCPAddr{IP: net.ParseIP(d.ForwardDNSServer), Port: 53},
-				&net.UDPAddr{IP: net.ParseIP(d.ForwardDNSServer), Port: 53},
-			}.RoundRobin(),
-		},
-		Resolver: new(dns.Cache),
+	var forwardServers []string
+	if d.ForwardDNSServer != "" {
+		forwardServers = append(forwardServers, d.ForwardDNSServer)
+	}
+	forwarders, err := newDNSForwarderGroup(append(forwardServers, d.ForwardDNSServers...))
+	if err != nil {
+		return err
 	}
+	d.forwarder = forwarders
 
-	d.server = &dns.Server{
-		Addr:    fmt.Sprintf("%s:%d", d.ListenAddr, d.Port),
-		Handler: d,
+	if d.ReplayFile != "" || d.RecordFile != "" {
+		if err = d.setupRecordReplay(); err != nil {
+			return err
+		}
+	}
+
+	if d.CacheSize >= 0 {
+		d.setupCache()
 	}
-	log.WithField("addr", fmt.Sprintf("%s:%d", d.ListenAddr, d.Port)).
-		Info("dns server started")
 
-	return d.server.ListenAndServe(context.Background())
+	if d.ReplayFile == "" || d.RecordFile != "" {
+		healthCheckInterval := DefaultDNSHealthCheckInterval
+		if d.HealthCheckInterval > 0 {
+			healthCheckInterval = time.Duration(d.HealthCheckInterval) * time.Second
+		}
+		go forwarders.healthCheck(context.Background(), healthCheckInterval)
+	}
+
+	if d.HTTPSPath == "" {
+		d.HTTPSPath = DefaultDNSHTTPSPath
+	}
+
+	serverErrors := make(chan error, 3*len(listenAddrs))
+	for _, addr := range listenAddrs {
+
+		go func(addr string) {
+			serverErrors <- d.listenAndServe(context.Background(), addr)
+		}(addr)
+
+		if d.TLSPort > 0 {
+			go func(addr string) {
+				serverErrors <- d.listenAndServeTLS(context.Background(), addr)
+			}(addr)
+		}
+
+		if d.HTTPSPort > 0 {
+			go func(addr string) {
+				serverErrors <- d.listenAndServeHTTPS(addr)
+			}(addr)
+		}
+	}
+
+	return <-serverErrors
+}
+
+// listenAndServe starts a dns server on both the TCP and UDP network address addr, and Port.
+func (d *DNSServer) listenAndServe(ctx context.Context, addr string) error {
+
+	ln, err := net.Listen("tcp", listenAddress(addr, d.Port))
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenPacket("udp", listenAddress(addr, d.Port))
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+
+	server := &dns.Server{Handler: d}
+	log.WithField("addr", listenAddress(addr, d.Port)).Info("dns server started")
+
+	serverErrors := make(chan error, 2)
+	go func() { serverErrors <- server.Serve(ctx, d.ClientACL.listener(ln)) }()
+	go func() { serverErrors <- server.ServePacket(ctx, d.ClientACL.packetConn(conn)) }()
+
+	return <-serverErrors
 }
 
-// ServeDNS handles incoming dns requests, forwarding to an upstream server, and overwriting A record answers
-// that match the pattern in DNSRegex.
+// ServeDNS handles incoming dns requests, answering from the static records, or applying the first matching rule
+// to each question. Matching questions are refused, answered nxdomain, or forwarded upstream with A and AAAA
+// answers rewritten to the redirect ip.
+//
+// The upstream response code, authority, and additional records are returned to the client, so servfail, refused,
+// and no data answers are not reported as nxdomain. A forwarding error is answered servfail. Redirected questions
+// are answered with the redirect ip, even when the upstream has no record for the name.
 func (d *DNSServer) ServeDNS(ctx context.Context, w dns.MessageWriter, r *dns.Query) {
 
-	var found bool
+	var found, failed bool
+	var authoritative = true
+	var status = dns.NoError
 
 	logMsg := log.WithDNSQuestions(r.Questions)
 
-	res, err := d.dnsClient.Do(context.Background(), r)
-	if err != nil {
-		logMsg.WithDNSNXDomain().WithError(err).Error("dns client forwarding failed")
-		w.Status(dns.NXDomain)
-		return
-	}
+	for _, q := range r.Questions {
+
+		if fault := d.Faults.matchQuestion(q); fault != nil {
+			logMsg.WithField("fault", fault.String())
+			fault.delay(ctx)
+			if fault.DNSFailure != DNSFailureNone {
+				status = fault.DNSFailure.rcode()
+				continue
+			}
+		}
+
+		if blocked, rule := d.Filter.matchQuestion(q); blocked {
+			logMsg.WithField("blocked", rule)
+			status = d.Filter.dnsRCode()
+			continue
+		}
+
+		if answers, ok := d.staticRecords.lookup(q); ok {
+			for _, answer := range answers {
+				logMsg.WithDNSAnswer(answer.Name, answer.TTL, answer.Record)
+				w.Answer(answer.Name, answer.TTL, answer.Record)
+				found = true
+			}
+			logMsg.WithField("static", true)
+			continue
+		}
+
+		rule := d.matchRule(q)
+		if rule != nil {
+			logMsg.WithField("dns_rule", rule.String())
+		}
 
-	for _, upstreamDNS := range res.Answers {
+		var forwarder = d.forwarder
+		if rule != nil {
+			switch rule.Action {
+			case DNSActionNXDomain:
+				status = dns.NXDomain
+				continue
+			case DNSActionRefused:
+				status = dns.Refused
+				continue
+			case DNSActionForward:
+				forwarder = rule.forwarder
+			}
+		}
+		authoritative = false
+
+		forwardMessage := *r.Message
+		forwardMessage.Questions = []dns.Question{q}
 
-		var matchRegex bool
-		if d.dnsRegex.MatchString(upstreamDNS.Name) {
-			matchRegex = true
+		res, err := forwarder.Do(ctx, &dns.Query{Message: &forwardMessage, RemoteAddr: r.RemoteAddr})
+		if err != nil {
+			logMsg.WithError(err)
+			status = dns.ServFail
+			failed = true
+			continue
 		}
 
-		if upstreamDNS.Record.Type() == dns.TypeA && matchRegex {
-			logMsg.WithDNSAnswer(upstreamDNS.Name, time.Minute, d.record)
-			w.Answer(upstreamDNS.Name, time.Minute, d.record)
+		var rewritten bool
+		for _, upstreamDNS := range res.Answers {
+
+			record, ttl := upstreamDNS.Record, upstreamDNS.TTL
+			if rule != nil {
+				if rewrite, ok := rule.rewrite(record); ok {
+					if rewrite == nil {
+						logMsg.WithField(ignoredField(record), true)
+						continue
+					}
+					record, ttl = rewrite, d.rewriteTTL()
+					rewritten = true
+				}
+			}
+
+			logMsg.WithDNSAnswer(upstreamDNS.Name, ttl, record)
+			w.Answer(upstreamDNS.Name, ttl, record)
 			found = true
-		} else if upstreamDNS.Record.Type() == dns.TypeAAAA && matchRegex {
-			logMsg.WithField("ignored_aaaa", true)
-		} else {
-			logMsg.WithDNSAnswer(upstreamDNS.Name, upstreamDNS.TTL, upstreamDNS.Record)
-			w.Answer(upstreamDNS.Name, upstreamDNS.TTL, upstreamDNS.Record)
+		}
+
+		if !rewritten && rule != nil && rule.synthesize(q) && (res.RCode == dns.NoError || res.RCode == dns.NXDomain) {
+			logMsg.WithDNSAnswer(q.Name, d.rewriteTTL(), rule.record)
+			logMsg.WithField("synthesized", true)
+			w.Answer(q.Name, d.rewriteTTL(), rule.record)
 			found = true
+			continue
+		}
+
+		if res.RCode != dns.NoError {
+			status = res.RCode
+		}
+
+		for _, authority := range res.Authorities {
+			w.Authority(authority.Name, authority.TTL, authority.Record)
+		}
+		for _, additional := range res.Additionals {
+			if additional.Record.Type() == dns.TypeOPT {
+				continue
+			}
+			w.Additional(additional.Name, additional.TTL, additional.Record)
 		}
 	}
 
+	w.Authoritative(authoritative)
 	if !found {
-		logMsg.WithDNSNXDomain()
-		w.Status(dns.NXDomain)
+		w.Status(status)
+		switch status {
+		case dns.NoError:
+			logMsg.WithField("nodata", true)
+		case dns.NXDomain:
+			logMsg.WithDNSNXDomain()
+		default:
+			logMsg.WithField("rcode", dnsRCodeName(status))
+		}
+	}
+
+	if failed {
+		logMsg.Error("dns client forwarding failed")
+		return
 	}
 
 	logMsg.Info("")
 }
+
+// setupRecordReplay wraps the forwarder, and the forwarders of forward rules, to replay answers from ReplayFile, and
+// record answers to RecordFile.
+func (d *DNSServer) setupRecordReplay() (err error) {
+
+	var replay dnsReplayStore
+	if d.ReplayFile != "" {
+		if replay, err = loadDNSReplayStore(d.ReplayFile); err != nil {
+			return err
+		}
+		log.WithField("replay_file", d.ReplayFile).WithField("answers", len(replay)).Info("dns replay loaded")
+	}
+
+	var record *dnsRecordFile
+	if d.RecordFile != "" {
+		record = &dnsRecordFile{filename: d.RecordFile}
+	}
+
+	wrap := func(forwarder dns.RoundTripper) dns.RoundTripper {
+		if replay != nil && record == nil {
+			forwarder = nil
+		}
+		return &dnsRecordReplay{forwarder: forwarder, replay: replay, record: record}
+	}
+
+	d.forwarder = wrap(d.forwarder)
+	for _, rule := range d.rules {
+		if rule.forwarder != nil {
+			rule.forwarder = wrap(rule.forwarder)
+		}
+	}
+
+	return nil
+}
+
+// setupCache wraps the forwarder, and the forwarders of forward rules, with a shared answer cache, and starts logging
+// the cache stats.
+func (d *DNSServer) setupCache() {
+
+	negativeTTL := time.Duration(d.NegativeCacheTTL) * time.Second
+	if d.NegativeCacheTTL < 0 {
+		negativeTTL = -1
+	}
+
+	d.cache = newDNSCache(
+		d.CacheSize,
+		time.Duration(d.CacheMinTTL)*time.Second,
+		time.Duration(d.CacheMaxTTL)*time.Second,
+		negativeTTL,
+	)
+
+	d.forwarder = d.cache.wrap(d.forwarder)
+	for _, rule := range d.rules {
+		if rule.forwarder != nil {
+			rule.forwarder = d.cache.wrap(rule.forwarder)
+		}
+	}
+
+	if d.CacheStatsInterval >= 0 {
+		statsInterval := DefaultDNSCacheStatsInterval
+		if d.CacheStatsInterval > 0 {
+			statsInterval = time.Duration(d.CacheStatsInterval) * time.Second
+		}
+		go d.cache.logStats(context.Background(), statsInterval)
+	}
+}
+
+// rewriteTTL returns the ttl of redirected answers.
+func (d *DNSServer) rewriteTTL() time.Duration {
+
+	if d.RewriteTTL > 0 {
+		return time.Duration(d.RewriteTTL) * time.Second
+	}
+
+	return DefaultDNSRewriteTTL
+}
+
+// dnsRCodeName returns the lower case name of a response code for logging.
+func dnsRCodeName(rcode dns.RCode) string {
+
+	switch rcode {
+	case dns.NoError:
+		return "noerror"
+	case dns.FormErr:
+		return "formerr"
+	case dns.ServFail:
+		return "servfail"
+	case dns.NXDomain:
+		return "nxdomain"
+	case dns.NotImp:
+		return "notimp"
+	case dns.Refused:
+		return "refused"
+	}
+
+	return fmt.Sprintf("rcode%d", rcode)
+}
+
+// ignoredField returns the log field name recording a dropped redirect answer
+func ignoredField(record dns.Record) string {
+
+	if record.Type() == dns.TypeAAAA {
+		return "ignored_aaaa"
+	}
+
+	return "ignored_a"
+}
+
+// matchRule returns the first rule matching the question, or nil if no rule matches.
+func (d *DNSServer) matchRule(q dns.Question) *DNSRule {
+
+	for _, rule := range d.rules {
+		if rule.Match(q) {
+			return rule
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benburkert/dns"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// DefaultDNSCacheSize is the maximum number of cached answers, if CacheSize is left unset
+const DefaultDNSCacheSize = 4096
+
+// DefaultDNSNegativeCacheTTL is how long nxdomain, and no data answers are cached, when the upstream answer has no
+// SOA record, and NegativeCacheTTL is left unset
+const DefaultDNSNegativeCacheTTL = time.Minute
+
+// DefaultDNSCacheStatsInterval is how often cache stats are logged, if CacheStatsInterval is left unset
+const DefaultDNSCacheStatsInterval = 5 * time.Minute
+
+// DefaultDNSRewriteTTL is the ttl of redirected answers, if RewriteTTL is left unset
+const DefaultDNSRewriteTTL = time.Minute
+
+// dnsQuestionKey identifies an answer by the question name, and type.
+type dnsQuestionKey struct {
+	name  string
+	qType dns.Type
+}
+
+func newDNSQuestionKey(q dns.Question) dnsQuestionKey {
+
+	return dnsQuestionKey{name: strings.ToLower(q.Name), qType: q.Type}
+}
+
+// DNSCacheStats are the counters of a dns cache, logged each stats interval.
+type DNSCacheStats struct {
+	Entries      int    `json:"entries"`
+	Hits         uint64 `json:"hits"`
+	NegativeHits uint64 `json:"negative_hits"`
+	Misses       uint64 `json:"misses"`
+	Expired      uint64 `json:"expired"`
+	Evictions    uint64 `json:"evictions"`
+}
+
+// dnsCacheKey identifies a cached answer by the forwarder that answered it, and the question.
+type dnsCacheKey struct {
+	forwarder int
+	question  dnsQuestionKey
+}
+
+type dnsCacheEntry struct {
+	key      dnsCacheKey
+	msg      *dns.Message
+	stored   time.Time
+	expires  time.Time
+	negative bool
+}
+
+// dnsCache is a least recently used cache of forwarded answers. Answers are cached for the lowest ttl of the answer
+// records, clamped to minTTL, and maxTTL. Nxdomain, and no data answers are cached for negativeTTL, or the SOA
+// minimum of the answer when negativeTTL is zero. Other response codes are never cached.
+type dnsCache struct {
+	lock       sync.Mutex
+	entries    map[dnsCacheKey]*list.Element
+	lru        *list.List
+	forwarders int
+	stats      DNSCacheStats
+
+	maxEntries  int
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+}
+
+func newDNSCache(maxEntries int, minTTL, maxTTL, negativeTTL time.Duration) *dnsCache {
+
+	if maxEntries <= 0 {
+		maxEntries = DefaultDNSCacheSize
+	}
+
+	return &dnsCache{
+		entries:     map[dnsCacheKey]*list.Element{},
+		lru:         list.New(),
+		maxEntries:  maxEntries,
+		minTTL:      minTTL,
+		maxTTL:      maxTTL,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+	}
+}
+
+// wrap returns a forwarder that answers from the cache, and caches the answers of forwarder.
+func (c *dnsCache) wrap(forwarder dns.RoundTripper) dns.RoundTripper {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.forwarders++
+
+	return &dnsCachedForwarder{cache: c, id: c.forwarders, forwarder: forwarder}
+}
+
+// Stats returns a copy of the cache counters.
+func (c *dnsCache) Stats() DNSCacheStats {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+
+	return stats
+}
+
+// logStats logs the cache stats each interval until the context is canceled.
+func (c *dnsCache) logStats(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := c.Stats()
+			log.WithField("entries", stats.Entries).
+				WithField("hits", stats.Hits).
+				WithField("negative_hits", stats.NegativeHits).
+				WithField("misses", stats.Misses).
+				WithField("expired", stats.Expired).
+				WithField("evictions", stats.Evictions).
+				Info("dns cache stats")
+		}
+	}
+}
+
+// get returns a copy of the cached answer, with ttls reduced by the time spent in the cache.
+func (c *dnsCache) get(key dnsCacheKey) (*dns.Message, bool) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	entry := elem.Value.(*dnsCacheEntry)
+	now := c.now()
+	if !now.Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.stats.Expired++
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	if entry.negative {
+		c.stats.NegativeHits++
+	}
+
+	elapsed := now.Sub(entry.stored).Truncate(time.Second)
+	return copyDNSMessage(entry.msg, func(ttl time.Duration) time.Duration {
+		if ttl < elapsed {
+			return 0
+		}
+		return ttl - elapsed
+	}), true
+}
+
+// put caches the answer, if the response code, and ttl allow it, evicting the least recently used answers when the
+// cache is full. The returned message is the answer with clamped ttls, as it will be served from the cache.
+func (c *dnsCache) put(key dnsCacheKey, msg *dns.Message) *dns.Message {
+
+	var ttl time.Duration
+	var negative bool
+	switch {
+	case msg.RCode == dns.NoError && len(msg.Answers) > 0:
+		ttl = c.clamp(minResourceTTL(msg.Answers))
+	case msg.RCode == dns.NXDomain || msg.RCode == dns.NoError:
+		negative = true
+		ttl = c.negativeAnswerTTL(msg)
+	}
+	if ttl <= 0 {
+		return msg
+	}
+
+	now := c.now()
+	entry := &dnsCacheEntry{
+		key:      key,
+		msg:      copyDNSMessage(msg, c.clamp),
+		stored:   now,
+		expires:  now.Add(ttl),
+		negative: negative,
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return copyDNSMessage(entry.msg, keepTTL)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+		c.stats.Evictions++
+	}
+
+	return copyDNSMessage(entry.msg, keepTTL)
+}
+
+// clamp limits a ttl to the cache minimum, and maximum ttl.
+func (c *dnsCache) clamp(ttl time.Duration) time.Duration {
+
+	if c.minTTL > 0 && ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	return ttl
+}
+
+// negativeAnswerTTL returns how long a nxdomain, or no data answer is cached. A negative negativeTTL disables
+// negative caching, zero uses the SOA minimum from the authority section, as described in RFC 2308.
+func (c *dnsCache) negativeAnswerTTL(msg *dns.Message) time.Duration {
+
+	if c.negativeTTL < 0 {
+		return 0
+	}
+
+	ttl := c.negativeTTL
+	if ttl == 0 {
+		ttl = DefaultDNSNegativeCacheTTL
+		for _, res := range msg.Authorities {
+			if soa, ok := res.Record.(*dns.SOA); ok {
+				ttl = res.TTL
+				if soa.MinTTL < ttl {
+					ttl = soa.MinTTL
+				}
+				break
+			}
+		}
+	}
+
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	return ttl
+}
+
+// dnsCachedForwarder is a forwarder wrapped by a dnsCache.
+type dnsCachedForwarder struct {
+	cache     *dnsCache
+	id        int
+	forwarder dns.RoundTripper
+}
+
+// Do answers single question queries from the cache, or forwards the query, and caches the answer.
+func (f *dnsCachedForwarder) Do(ctx context.Context, query *dns.Query) (*dns.Message, error) {
+
+	if len(query.Questions) != 1 {
+		return f.forwarder.Do(ctx, query)
+	}
+
+	key := dnsCacheKey{forwarder: f.id, question: newDNSQuestionKey(query.Questions[0])}
+	if msg, ok := f.cache.get(key); ok {
+		msg.ID = query.ID
+		msg.Questions = query.Questions
+		return msg, nil
+	}
+
+	msg, err := f.forwarder.Do(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.cache.put(key, msg), nil
+}
+
+// minResourceTTL returns the lowest ttl of the resources, ignoring OPT pseudo records.
+func minResourceTTL(resources []dns.Resource) (ttl time.Duration) {
+
+	for _, res := range resources {
+		if res.Record.Type() == dns.TypeOPT {
+			continue
+		}
+		if ttl == 0 || res.TTL < ttl {
+			ttl = res.TTL
+		}
+	}
+
+	return ttl
+}
+
+// keepTTL leaves a ttl unchanged when copying a message
+func keepTTL(ttl time.Duration) time.Duration { return ttl }
+
+// copyDNSMessage returns a copy of the message, with the ttl of each resource, other than OPT pseudo records,
+// replaced by adjust.
+func copyDNSMessage(msg *dns.Message, adjust func(time.Duration) time.Duration) *dns.Message {
+
+	copyResources := func(resources []dns.Resource) []dns.Resource {
+		if resources == nil {
+			return nil
+		}
+		copied := make([]dns.Resource, len(resources))
+		for i, res := range resources {
+			copied[i] = res
+			if res.Record.Type() != dns.TypeOPT {
+				copied[i].TTL = adjust(res.TTL)
+			}
+		}
+		return copied
+	}
+
+	copied := *msg
+	copied.Answers = copyResources(msg.Answers)
+	copied.Authorities = copyResources(msg.Authorities)
+	copied.Additionals = copyResources(msg.Additionals)
+
+	return &copied
+}
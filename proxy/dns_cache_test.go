@@ -0,0 +1,195 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+func TestDNSCache_Do(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := &testDNSRoundTripper{answers: map[string]*dns.Message{
+		"www.test.": {
+			Answers: []dns.Resource{
+				{Name: "www.test.", Class: dns.ClassIN, TTL: 5 * time.Second, Record: &dns.A{A: net.ParseIP("192.0.2.1").To4()}},
+				{Name: "www.test.", Class: dns.ClassIN, TTL: time.Hour, Record: &dns.A{A: net.ParseIP("192.0.2.2").To4()}},
+			},
+		},
+		"missing.test.": {
+			RCode: dns.NXDomain,
+			Authorities: []dns.Resource{{
+				Name:   "test.",
+				Class:  dns.ClassIN,
+				TTL:    time.Hour,
+				Record: &dns.SOA{NS: "ns.test.", MBox: "admin.test.", MinTTL: 30 * time.Second},
+			}},
+		},
+		"broken.test.": {RCode: dns.ServFail},
+	}}
+
+	now := time.Now()
+	cache := newDNSCache(2, 10*time.Second, 120*time.Second, 0)
+	cache.now = func() time.Time { return now }
+	forwarder := cache.wrap(upstream)
+
+	query := func(name string) *dns.Message {
+		msg, err := forwarder.Do(context.Background(), &dns.Query{
+			Message: &dns.Message{
+				ID:        7,
+				Questions: []dns.Question{{Name: name, Type: dns.TypeA, Class: dns.ClassIN}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, received %s", err.Error())
+		}
+		return msg
+	}
+
+	t.Run("clamp", func(subTest *testing.T) {
+		msg := query("www.test.")
+		if msg.Answers[0].TTL != 10*time.Second {
+			subTest.Fatalf("expected ttl clamped to 10s, but received %s", msg.Answers[0].TTL)
+		}
+		if msg.Answers[1].TTL != 120*time.Second {
+			subTest.Fatalf("expected ttl clamped to 2m0s, but received %s", msg.Answers[1].TTL)
+		}
+	})
+
+	t.Run("hit", func(subTest *testing.T) {
+		now = now.Add(4 * time.Second)
+		msg := query("WWW.test.")
+		if upstream.queries != 1 {
+			subTest.Fatalf("expected 1 upstream query, but received %d", upstream.queries)
+		}
+		if msg.ID != 7 {
+			subTest.Fatalf("expected id 7, but received %d", msg.ID)
+		}
+		if msg.Answers[0].TTL != 6*time.Second {
+			subTest.Fatalf("expected remaining ttl 6s, but received %s", msg.Answers[0].TTL)
+		}
+	})
+
+	t.Run("expired", func(subTest *testing.T) {
+		now = now.Add(6 * time.Second)
+		query("www.test.")
+		if upstream.queries != 2 {
+			subTest.Fatalf("expected 2 upstream queries, but received %d", upstream.queries)
+		}
+	})
+
+	t.Run("negative", func(subTest *testing.T) {
+		query("missing.test.")
+		now = now.Add(29 * time.Second)
+		msg := query("missing.test.")
+		if msg.RCode != dns.NXDomain {
+			subTest.Fatalf("expected rcode %d, but received %d", dns.NXDomain, msg.RCode)
+		}
+		if upstream.queries != 3 {
+			subTest.Fatalf("expected 3 upstream queries, but received %d", upstream.queries)
+		}
+		now = now.Add(time.Second)
+		query("missing.test.")
+		if upstream.queries != 4 {
+			subTest.Fatalf("expected negative answer to expire after the SOA minimum")
+		}
+	})
+
+	t.Run("servfail", func(subTest *testing.T) {
+		query("broken.test.")
+		query("broken.test.")
+		if upstream.queries != 6 {
+			subTest.Fatalf("expected servfail to not be cached, but received %d upstream queries", upstream.queries)
+		}
+	})
+
+	t.Run("stats", func(subTest *testing.T) {
+		stats := cache.Stats()
+		if stats.Entries != 2 {
+			subTest.Fatalf("expected 2 entries, but received %d", stats.Entries)
+		}
+		if stats.Hits != 2 || stats.NegativeHits != 1 {
+			subTest.Fatalf("expected 2 hits, and 1 negative hit, but received %+v", stats)
+		}
+		if stats.Expired != 2 {
+			subTest.Fatalf("expected 2 expired, but received %d", stats.Expired)
+		}
+		query("other.test.")
+		if stats = cache.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+			subTest.Fatalf("expected 1 eviction, and 2 entries, but received %+v", stats)
+		}
+	})
+}
+
+func TestDNSServer_ServeDNS_rewriteTTL(t *testing.T) {
+
+	t.Parallel()
+
+	rule := &DNSRule{Pattern: `\.test\.$`, Action: DNSActionRedirect, Target: "10.0.0.1"}
+	if err := rule.compile(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	for _, test := range []struct {
+		rewriteTTL int
+		expected   time.Duration
+	}{
+		{0, DefaultDNSRewriteTTL},
+		{5, 5 * time.Second},
+	} {
+		d := &DNSServer{
+			rules:      []*DNSRule{rule},
+			RewriteTTL: test.rewriteTTL,
+			forwarder: &testDNSRoundTripper{answers: map[string]*dns.Message{
+				"www.test.": {Answers: []dns.Resource{
+					{Name: "www.test.", Class: dns.ClassIN, TTL: time.Hour, Record: &dns.A{A: net.ParseIP("192.0.2.1").To4()}},
+				}},
+			}},
+		}
+
+		w := &testDNSWriter{}
+		d.ServeDNS(context.Background(), w, &dns.Query{
+			Message: &dns.Message{
+				Questions: []dns.Question{{Name: "www.test.", Type: dns.TypeA, Class: dns.ClassIN}},
+			},
+		})
+
+		if len(w.answers) != 1 || w.answers[0].TTL != test.expected {
+			t.Fatalf("expected one answer with ttl %s, but received %v", test.expected, w.answers)
+		}
+	}
+}
+
+// testDNSRoundTripper answers queries from a map of question names, counting each query. Names missing from the map
+// are answered nxdomain, and every query fails when err is set.
+type testDNSRoundTripper struct {
+	answers map[string]*dns.Message
+	queries int
+	err     error
+}
+
+func (r *testDNSRoundTripper) Do(ctx context.Context, query *dns.Query) (*dns.Message, error) {
+
+	r.queries++
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	msg := &dns.Message{RCode: dns.NXDomain}
+	if answer, ok := r.answers[query.Questions[0].Name]; ok {
+		copied := *answer
+		msg = &copied
+	}
+	msg.ID = query.ID
+	msg.Response = true
+	msg.Questions = query.Questions
+
+	return msg, nil
+}
@@ -0,0 +1,294 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benburkert/dns"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// Error dns forwarder address is invalid
+const ERRDNSForwarderInvalid = ErrorStr("invalid dns forwarder")
+
+// Error every dns forwarder failed to answer the query
+const ERRDNSForwardFailed = ErrorStr("all dns forwarders failed")
+
+// Error dns over https forwarder returned an unexpected response
+const ERRDNSHTTPSResponse = ErrorStr("dns over https forwarder bad response")
+
+// DefaultDNSHealthCheckInterval is how often forwarders are checked, if HealthCheckInterval is left unset
+const DefaultDNSHealthCheckInterval = 30 * time.Second
+
+// DefaultDNSForwardTimeout is how long a single forwarder is given to answer, before failing over to the next
+const DefaultDNSForwardTimeout = 5 * time.Second
+
+// newDNSForwarder returns a dns.RoundTripper for a forwarder address. Supported formats are:
+//
+//	8.8.8.8, 127.0.0.1:5353                plain dns over udp, and tcp, port 53 if omitted
+//	tls://1.1.1.1, tls://dns.google:853   dns over tls, port 853 if omitted
+//	https://dns.google/dns-query           dns over https
+func newDNSForwarder(server string) (dns.RoundTripper, error) {
+
+	if strings.HasPrefix(server, "https://") {
+		return &dnsHTTPSClient{
+			URL:    server,
+			Client: &http.Client{Timeout: DefaultDNSForwardTimeout},
+		}, nil
+	}
+
+	if strings.HasPrefix(server, "tls://") {
+
+		host, port, err := splitDNSServer(strings.TrimPrefix(server, "tls://"), 853)
+		if err != nil {
+			return nil, err
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ips, err := net.LookupIP(host)
+			if err != nil || len(ips) == 0 {
+				return nil, ERRDNSForwarderInvalid.Err().WithReason("unable to resolve %q", host)
+			}
+			ip = ips[0]
+		}
+		addr := dns.OverTLSAddr{Addr: &net.TCPAddr{IP: ip, Port: port}}
+
+		return &dns.Client{
+			Transport: &dns.Transport{
+				TLSConfig: &tls.Config{ServerName: host},
+				Proxy: func(context.Context, net.Addr) (net.Addr, error) {
+					return addr, nil
+				},
+			},
+		}, nil
+	}
+
+	host, port, err := splitDNSServer(server, 53)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ERRDNSForwarderInvalid.Err().WithReason("invalid dns server address %q", server)
+	}
+
+	return &dns.Client{
+		Transport: &dns.Transport{
+			Proxy: dns.NameServers{
+				&net.TCPAddr{IP: ip, Port: port},
+				&net.UDPAddr{IP: ip, Port: port},
+			}.RoundRobin(),
+		},
+	}, nil
+}
+
+// splitDNSServer splits a host, and optional port. Bare ipv6 addresses are returned with the default port.
+func splitDNSServer(server string, defaultPort int) (string, int, error) {
+
+	host, portStr, err := net.SplitHostPort(server)
+	if err != nil {
+		return server, defaultPort, nil
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, ERRDNSForwarderInvalid.Err().WithReason("invalid port in dns server address %q", server)
+	}
+
+	return host, port, nil
+}
+
+// dnsHTTPSClient is a dns over https, RFC 8484, client.
+type dnsHTTPSClient struct {
+	URL    string
+	Client *http.Client
+}
+
+// Do sends the query as a dns over https POST request, and returns the response message.
+func (c *dnsHTTPSClient) Do(ctx context.Context, query *dns.Query) (*dns.Message, error) {
+
+	msg := *query.Message
+	msg.ID = 0
+	msgBytes, err := msg.Pack(nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(msgBytes))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ERRDNSHTTPSResponse.Err().WithReason("status code %d", resp.StatusCode)
+	}
+
+	resBytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessageLength))
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(dns.Message)
+	if _, err = res.Unpack(resBytes); err != nil {
+		return nil, ERRDNSHTTPSResponse.Err().WithError(err)
+	}
+	res.ID = query.ID
+
+	return res, nil
+}
+
+// dnsUpstream is a forwarder, and its health state.
+type dnsUpstream struct {
+	address string
+	client  dns.RoundTripper
+
+	lock    sync.RWMutex
+	healthy bool
+}
+
+func (u *dnsUpstream) isHealthy() bool {
+
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.healthy
+}
+
+// setHealthy updates the health state, logging the transition.
+func (u *dnsUpstream) setHealthy(healthy bool, err error) {
+
+	u.lock.Lock()
+	changed := u.healthy != healthy
+	u.healthy = healthy
+	u.lock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if healthy {
+		log.WithField("forward_dns_server", u.address).Info("dns forwarder healthy")
+	} else {
+		log.WithField("forward_dns_server", u.address).WithError(err).Warning("dns forwarder unhealthy")
+	}
+}
+
+// dnsForwarderGroup forwards queries to the first healthy forwarder, failing over to the next on error. Forwarders
+// marked unhealthy are only used when no healthy forwarder answers, and are restored by the health check.
+type dnsForwarderGroup struct {
+	upstreams []*dnsUpstream
+	timeout   time.Duration
+}
+
+// newDNSForwarderGroup creates a forwarder for each address, in failover order.
+func newDNSForwarderGroup(servers []string) (*dnsForwarderGroup, error) {
+
+	g := &dnsForwarderGroup{timeout: DefaultDNSForwardTimeout}
+	for _, server := range servers {
+
+		client, err := newDNSForwarder(server)
+		if err != nil {
+			return nil, err
+		}
+
+		g.upstreams = append(g.upstreams, &dnsUpstream{address: server, client: client, healthy: true})
+	}
+
+	if len(g.upstreams) == 0 {
+		return nil, ERRDNSForwarderInvalid.Err().WithReason("no forwarders configured")
+	}
+
+	return g, nil
+}
+
+// Do sends the query to each forwarder in order, healthy forwarders first, until one answers.
+func (g *dnsForwarderGroup) Do(ctx context.Context, query *dns.Query) (*dns.Message, error) {
+
+	var healthy, unhealthy []*dnsUpstream
+	for _, upstream := range g.upstreams {
+		if upstream.isHealthy() {
+			healthy = append(healthy, upstream)
+		} else {
+			unhealthy = append(unhealthy, upstream)
+		}
+	}
+
+	var lastErr error
+	for _, upstream := range append(healthy, unhealthy...) {
+
+		attemptCtx, cancel := context.WithTimeout(ctx, g.timeout)
+		msg, err := upstream.client.Do(attemptCtx, query)
+		cancel()
+
+		if err != nil {
+			upstream.setHealthy(false, err)
+			lastErr = fmt.Errorf("%s: %s", upstream.address, err.Error())
+			continue
+		}
+
+		upstream.setHealthy(true, nil)
+		return msg, nil
+	}
+
+	return nil, ERRDNSForwardFailed.Err().WithError(lastErr)
+}
+
+// healthCheck probes every forwarder each interval until the context is canceled.
+func (g *dnsForwarderGroup) healthCheck(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, upstream := range g.upstreams {
+				upstream.setHealthy(g.check(ctx, upstream))
+			}
+		}
+	}
+}
+
+// check sends a root NS query to the forwarder, returning true if the forwarder answered.
+func (g *dnsForwarderGroup) check(ctx context.Context, upstream *dnsUpstream) (bool, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	_, err := upstream.client.Do(ctx, &dns.Query{
+		Message: &dns.Message{
+			RecursionDesired: true,
+			Questions:        []dns.Question{{Name: ".", Type: dns.TypeNS, Class: dns.ClassIN}},
+		},
+		RemoteAddr: &net.UDPAddr{},
+	})
+
+	return err == nil, err
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+func TestDNSForwarderGroup_Do(t *testing.T) {
+
+	t.Parallel()
+
+	upstreamAddr, shutdown := testDNSUpstream(t, dns.HandlerFunc(
+		func(ctx context.Context, w dns.MessageWriter, r *dns.Query) {
+			for _, q := range r.Questions {
+				w.Answer(q.Name, time.Hour, &dns.A{A: net.ParseIP("192.0.2.1").To4()})
+			}
+		}))
+	defer shutdown()
+
+	// Reserve a port, and close it, so the first forwarder refuses connections
+	deadConn, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatalf("failed to open a port for the dead forwarder, %s", err.Error())
+	}
+	deadAddr := deadConn.LocalAddr().String()
+	_ = deadConn.Close()
+
+	g, err := newDNSForwarderGroup([]string{deadAddr, upstreamAddr})
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	msg, err := g.Do(context.Background(), &dns.Query{
+		Message: &dns.Message{
+			Questions: []dns.Question{{Name: "www.test.", Type: dns.TypeA, Class: dns.ClassIN}},
+		},
+		RemoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353},
+	})
+	if err != nil {
+		t.Fatalf("expected failover to answer, received %s", err.Error())
+	}
+	if len(msg.Answers) != 1 {
+		t.Fatalf("expected one answer, but received %v", msg.Answers)
+	}
+
+	if g.upstreams[0].isHealthy() {
+		t.Fatalf("expected %s to be marked unhealthy", deadAddr)
+	}
+	if !g.upstreams[1].isHealthy() {
+		t.Fatalf("expected %s to be marked healthy", upstreamAddr)
+	}
+}
+
+func TestDNSHTTPSClient_Do(t *testing.T) {
+
+	t.Parallel()
+
+	zone := dnsZone{}
+	if err := zone.addRecords([]*DNSStaticRecord{{Name: "api.test.internal", Type: "A", Value: "10.0.0.1"}}); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	server := httptest.NewTLSServer(&DNSServer{staticRecords: zone, HTTPSPath: DefaultDNSHTTPSPath})
+	defer server.Close()
+
+	forwarder, err := newDNSForwarder(server.URL + DefaultDNSHTTPSPath)
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	forwarder.(*dnsHTTPSClient).Client = server.Client()
+
+	msg, err := forwarder.Do(context.Background(), &dns.Query{
+		Message: &dns.Message{
+			ID:        4321,
+			Questions: []dns.Question{{Name: "api.test.internal.", Type: dns.TypeA, Class: dns.ClassIN}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if msg.ID != 4321 {
+		t.Fatalf("expected message id 4321, but received %d", msg.ID)
+	}
+	if len(msg.Answers) != 1 {
+		t.Fatalf("expected one answer, but received %v", msg.Answers)
+	}
+}
+
+func TestNewDNSForwarder_invalid(t *testing.T) {
+
+	t.Parallel()
+
+	for _, server := range []string{"dns.google", "8.8.8.8:dns", "tls://8.8.8.8:dot"} {
+		if _, err := newDNSForwarder(server); err == nil {
+			t.Fatalf("expected error for forwarder %s", server)
+		}
+	}
+}
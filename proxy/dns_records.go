@@ -0,0 +1,215 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+// Error unable to parse a static dns record
+const ERRDNSRecordParse = ErrorStr("parse dns record failed")
+
+// Error unable to read the hosts file
+const ERRDNSHostsFileRead = ErrorStr("read hosts file failed")
+
+// DefaultDNSRecordTTL is the ttl returned with static records, and rewritten answers when no ttl is set
+const DefaultDNSRecordTTL = time.Minute
+
+// maxCNAMEChain limits how many static CNAME records will be followed when answering a query
+const maxCNAMEChain = 8
+
+// DNSStaticRecord is a dns record that DNSServer answers locally, without querying the forward dns server. Value
+// is formatted the same as the record data in a zone file:
+//
+//	A, AAAA  an ip address, "10.0.0.1"
+//	CNAME    a host name, "proxy.test.internal"
+//	TXT      the text value, "v=spf1 -all"
+//	SRV      priority, weight, port and target, "10 5 8443 proxy.test.internal"
+type DNSStaticRecord struct {
+	Name  string `json:"name"`  // Fully qualified name of the record
+	Type  string `json:"type"`  // Record type, one of A, AAAA, CNAME, TXT, or SRV
+	Value string `json:"value"` // Record data
+	TTL   int    `json:"ttl"`   // TTL in seconds, a zero value uses DefaultDNSRecordTTL
+}
+
+// Resource converts the static record to a dns resource.
+func (r *DNSStaticRecord) Resource() (res dns.Resource, err error) {
+
+	res.Name = dnsName(r.Name)
+	res.Class = dns.ClassIN
+	res.TTL = DefaultDNSRecordTTL
+	if r.TTL > 0 {
+		res.TTL = time.Duration(r.TTL) * time.Second
+	}
+
+	switch strings.ToUpper(r.Type) {
+	case "A":
+		ip := net.ParseIP(r.Value).To4()
+		if ip == nil {
+			return res, ERRDNSRecordParse.Err().WithReason("%s invalid ipv4 address %q", r.Name, r.Value)
+		}
+		res.Record = &dns.A{A: ip}
+	case "AAAA":
+		ip := net.ParseIP(r.Value)
+		if ip == nil || ip.To4() != nil {
+			return res, ERRDNSRecordParse.Err().WithReason("%s invalid ipv6 address %q", r.Name, r.Value)
+		}
+		res.Record = &dns.AAAA{AAAA: ip}
+	case "CNAME":
+		if r.Value == "" {
+			return res, ERRDNSRecordParse.Err().WithReason("%s empty cname", r.Name)
+		}
+		res.Record = &dns.CNAME{CNAME: dnsName(r.Value)}
+	case "TXT":
+		res.Record = &dns.TXT{TXT: splitTXT(r.Value)}
+	case "SRV":
+		fields := strings.Fields(r.Value)
+		if len(fields) != 4 {
+			return res, ERRDNSRecordParse.Err().WithReason("%s srv value must be \"priority weight port target\"", r.Name)
+		}
+		var values [3]int
+		for i := range values {
+			if values[i], err = strconv.Atoi(fields[i]); err != nil {
+				return res, ERRDNSRecordParse.Err().WithReason("%s invalid srv value %q", r.Name, r.Value)
+			}
+		}
+		res.Record = &dns.SRV{Priority: values[0], Weight: values[1], Port: values[2], Target: dnsName(fields[3])}
+	default:
+		return res, ERRDNSRecordParse.Err().WithReason("%s unsupported record type %q", r.Name, r.Type)
+	}
+
+	return res, nil
+}
+
+// dnsZone is a lookup table of static records, keyed by the lower case fully qualified name.
+type dnsZone map[string][]dns.Resource
+
+// add inserts a resource into the zone.
+func (z dnsZone) add(res dns.Resource) {
+
+	name := strings.ToLower(res.Name)
+	z[name] = append(z[name], res)
+}
+
+// addRecords converts, and adds the static records to the zone.
+func (z dnsZone) addRecords(records []*DNSStaticRecord) error {
+
+	for _, record := range records {
+		res, err := record.Resource()
+		if err != nil {
+			return err
+		}
+		z.add(res)
+	}
+
+	return nil
+}
+
+// addHostsFile adds A, and AAAA records for every entry in a hosts format file. Each line is an ip address,
+// followed by one or more names. Text following a # is ignored.
+func (z dnsZone) addHostsFile(filename string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return ERRDNSHostsFileRead.Err().WithError(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return ERRDNSRecordParse.Err().WithReason("%s:%d missing host name", filename, lineNumber)
+		}
+
+		recordType := "A"
+		if ip := net.ParseIP(fields[0]); ip != nil && ip.To4() == nil {
+			recordType = "AAAA"
+		}
+
+		for _, name := range fields[1:] {
+			res, err := (&DNSStaticRecord{Name: name, Type: recordType, Value: fields[0]}).Resource()
+			if err != nil {
+				return ERRDNSRecordParse.Err().WithReason("%s:%d %s", filename, lineNumber, err.Error())
+			}
+			z.add(res)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return ERRDNSHostsFileRead.Err().WithError(err)
+	}
+
+	return nil
+}
+
+// lookup returns the static answers for a question. The returned bool is true when the zone contains the name, in
+// which case the answers may be empty, signaling the name exists, but has no records of the requested type. CNAME
+// records are followed to static targets of the requested type.
+func (z dnsZone) lookup(q dns.Question) (answers []dns.Resource, ok bool) {
+
+	name := strings.ToLower(q.Name)
+	for i := 0; i < maxCNAMEChain; i++ {
+
+		resources, found := z[name]
+		if !found {
+			return answers, ok
+		}
+		ok = true
+
+		var cname string
+		for _, res := range resources {
+			if q.Type == dns.TypeANY || q.Type == dns.TypeALL || res.Record.Type() == q.Type {
+				answers = append(answers, res)
+			} else if c, isCNAME := res.Record.(*dns.CNAME); isCNAME {
+				answers = append(answers, res)
+				cname = strings.ToLower(c.CNAME)
+			}
+		}
+
+		if cname == "" {
+			break
+		}
+		name = cname
+	}
+
+	return answers, ok
+}
+
+// dnsName returns the name as a fully qualified domain name.
+func dnsName(name string) string {
+
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+
+	return name + "."
+}
+
+// splitTXT splits a txt value into the 255 byte character strings required by the record format.
+func splitTXT(value string) (txt []string) {
+
+	for len(value) > 255 {
+		txt = append(txt, value[:255])
+		value = value[255:]
+	}
+
+	return append(txt, value)
+}
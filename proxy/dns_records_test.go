@@ -0,0 +1,188 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+func TestDNSStaticRecord_Resource(t *testing.T) {
+
+	t.Parallel()
+
+	t.Run("a", func(subTest *testing.T) {
+		res, err := (&DNSStaticRecord{Name: "api.test.internal", Type: "a", Value: "10.0.0.1"}).Resource()
+		if err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+		if res.Name != "api.test.internal." {
+			subTest.Fatalf("expected name api.test.internal., but received %s", res.Name)
+		}
+		if res.TTL != DefaultDNSRecordTTL {
+			subTest.Fatalf("expected ttl %s, but received %s", DefaultDNSRecordTTL, res.TTL)
+		}
+		if a, ok := res.Record.(*dns.A); !ok || !a.A.Equal(net.ParseIP("10.0.0.1")) {
+			subTest.Fatalf("expected A record 10.0.0.1, but received %v", res.Record)
+		}
+	})
+
+	t.Run("srv", func(subTest *testing.T) {
+		res, err := (&DNSStaticRecord{
+			Name:  "_https._tcp.test.internal.",
+			Type:  "SRV",
+			Value: "10 5 8443 api.test.internal",
+			TTL:   30,
+		}).Resource()
+		if err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+		if res.TTL != 30*time.Second {
+			subTest.Fatalf("expected ttl 30s, but received %s", res.TTL)
+		}
+		srv, ok := res.Record.(*dns.SRV)
+		if !ok {
+			subTest.Fatalf("expected SRV record, but received %T", res.Record)
+		}
+		if srv.Priority != 10 || srv.Weight != 5 || srv.Port != 8443 || srv.Target != "api.test.internal." {
+			subTest.Fatalf("unexpected SRV record %+v", srv)
+		}
+	})
+
+	t.Run("invalid", func(subTest *testing.T) {
+		for _, record := range []*DNSStaticRecord{
+			{Name: "a.test", Type: "A", Value: "::1"},
+			{Name: "a.test", Type: "AAAA", Value: "10.0.0.1"},
+			{Name: "a.test", Type: "SRV", Value: "10 5 api.test.internal"},
+			{Name: "a.test", Type: "MX", Value: "10 mail.test"},
+		} {
+			_, err := record.Resource()
+			if err == nil {
+				subTest.Fatalf("expected error for %+v", record)
+			}
+			if !ERRDNSRecordParse.Err().Match(err.(*ProxyError)) {
+				subTest.Fatalf("expected error %s, but received %s", ERRDNSRecordParse, err.Error())
+			}
+		}
+	})
+}
+
+func TestDNSZone_addHostsFile(t *testing.T) {
+
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatalf("failed to create temp file, %s", err.Error())
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	_, err = f.WriteString("# comment\n10.0.0.1 api.test.internal www.test.internal # trailing\n\n::1 api.test.internal\n")
+	if err != nil {
+		t.Fatalf("failed to write temp file, %s", err.Error())
+	}
+	_ = f.Close()
+
+	zone := dnsZone{}
+	if err := zone.addHostsFile(f.Name()); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	answers, ok := zone.lookup(dns.Question{Name: "API.test.internal.", Type: dns.TypeA, Class: dns.ClassIN})
+	if !ok || len(answers) != 1 {
+		t.Fatalf("expected one A answer, but received %v", answers)
+	}
+
+	answers, ok = zone.lookup(dns.Question{Name: "api.test.internal.", Type: dns.TypeAAAA, Class: dns.ClassIN})
+	if !ok || len(answers) != 1 {
+		t.Fatalf("expected one AAAA answer, but received %v", answers)
+	}
+
+	answers, ok = zone.lookup(dns.Question{Name: "www.test.internal.", Type: dns.TypeAAAA, Class: dns.ClassIN})
+	if !ok || len(answers) != 0 {
+		t.Fatalf("expected no data answer, but received %v", answers)
+	}
+
+	if _, ok = zone.lookup(dns.Question{Name: "missing.test.internal.", Type: dns.TypeA, Class: dns.ClassIN}); ok {
+		t.Fatalf("expected lookup of missing name to fail")
+	}
+}
+
+func TestDNSServer_ServeDNS_static(t *testing.T) {
+
+	t.Parallel()
+
+	zone := dnsZone{}
+	err := zone.addRecords([]*DNSStaticRecord{
+		{Name: "alias.test.internal", Type: "CNAME", Value: "api.test.internal"},
+		{Name: "api.test.internal", Type: "A", Value: "10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	d := &DNSServer{staticRecords: zone}
+	w := &testDNSWriter{}
+	d.ServeDNS(context.Background(), w, &dns.Query{
+		Message: &dns.Message{
+			Questions: []dns.Question{{Name: "alias.test.internal.", Type: dns.TypeA, Class: dns.ClassIN}},
+		},
+	})
+
+	if w.rcode != dns.NoError {
+		t.Fatalf("expected rcode %d, but received %d", dns.NoError, w.rcode)
+	}
+	if !w.authoritative {
+		t.Fatalf("expected authoritative answer")
+	}
+	if len(w.answers) != 2 {
+		t.Fatalf("expected CNAME and A answers, but received %v", w.answers)
+	}
+	if _, ok := w.answers[0].Record.(*dns.CNAME); !ok {
+		t.Fatalf("expected first answer to be a CNAME, but received %T", w.answers[0].Record)
+	}
+	if a, ok := w.answers[1].Record.(*dns.A); !ok || !a.A.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected second answer to be A 10.0.0.1, but received %v", w.answers[1].Record)
+	}
+}
+
+// testDNSWriter is a dns.MessageWriter that records the response
+type testDNSWriter struct {
+	authoritative bool
+	recursion     bool
+	rcode         dns.RCode
+	answers       []dns.Resource
+	authorities   []dns.Resource
+	additionals   []dns.Resource
+}
+
+func (w *testDNSWriter) Authoritative(aa bool) { w.authoritative = aa }
+func (w *testDNSWriter) Recursion(ra bool)     { w.recursion = ra }
+func (w *testDNSWriter) Status(rc dns.RCode)   { w.rcode = rc }
+
+func (w *testDNSWriter) Answer(name string, ttl time.Duration, record dns.Record) {
+	w.answers = append(w.answers, dns.Resource{Name: name, Class: dns.ClassIN, TTL: ttl, Record: record})
+}
+
+func (w *testDNSWriter) Authority(name string, ttl time.Duration, record dns.Record) {
+	w.authorities = append(w.authorities, dns.Resource{Name: name, Class: dns.ClassIN, TTL: ttl, Record: record})
+}
+
+func (w *testDNSWriter) Additional(name string, ttl time.Duration, record dns.Record) {
+	w.additionals = append(w.additionals, dns.Resource{Name: name, Class: dns.ClassIN, TTL: ttl, Record: record})
+}
+
+func (w *testDNSWriter) Recur(context.Context) (*dns.Message, error) {
+	return nil, dns.ErrUnsupportedOp
+}
+
+func (w *testDNSWriter) Reply(context.Context) error {
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/benburkert/dns"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// Error query has no recorded answer in the replay file
+const ERRDNSReplayMiss = ErrorStr("no recorded dns answer")
+
+// Error unable to read the dns replay file
+const ERRDNSReplayRead = ErrorStr("read dns replay file failed")
+
+// Error unable to write to the dns record file
+const ERRDNSRecordWrite = ErrorStr("write dns record file failed")
+
+// DNSRecording is a single upstream answer stored in a dns record file. Each line of the file is a json encoded
+// DNSRecording. Message is the base64 encoded wire format of the upstream response.
+type DNSRecording struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// dnsReplayStore is the set of recorded answers loaded from a dns record file. When a question is recorded more
+// than once, the last answer is used.
+type dnsReplayStore map[dnsQuestionKey]*dns.Message
+
+// loadDNSReplayStore reads a dns record file.
+func loadDNSReplayStore(filename string) (dnsReplayStore, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, ERRDNSReplayRead.Err().WithError(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	store := dnsReplayStore{}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		recording := &DNSRecording{}
+		if err := json.Unmarshal(scanner.Bytes(), recording); err != nil {
+			return nil, ERRDNSReplayRead.Err().WithReason("%s:%d %s", filename, lineNumber, err.Error())
+		}
+
+		msgBytes, err := base64.StdEncoding.DecodeString(recording.Message)
+		if err != nil {
+			return nil, ERRDNSReplayRead.Err().WithReason("%s:%d %s", filename, lineNumber, err.Error())
+		}
+
+		msg := new(dns.Message)
+		if _, err := msg.Unpack(msgBytes); err != nil {
+			return nil, ERRDNSReplayRead.Err().WithReason("%s:%d %s", filename, lineNumber, err.Error())
+		}
+
+		for _, q := range msg.Questions {
+			store[newDNSQuestionKey(q)] = msg
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, ERRDNSReplayRead.Err().WithError(err)
+	}
+
+	return store, nil
+}
+
+// lookup returns a copy of the recorded answer for the query, with the query id.
+func (s dnsReplayStore) lookup(query *dns.Query) (*dns.Message, bool) {
+
+	if len(query.Questions) == 0 {
+		return nil, false
+	}
+
+	recorded, ok := s[newDNSQuestionKey(query.Questions[0])]
+	if !ok {
+		return nil, false
+	}
+
+	msg := *recorded
+	msg.ID = query.ID
+	msg.Questions = query.Questions
+
+	return &msg, true
+}
+
+// dnsRecordFile appends upstream answers to a dns record file.
+type dnsRecordFile struct {
+	lock sync.Mutex
+	file *os.File
+
+	filename string
+}
+
+// write appends the message to the record file, opening the file on first use.
+func (r *dnsRecordFile) write(msg *dns.Message) (err error) {
+
+	msgBytes, err := msg.Pack(nil, false)
+	if err != nil {
+		return ERRDNSRecordWrite.Err().WithError(err)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		r.file, err = os.OpenFile(r.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return ERRDNSRecordWrite.Err().WithError(err)
+		}
+	}
+
+	for _, q := range msg.Questions {
+
+		data, err := json.Marshal(&DNSRecording{
+			Name:    q.Name,
+			Type:    dnsTypeName(q.Type),
+			Message: base64.StdEncoding.EncodeToString(msgBytes),
+		})
+		if err != nil {
+			return ERRDNSRecordWrite.Err().WithError(err)
+		}
+
+		if _, err = r.file.Write(append(data, '\n')); err != nil {
+			return ERRDNSRecordWrite.Err().WithError(err)
+		}
+	}
+
+	return nil
+}
+
+// dnsRecordReplay wraps a forwarder, answering from the replay store when set, and recording forwarded answers to
+// the record file when set. With a replay store, and no forwarder, queries missing from the store fail with
+// ERRDNSReplayMiss.
+type dnsRecordReplay struct {
+	forwarder dns.RoundTripper
+	replay    dnsReplayStore
+	record    *dnsRecordFile
+}
+
+// Do answers the query from the replay store, or forwards it, and records the answer.
+func (r *dnsRecordReplay) Do(ctx context.Context, query *dns.Query) (*dns.Message, error) {
+
+	if r.replay != nil {
+		if msg, ok := r.replay.lookup(query); ok {
+			return msg, nil
+		}
+
+		if r.forwarder == nil {
+			var name string
+			if len(query.Questions) > 0 {
+				name = query.Questions[0].Name
+			}
+			return nil, ERRDNSReplayMiss.Err().WithReason("%s", name)
+		}
+	}
+
+	msg, err := r.forwarder.Do(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.record != nil {
+		if err := r.record.write(msg); err != nil {
+			log.WithError(err).Error("dns record failed")
+		}
+	}
+
+	return msg, nil
+}
+
+// dnsTypeName returns the name of a dns type, as used in rules, and record files.
+func dnsTypeName(t dns.Type) string {
+
+	for name, qType := range dnsTypeNames {
+		if qType == t {
+			return name
+		}
+	}
+
+	return "UNKNOWN"
+}
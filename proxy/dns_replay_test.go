@@ -0,0 +1,84 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+func TestDNSRecordReplay_Do(t *testing.T) {
+
+	t.Parallel()
+
+	upstreamAddr, shutdown := testDNSUpstream(t, dns.HandlerFunc(
+		func(ctx context.Context, w dns.MessageWriter, r *dns.Query) {
+			for _, q := range r.Questions {
+				w.Answer(q.Name, time.Hour, &dns.A{A: net.ParseIP("192.0.2.1").To4()})
+			}
+		}))
+	defer shutdown()
+
+	dir, err := ioutil.TempDir("", "dns_replay")
+	if err != nil {
+		t.Fatalf("failed to create temp dir, %s", err.Error())
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	recordFile := filepath.Join(dir, "dns.json")
+
+	forwarder, err := newDNSForwarder(upstreamAddr)
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	query := func(name string) *dns.Query {
+		return &dns.Query{
+			Message: &dns.Message{
+				ID:        99,
+				Questions: []dns.Question{{Name: name, Type: dns.TypeA, Class: dns.ClassIN}},
+			},
+			RemoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353},
+		}
+	}
+
+	recorder := &dnsRecordReplay{forwarder: forwarder, record: &dnsRecordFile{filename: recordFile}}
+	if _, err := recorder.Do(context.Background(), query("www.test.")); err != nil {
+		t.Fatalf("expected no error recording, received %s", err.Error())
+	}
+
+	replay, err := loadDNSReplayStore(recordFile)
+	if err != nil {
+		t.Fatalf("expected no error loading replay, received %s", err.Error())
+	}
+
+	replayer := &dnsRecordReplay{replay: replay}
+	msg, err := replayer.Do(context.Background(), query("WWW.test."))
+	if err != nil {
+		t.Fatalf("expected no error replaying, received %s", err.Error())
+	}
+	if msg.ID != 99 {
+		t.Fatalf("expected message id 99, but received %d", msg.ID)
+	}
+	if len(msg.Answers) != 1 {
+		t.Fatalf("expected one answer, but received %v", msg.Answers)
+	}
+	if a, ok := msg.Answers[0].Record.(*dns.A); !ok || !a.A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("expected answer 192.0.2.1, but received %v", msg.Answers[0].Record)
+	}
+
+	_, err = replayer.Do(context.Background(), query("missing.test."))
+	if err == nil {
+		t.Fatalf("expected replay miss error")
+	}
+	if !ERRDNSReplayMiss.Err().Match(err.(*ProxyError)) {
+		t.Fatalf("expected error %s, but received %s", ERRDNSReplayMiss, err.Error())
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/benburkert/dns"
+)
+
+// Error dns rule configuration is invalid
+const ERRDNSRuleInvalid = ErrorStr("invalid dns rule")
+
+// DNSRuleAction is the action DNSServer takes for a query that matches a DNSRule
+type DNSRuleAction string
+
+const (
+	// DNSActionRedirect rewrites A, or AAAA answers to the rule Target ip
+	DNSActionRedirect DNSRuleAction = "redirect"
+
+	// DNSActionNXDomain answers the query with nxdomain, without forwarding
+	DNSActionNXDomain DNSRuleAction = "nxdomain"
+
+	// DNSActionRefused answers the query with refused, without forwarding
+	DNSActionRefused DNSRuleAction = "refused"
+
+	// DNSActionForward forwards the query to the rule Target dns server, and returns the answers unmodified
+	DNSActionForward DNSRuleAction = "forward"
+
+	// DNSActionPass forwards the query to the forward dns server, and returns the answers unmodified
+	DNSActionPass DNSRuleAction = "pass"
+)
+
+var dnsTypeNames = map[string]dns.Type{
+	"A":     dns.TypeA,
+	"NS":    dns.TypeNS,
+	"CNAME": dns.TypeCNAME,
+	"SOA":   dns.TypeSOA,
+	"PTR":   dns.TypePTR,
+	"MX":    dns.TypeMX,
+	"TXT":   dns.TypeTXT,
+	"AAAA":  dns.TypeAAAA,
+	"SRV":   dns.TypeSRV,
+	"CAA":   dns.TypeCAA,
+	"ANY":   dns.TypeANY,
+}
+
+// DNSRule matches dns questions by name, and optionally query type, and assigns the action DNSServer takes.
+// Rules are evaluated in order, the first matching rule is used.
+type DNSRule struct {
+	Pattern string        `json:"pattern"` // Regex pattern matched against the fully qualified query name
+	Type    string        `json:"type"`    // Query type to match, such as A or AAAA, empty matches all types
+	Action  DNSRuleAction `json:"action"`  // Action taken for matching queries
+	Target  string        `json:"target"`  // IP for redirect, or forwarder address for forward
+
+	// Synthesize answers redirect questions with the Target ip when the upstream has no record to rewrite, including
+	// when it answers nxdomain. Without it, only A, or AAAA answers the upstream returns are rewritten.
+	Synthesize bool `json:"synthesize"`
+
+	regex     *regexp.Regexp
+	qType     dns.Type
+	matchType bool
+	record    dns.Record
+	forwarder dns.RoundTripper
+}
+
+// compile validates the rule, and prepares it for matching.
+func (r *DNSRule) compile() (err error) {
+
+	if r.regex, err = regexp.Compile(r.Pattern); err != nil {
+		return ERRDNSRuleInvalid.Err().WithReason("pattern %q, %s", r.Pattern, err.Error())
+	}
+
+	if r.Type != "" {
+		qType, ok := dnsTypeNames[strings.ToUpper(r.Type)]
+		if !ok {
+			return ERRDNSRuleInvalid.Err().WithReason("pattern %q, unsupported type %q", r.Pattern, r.Type)
+		}
+		r.qType = qType
+		r.matchType = true
+	}
+
+	switch r.Action {
+	case DNSActionRedirect:
+		ip := net.ParseIP(r.Target)
+		if ip == nil {
+			return ERRDNSRuleInvalid.Err().WithReason("pattern %q, invalid redirect ip %q", r.Pattern, r.Target)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			r.record = &dns.A{A: ip4}
+		} else {
+			r.record = &dns.AAAA{AAAA: ip}
+		}
+	case DNSActionForward:
+		if r.forwarder, err = newDNSForwarder(r.Target); err != nil {
+			return ERRDNSRuleInvalid.Err().WithReason("pattern %q, %s", r.Pattern, err.Error())
+		}
+	case DNSActionNXDomain, DNSActionRefused, DNSActionPass:
+	default:
+		return ERRDNSRuleInvalid.Err().WithReason("pattern %q, unsupported action %q", r.Pattern, r.Action)
+	}
+
+	if r.Synthesize && r.Action != DNSActionRedirect {
+		return ERRDNSRuleInvalid.Err().WithReason("pattern %q, synthesize requires the %s action", r.Pattern, DNSActionRedirect)
+	}
+
+	return nil
+}
+
+// Match returns true when the question matches the rule pattern, and type.
+func (r *DNSRule) Match(q dns.Question) bool {
+
+	if r.matchType && r.qType != q.Type {
+		return false
+	}
+
+	return r.regex.MatchString(q.Name)
+}
+
+// String returns a short description of the rule for logging.
+func (r *DNSRule) String() string {
+
+	if r.Target != "" {
+		return fmt.Sprintf("%s %s %s", r.Pattern, r.Action, r.Target)
+	}
+
+	return fmt.Sprintf("%s %s", r.Pattern, r.Action)
+}
+
+// rewrite returns the redirect record replacing an upstream answer. The returned bool is false when the answer
+// should be returned unmodified, and the returned record is nil when the answer should be dropped.
+func (r *DNSRule) rewrite(record dns.Record) (dns.Record, bool) {
+
+	if r.Action != DNSActionRedirect {
+		return nil, false
+	}
+
+	recordType := record.Type()
+	if recordType != dns.TypeA && recordType != dns.TypeAAAA {
+		return nil, false
+	}
+
+	if recordType == r.record.Type() {
+		return r.record, true
+	}
+
+	return nil, true
+}
+
+// synthesize returns true when a redirect rule with Synthesize set should answer the question with the redirect ip,
+// because the upstream answer had no record to rewrite.
+func (r *DNSRule) synthesize(q dns.Question) bool {
+
+	return r.Synthesize && r.Action == DNSActionRedirect && q.Type == r.record.Type()
+}
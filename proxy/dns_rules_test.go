@@ -0,0 +1,146 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+func TestDNSServer_ServeDNS_rules(t *testing.T) {
+
+	t.Parallel()
+
+	upstreamAddr, shutdown := testDNSUpstream(t, dns.HandlerFunc(
+		func(ctx context.Context, w dns.MessageWriter, r *dns.Query) {
+			for _, q := range r.Questions {
+				w.Answer(q.Name, time.Hour, &dns.A{A: net.ParseIP("192.0.2.1").To4()})
+			}
+		}))
+	defer shutdown()
+
+	d := &DNSServer{
+		Rules: []*DNSRule{
+			{Pattern: `\.blocked\.test\.$`, Action: DNSActionNXDomain},
+			{Pattern: `^refused\.test\.$`, Action: DNSActionRefused},
+			{Pattern: `^api\.test\.$`, Type: "A", Action: DNSActionRedirect, Target: "10.0.0.2"},
+			{Pattern: `.*`, Action: DNSActionForward, Target: upstreamAddr},
+		},
+	}
+	for _, rule := range d.Rules {
+		if err := rule.compile(); err != nil {
+			t.Fatalf("expected rule to compile, received %s", err.Error())
+		}
+	}
+	d.rules = d.Rules
+	d.forwarder = d.Rules[3].forwarder
+
+	tests := []struct {
+		name   string
+		status dns.RCode
+		answer string
+	}{
+		{name: "ads.blocked.test.", status: dns.NXDomain},
+		{name: "refused.test.", status: dns.Refused},
+		{name: "api.test.", status: dns.NoError, answer: "10.0.0.2"},
+		{name: "www.test.", status: dns.NoError, answer: "192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		w := &testDNSWriter{}
+		d.ServeDNS(context.Background(), w, &dns.Query{
+			Message: &dns.Message{
+				Questions: []dns.Question{{Name: test.name, Type: dns.TypeA, Class: dns.ClassIN}},
+			},
+			RemoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353},
+		})
+
+		if w.rcode != test.status {
+			t.Fatalf("%s expected rcode %d, but received %d", test.name, test.status, w.rcode)
+		}
+
+		if test.answer == "" {
+			if len(w.answers) != 0 {
+				t.Fatalf("%s expected no answers, but received %v", test.name, w.answers)
+			}
+			continue
+		}
+
+		if len(w.answers) != 1 {
+			t.Fatalf("%s expected one answer, but received %v", test.name, w.answers)
+		}
+		if a, ok := w.answers[0].Record.(*dns.A); !ok || !a.A.Equal(net.ParseIP(test.answer)) {
+			t.Fatalf("%s expected answer %s, but received %v", test.name, test.answer, w.answers[0].Record)
+		}
+	}
+}
+
+func TestDNSRule_compile(t *testing.T) {
+
+	t.Parallel()
+
+	for _, rule := range []*DNSRule{
+		{Pattern: `(`, Action: DNSActionPass},
+		{Pattern: `.*`, Type: "BOGUS", Action: DNSActionPass},
+		{Pattern: `.*`, Action: DNSActionRedirect, Target: "proxy"},
+		{Pattern: `.*`, Action: DNSActionForward, Target: "127.0.0.1:dns"},
+		{Pattern: `.*`, Action: "drop"},
+	} {
+		err := rule.compile()
+		if err == nil {
+			t.Fatalf("expected error for rule %+v", rule)
+		}
+		if !ERRDNSRuleInvalid.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s, but received %s", ERRDNSRuleInvalid, err.Error())
+		}
+	}
+}
+
+// testDNSUpstream starts a dns server on a random local port, and returns its address
+func testDNSUpstream(t *testing.T, handler dns.Handler) (string, func()) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatalf("failed to open a port for the test dns server, %s", err.Error())
+	}
+	conn, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to open a port for the test dns server, %s", err.Error())
+	}
+
+	server := &dns.Server{Handler: handler}
+	go func() { _ = server.Serve(context.Background(), ln) }()
+	go func() { _ = server.ServePacket(context.Background(), conn) }()
+
+	return ln.Addr().String(), func() {
+		_ = ln.Close()
+		_ = conn.Close()
+	}
+}
+
+func TestDNSServer_ListenAndServe_rules(t *testing.T) {
+
+	t.Parallel()
+
+	// A missing hosts file stops ListenAndServe after the rules are compiled
+	d := &DNSServer{
+		AdvertisedAddr: "127.0.0.1",
+		DNSRegex:       ".*",
+		Rules:          []*DNSRule{{Pattern: `ads\.test`, Action: DNSActionNXDomain}},
+		HostsFile:      "/nonexistent/hosts",
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := d.ListenAndServe(); err == nil {
+			t.Fatalf("expected an error for a missing hosts file")
+		}
+		if len(d.rules) != 2 {
+			t.Fatalf("expected 2 compiled rules, but received %d", len(d.rules))
+		}
+	}
+}
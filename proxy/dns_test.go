@@ -0,0 +1,155 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+func TestDNSServer_ServeDNS_upstreamStatus(t *testing.T) {
+
+	t.Parallel()
+
+	soa := dns.Resource{
+		Name:   "test.",
+		Class:  dns.ClassIN,
+		TTL:    time.Hour,
+		Record: &dns.SOA{NS: "ns.test.", MBox: "admin.test.", MinTTL: 30 * time.Second},
+	}
+	upstream := &testDNSRoundTripper{answers: map[string]*dns.Message{
+		"broken.test.":  {RCode: dns.ServFail},
+		"refused.test.": {RCode: dns.Refused},
+		"nodata.test.":  {Authorities: []dns.Resource{soa}},
+		"v6.test.": {Answers: []dns.Resource{
+			{Name: "v6.test.", Class: dns.ClassIN, TTL: time.Hour, Record: &dns.AAAA{AAAA: net.ParseIP("2001:db8::1")}},
+		}},
+		"missing.test.": {RCode: dns.NXDomain, Authorities: []dns.Resource{soa}},
+	}}
+
+	rule := &DNSRule{Pattern: `^(v6|proxied)\.test\.$`, Action: DNSActionRedirect, Target: "10.0.0.1", Synthesize: true}
+	if err := rule.compile(); err != nil {
+		t.Fatalf("expected rule to compile, received %s", err.Error())
+	}
+	d := &DNSServer{rules: []*DNSRule{rule}, forwarder: upstream}
+
+	tests := []struct {
+		name        string
+		qType       dns.Type
+		status      dns.RCode
+		answer      string
+		authorities int
+	}{
+		{name: "broken.test.", qType: dns.TypeA, status: dns.ServFail},
+		{name: "refused.test.", qType: dns.TypeA, status: dns.Refused},
+		{name: "nodata.test.", qType: dns.TypeA, status: dns.NoError, authorities: 1},
+		{name: "missing.test.", qType: dns.TypeA, status: dns.NXDomain, authorities: 1},
+		{name: "v6.test.", qType: dns.TypeA, status: dns.NoError, answer: "10.0.0.1"},
+		{name: "v6.test.", qType: dns.TypeAAAA, status: dns.NoError},
+		{name: "proxied.test.", qType: dns.TypeA, status: dns.NoError, answer: "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		w := &testDNSWriter{}
+		d.ServeDNS(context.Background(), w, &dns.Query{
+			Message: &dns.Message{
+				Questions: []dns.Question{{Name: test.name, Type: test.qType, Class: dns.ClassIN}},
+			},
+		})
+
+		if w.rcode != test.status {
+			t.Fatalf("%s expected rcode %d, but received %d", test.name, test.status, w.rcode)
+		}
+		if len(w.authorities) != test.authorities {
+			t.Fatalf("%s expected %d authorities, but received %v", test.name, test.authorities, w.authorities)
+		}
+
+		if test.answer == "" {
+			if len(w.answers) != 0 {
+				t.Fatalf("%s expected no answers, but received %v", test.name, w.answers)
+			}
+			continue
+		}
+
+		if len(w.answers) != 1 {
+			t.Fatalf("%s expected one answer, but received %v", test.name, w.answers)
+		}
+		if a, ok := w.answers[0].Record.(*dns.A); !ok || !a.A.Equal(net.ParseIP(test.answer)) {
+			t.Fatalf("%s expected answer %s, but received %v", test.name, test.answer, w.answers[0].Record)
+		}
+	}
+
+	t.Run("forward error", func(subTest *testing.T) {
+		d := &DNSServer{forwarder: &testDNSRoundTripper{err: ERRDNSForwardFailed.Err()}}
+		w := &testDNSWriter{}
+		d.ServeDNS(context.Background(), w, &dns.Query{
+			Message: &dns.Message{
+				Questions: []dns.Question{{Name: "www.test.", Type: dns.TypeA, Class: dns.ClassIN}},
+			},
+		})
+		if w.rcode != dns.ServFail {
+			subTest.Fatalf("expected rcode %d, but received %d", dns.ServFail, w.rcode)
+		}
+	})
+}
+
+func TestDNSServer_ServeDNS_defaultRegexNXDomain(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := &testDNSRoundTripper{answers: map[string]*dns.Message{
+		"www.test.": {Answers: []dns.Resource{
+			{Name: "www.test.", Class: dns.ClassIN, TTL: time.Hour, Record: &dns.A{A: net.ParseIP("192.0.2.1").To4()}},
+		}},
+		"nodata.test.": {},
+	}}
+
+	// The rule ListenAndServe adds for the default empty DNSRegex, which matches every name
+	rule := &DNSRule{Pattern: "", Action: DNSActionRedirect, Target: "10.0.0.1"}
+	if err := rule.compile(); err != nil {
+		t.Fatalf("expected rule to compile, received %s", err.Error())
+	}
+	d := &DNSServer{rules: []*DNSRule{rule}, forwarder: upstream}
+
+	for _, test := range []struct {
+		name   string
+		status dns.RCode
+		answer bool
+	}{
+		{name: "www.test.", status: dns.NoError, answer: true},
+		{name: "nodata.test.", status: dns.NoError},
+		{name: "missing.test.", status: dns.NXDomain},
+	} {
+		w := &testDNSWriter{}
+		d.ServeDNS(context.Background(), w, &dns.Query{
+			Message: &dns.Message{
+				Questions: []dns.Question{{Name: test.name, Type: dns.TypeA, Class: dns.ClassIN}},
+			},
+		})
+
+		if w.rcode != test.status {
+			t.Fatalf("%s expected rcode %d, but received %d", test.name, test.status, w.rcode)
+		}
+		if !test.answer {
+			if len(w.answers) != 0 {
+				t.Fatalf("%s expected no synthesized answers, but received %v", test.name, w.answers)
+			}
+			continue
+		}
+		if len(w.answers) != 1 {
+			t.Fatalf("%s expected one answer, but received %v", test.name, w.answers)
+		}
+		if a, ok := w.answers[0].Record.(*dns.A); !ok || !a.A.Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatalf("%s expected the upstream answer rewritten to 10.0.0.1, but received %v", test.name, w.answers[0].Record)
+		}
+	}
+
+	if err := (&DNSRule{Pattern: ".*", Action: DNSActionPass, Synthesize: true}).compile(); err == nil {
+		t.Fatalf("expected an error for synthesize without the redirect action")
+	}
+}
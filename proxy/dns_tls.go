@@ -0,0 +1,197 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/benburkert/dns"
+	"golang.org/x/net/http2"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// DefaultDNSHTTPSPath is the path DNSServer answers dns over https queries on, if HTTPSPath is left unset
+const DefaultDNSHTTPSPath = "/dns-query"
+
+// Error dns over tls, or dns over https is enabled without a certificate store
+const ERRDNSNoCerts = ErrorStr("dns server has no certificate store")
+
+// dnsMessageContentType is the media type of dns over https requests, and responses defined in RFC 8484
+const dnsMessageContentType = "application/dns-message"
+
+// maxDNSMessageLength is the largest dns message that can be sent over tcp, or https
+const maxDNSMessageLength = 65535
+
+// listenAndServeTLS starts a dns over tls server, RFC 7858, on the TCP network address addr, and TLSPort.
+func (d *DNSServer) listenAndServeTLS(ctx context.Context, addr string) error {
+
+	ln, err := net.Listen("tcp", listenAddress(addr, d.TLSPort))
+	if err != nil {
+		return err
+	}
+
+	server := &dns.Server{
+		Handler:   d,
+		TLSConfig: &tls.Config{GetCertificate: d.certLookup},
+	}
+	log.WithField("addr", ln.Addr().String()).Info("dns over tls server started")
+
+	return server.ServeTLS(ctx, d.ClientACL.listener(ln))
+}
+
+// listenAndServeHTTPS starts a dns over https server, RFC 8484, on the TCP network address addr, and HTTPSPort.
+func (d *DNSServer) listenAndServeHTTPS(addr string) error {
+
+	tlsConfig := &tls.Config{GetCertificate: d.certLookup}
+	server := &http.Server{
+		Handler:   d,
+		TLSConfig: tlsConfig,
+	}
+	if err := http2.ConfigureServer(server, nil); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", listenAddress(addr, d.HTTPSPort))
+	if err != nil {
+		return err
+	}
+	log.WithField("addr", ln.Addr().String()).Info("dns over https server started")
+
+	return server.Serve(tls.NewListener(d.ClientACL.listener(ln), tlsConfig))
+}
+
+// certLookup returns a certificate from Certs for the client hello server name. Clients connecting by ip address
+// don't send a server name, and are given a certificate for the listening ip address.
+func (d *DNSServer) certLookup(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	serverName := clientHello.ServerName
+	if serverName == "" && clientHello.Conn != nil {
+		if addr, ok := clientHello.Conn.LocalAddr().(*net.TCPAddr); ok {
+			serverName = addr.IP.String()
+		}
+	}
+
+	log.WithField("server_name", serverName).Debug("[SNI] dns lookup with client hello")
+	return d.Certs.Get(serverName)
+}
+
+// ServeHTTP answers dns over https GET, and POST requests on HTTPSPath using ServeDNS.
+func (d *DNSServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+
+	if req.URL.Path != d.HTTPSPath {
+		http.NotFound(resp, req)
+		return
+	}
+
+	var msgBytes []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		msgBytes, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dnsMessageContentType {
+			resp.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		msgBytes, err = ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, maxDNSMessageLength))
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(msgBytes) == 0 {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	msg := new(dns.Message)
+	if _, err = msg.Unpack(msgBytes); err != nil {
+		log.WithError(err).WithField("remote_addr", req.RemoteAddr).Debug("dns over https unpack failed")
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	remoteAddr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		remoteAddr = &net.TCPAddr{}
+	}
+
+	w := newDNSResponseWriter(msg)
+	d.ServeDNS(req.Context(), w, &dns.Query{Message: msg, RemoteAddr: remoteAddr})
+
+	resBytes, err := w.msg.Pack(nil, true)
+	if err != nil {
+		log.WithError(err).Error("dns over https pack failed")
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", dnsMessageContentType)
+	resp.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(w.minTTL().Seconds())))
+	resp.WriteHeader(http.StatusOK)
+	_, _ = resp.Write(resBytes)
+}
+
+// dnsResponseWriter is a dns.MessageWriter that builds a response message in memory, to be sent over a transport
+// not handled by dns.Server.
+type dnsResponseWriter struct {
+	msg *dns.Message
+}
+
+func newDNSResponseWriter(query *dns.Message) *dnsResponseWriter {
+
+	msg := *query
+	msg.Response = true
+	msg.Answers, msg.Authorities, msg.Additionals = nil, nil, nil
+
+	return &dnsResponseWriter{msg: &msg}
+}
+
+func (w *dnsResponseWriter) Authoritative(aa bool) { w.msg.Authoritative = aa }
+func (w *dnsResponseWriter) Recursion(ra bool)     { w.msg.RecursionAvailable = ra }
+func (w *dnsResponseWriter) Status(rc dns.RCode)   { w.msg.RCode = rc }
+
+func (w *dnsResponseWriter) Answer(name string, ttl time.Duration, record dns.Record) {
+	w.msg.Answers = append(w.msg.Answers, dns.Resource{Name: name, Class: dns.ClassIN, TTL: ttl, Record: record})
+}
+
+func (w *dnsResponseWriter) Authority(name string, ttl time.Duration, record dns.Record) {
+	w.msg.Authorities = append(w.msg.Authorities, dns.Resource{Name: name, Class: dns.ClassIN, TTL: ttl, Record: record})
+}
+
+func (w *dnsResponseWriter) Additional(name string, ttl time.Duration, record dns.Record) {
+	w.msg.Additionals = append(w.msg.Additionals, dns.Resource{Name: name, Class: dns.ClassIN, TTL: ttl, Record: record})
+}
+
+func (w *dnsResponseWriter) Recur(context.Context) (*dns.Message, error) {
+	return nil, dns.ErrUnsupportedOp
+}
+
+func (w *dnsResponseWriter) Reply(context.Context) error {
+	return nil
+}
+
+// minTTL returns the lowest ttl of the response records, used as the http cache lifetime.
+func (w *dnsResponseWriter) minTTL() (ttl time.Duration) {
+
+	for _, section := range [][]dns.Resource{w.msg.Answers, w.msg.Authorities, w.msg.Additionals} {
+		for _, res := range section {
+			if res.Record.Type() == dns.TypeOPT {
+				continue
+			}
+			if ttl == 0 || res.TTL < ttl {
+				ttl = res.TTL
+			}
+		}
+	}
+
+	return ttl
+}
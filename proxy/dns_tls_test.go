@@ -0,0 +1,95 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/benburkert/dns"
+)
+
+func TestDNSServer_ServeHTTP(t *testing.T) {
+
+	t.Parallel()
+
+	zone := dnsZone{}
+	if err := zone.addRecords([]*DNSStaticRecord{{Name: "api.test.internal", Type: "A", Value: "10.0.0.1"}}); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	d := &DNSServer{staticRecords: zone, HTTPSPath: DefaultDNSHTTPSPath}
+
+	query := &dns.Message{
+		ID:        1234,
+		Questions: []dns.Question{{Name: "api.test.internal.", Type: dns.TypeA, Class: dns.ClassIN}},
+	}
+	queryBytes, err := query.Pack(nil, true)
+	if err != nil {
+		t.Fatalf("failed to pack query, %s", err.Error())
+	}
+
+	requests := map[string]*http.Request{
+		"get": httptest.NewRequest(http.MethodGet,
+			"https://127.0.0.1/dns-query?dns="+base64.RawURLEncoding.EncodeToString(queryBytes), nil),
+		"post": httptest.NewRequest(http.MethodPost, "https://127.0.0.1/dns-query", bytes.NewReader(queryBytes)),
+	}
+	requests["post"].Header.Set("Content-Type", dnsMessageContentType)
+
+	for name, req := range requests {
+		t.Run(name, func(subTest *testing.T) {
+			resp := httptest.NewRecorder()
+			d.ServeHTTP(resp, req)
+
+			if resp.Code != http.StatusOK {
+				subTest.Fatalf("expected response status code %d, but received %d", http.StatusOK, resp.Code)
+			}
+			if resp.Header().Get("Content-Type") != dnsMessageContentType {
+				subTest.Fatalf("expected content type %s, but received %s", dnsMessageContentType, resp.Header().Get("Content-Type"))
+			}
+			if resp.Header().Get("Cache-Control") != "max-age=60" {
+				subTest.Fatalf("expected cache control max-age=60, but received %s", resp.Header().Get("Cache-Control"))
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				subTest.Fatalf("error reading from response body %s", err.Error())
+			}
+
+			msg := new(dns.Message)
+			if _, err := msg.Unpack(body); err != nil {
+				subTest.Fatalf("failed to unpack response, %s", err.Error())
+			}
+			if msg.ID != query.ID || !msg.Response {
+				subTest.Fatalf("expected response to query %d, but received %+v", query.ID, msg)
+			}
+			if len(msg.Answers) != 1 {
+				subTest.Fatalf("expected one answer, but received %v", msg.Answers)
+			}
+			if a, ok := msg.Answers[0].Record.(*dns.A); !ok || !a.A.Equal(net.ParseIP("10.0.0.1")) {
+				subTest.Fatalf("expected answer 10.0.0.1, but received %v", msg.Answers[0].Record)
+			}
+		})
+	}
+
+	t.Run("not_found", func(subTest *testing.T) {
+		resp := httptest.NewRecorder()
+		d.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "https://127.0.0.1/", nil))
+		if resp.Code != http.StatusNotFound {
+			subTest.Fatalf("expected response status code %d, but received %d", http.StatusNotFound, resp.Code)
+		}
+	})
+
+	t.Run("bad_request", func(subTest *testing.T) {
+		resp := httptest.NewRecorder()
+		d.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "https://127.0.0.1/dns-query?dns=AAAA", nil))
+		if resp.Code != http.StatusBadRequest {
+			subTest.Fatalf("expected response status code %d, but received %d", http.StatusBadRequest, resp.Code)
+		}
+	})
+}
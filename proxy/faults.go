@@ -0,0 +1,360 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+// Error fault rule configuration is invalid
+const ERRFaultRuleInvalid = ErrorStr("invalid fault rule")
+
+// Error response was reset by a fault rule
+const ERRFaultReset = ErrorStr("injected connection reset")
+
+// DNSFailure is the answer DNSServer gives to a question matching a fault rule
+type DNSFailure string
+
+const (
+	// DNSFailureNone answers the question normally
+	DNSFailureNone DNSFailure = ""
+
+	// DNSFailureServFail answers the question with servfail
+	DNSFailureServFail DNSFailure = "servfail"
+
+	// DNSFailureNXDomain answers the question with nxdomain
+	DNSFailureNXDomain DNSFailure = "nxdomain"
+
+	// DNSFailureRefused answers the question with refused
+	DNSFailureRefused DNSFailure = "refused"
+)
+
+// rcode returns the response code of the failure.
+func (f DNSFailure) rcode() dns.RCode {
+
+	switch f {
+	case DNSFailureNXDomain:
+		return dns.NXDomain
+	case DNSFailureRefused:
+		return dns.Refused
+	}
+
+	return dns.ServFail
+}
+
+// FaultRule injects failures into requests, and dns questions matching Pattern. A rule applies to a matched request
+// with Probability, and every fault set on the rule is injected together.
+type FaultRule struct {
+	// Pattern is a host, and optional path glob, matched as Route.Pattern. Dns questions are matched by name, against
+	// rules without a path.
+	Pattern string `json:"pattern"`
+
+	// Probability is the chance from 0 to 1 the rule applies to a matched request, 1 if zero.
+	Probability float64 `json:"probability"`
+
+	DelayMS  int `json:"delay_ms"`  // Milliseconds to wait before the request is forwarded, or the question answered
+	JitterMS int `json:"jitter_ms"` // Random milliseconds, up to JitterMS, added to DelayMS
+
+	Status int `json:"status"` // Response status code returned without contacting the upstream
+
+	Reset      bool  `json:"reset"`       // Reset the client connection after ResetAfter response body bytes
+	ResetAfter int64 `json:"reset_after"` // Response body bytes sent before the reset
+
+	Truncate int64   `json:"truncate"`  // Response body bytes sent before the body ends early, zero disables
+	Corrupt  float64 `json:"corrupt"`   // Fraction from 0 to 1 of response body bytes replaced with random bytes
+	DripRate int     `json:"drip_rate"` // Response body bytes per second
+
+	DNSFailure DNSFailure `json:"dns_failure"` // Answer matching dns questions with servfail, nxdomain, or refused
+
+	pattern *hostPathPattern
+}
+
+// compile validates the rule.
+func (r *FaultRule) compile() (err error) {
+
+	if r.pattern, err = compileHostPathPattern(r.Pattern); err != nil {
+		return ERRFaultRuleInvalid.Err().WithReason("pattern %q, %s", r.Pattern, err.Error())
+	}
+
+	if r.Probability < 0 || r.Probability > 1 || r.Corrupt < 0 || r.Corrupt > 1 {
+		return ERRFaultRuleInvalid.Err().WithReason("pattern %q, probability, and corrupt must be from 0 to 1", r.Pattern)
+	}
+
+	if r.DelayMS < 0 || r.JitterMS < 0 || r.ResetAfter < 0 || r.Truncate < 0 || r.DripRate < 0 {
+		return ERRFaultRuleInvalid.Err().WithReason("pattern %q, negative value", r.Pattern)
+	}
+
+	if r.Status != 0 && (r.Status < 100 || r.Status > 999) {
+		return ERRFaultRuleInvalid.Err().WithReason("pattern %q, invalid status code %d", r.Pattern, r.Status)
+	}
+
+	switch r.DNSFailure {
+	case DNSFailureNone, DNSFailureServFail, DNSFailureNXDomain, DNSFailureRefused:
+	default:
+		return ERRFaultRuleInvalid.Err().WithReason("pattern %q, unknown dns failure %s", r.Pattern, r.DNSFailure)
+	}
+
+	return nil
+}
+
+// apply returns true when the rule matches, and wins the probability roll.
+func (r *FaultRule) apply(host, path string) bool {
+
+	if !r.pattern.match(host, path) {
+		return false
+	}
+
+	return r.Probability == 0 || rand.Float64() < r.Probability
+}
+
+// delay waits DelayMS, plus jitter, or until the context is canceled.
+func (r *FaultRule) delay(ctx context.Context) time.Duration {
+
+	wait := time.Duration(r.DelayMS) * time.Millisecond
+	if r.JitterMS > 0 {
+		wait += time.Duration(rand.Intn(r.JitterMS+1)) * time.Millisecond
+	}
+	if wait <= 0 {
+		return 0
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	return wait
+}
+
+// bodyFaults returns true when the rule changes the response body.
+func (r *FaultRule) bodyFaults() bool {
+
+	return r.Reset || r.Truncate > 0 || r.Corrupt > 0 || r.DripRate > 0
+}
+
+// wrapBody returns a reader that applies the body faults of the rule.
+func (r *FaultRule) wrapBody(ctx context.Context, body io.Reader) io.Reader {
+
+	return &faultReader{ctx: ctx, rule: r, body: body}
+}
+
+// String returns the rule pattern, and the faults set.
+func (r *FaultRule) String() string {
+
+	var faults []string
+	if r.DelayMS > 0 || r.JitterMS > 0 {
+		faults = append(faults, "delay")
+	}
+	if r.Status > 0 {
+		faults = append(faults, "status")
+	}
+	if r.Reset {
+		faults = append(faults, "reset")
+	}
+	if r.Truncate > 0 {
+		faults = append(faults, "truncate")
+	}
+	if r.Corrupt > 0 {
+		faults = append(faults, "corrupt")
+	}
+	if r.DripRate > 0 {
+		faults = append(faults, "drip")
+	}
+	if r.DNSFailure != DNSFailureNone {
+		faults = append(faults, string(r.DNSFailure))
+	}
+
+	return r.Pattern + " " + strings.Join(faults, ",")
+}
+
+// FaultInjector holds the fault rules of ReverseProxy, and DNSServer. Injection can be enabled, and disabled at
+// runtime with SetEnabled, and starts disabled when Disabled is set.
+type FaultInjector struct {
+	Disabled bool         `json:"disabled"`
+	Rules    []*FaultRule `json:"rules"`
+
+	disabled int32
+}
+
+// Load compiles the rules, and sets the initial state from Disabled. It is called by MITMProxy.Run.
+func (f *FaultInjector) Load() error {
+
+	for _, rule := range f.Rules {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	f.SetEnabled(!f.Disabled)
+
+	return nil
+}
+
+// SetEnabled enables, or disables fault injection.
+func (f *FaultInjector) SetEnabled(enabled bool) {
+
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(&f.disabled, disabled)
+}
+
+// Enabled returns true when faults are injected.
+func (f *FaultInjector) Enabled() bool {
+
+	return atomic.LoadInt32(&f.disabled) == 0
+}
+
+// Toggle switches fault injection on, or off, and returns the new state.
+func (f *FaultInjector) Toggle() bool {
+
+	for {
+		disabled := atomic.LoadInt32(&f.disabled)
+		if atomic.CompareAndSwapInt32(&f.disabled, disabled, 1-disabled) {
+			return disabled == 1
+		}
+	}
+}
+
+// matchRequest returns the first compiled rule applied to the request, or nil. Rules with a dns failure, and no http
+// faults are skipped.
+func (f *FaultInjector) matchRequest(req *http.Request) *FaultRule {
+
+	if f == nil || !f.Enabled() {
+		return nil
+	}
+
+	for _, rule := range f.Rules {
+		if rule.pattern == nil || (rule.DNSFailure != DNSFailureNone && rule.Status == 0 && !rule.bodyFaults()) {
+			continue
+		}
+		if rule.apply(req.Host, req.URL.Path) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// matchQuestion returns the first compiled rule applied to the dns question, or nil. Rules with a path, or with only
+// http faults are skipped.
+func (f *FaultInjector) matchQuestion(q dns.Question) *FaultRule {
+
+	if f == nil || !f.Enabled() {
+		return nil
+	}
+
+	for _, rule := range f.Rules {
+		if rule.pattern == nil || rule.pattern.path != nil || (rule.DNSFailure == DNSFailureNone && rule.DelayMS == 0 && rule.JitterMS == 0) {
+			continue
+		}
+		if rule.apply(strings.TrimSuffix(q.Name, "."), "") {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// faultReader applies the body faults of a rule, in the order the bytes are sent: truncation, reset, corruption,
+// then the drip rate.
+type faultReader struct {
+	ctx  context.Context
+	rule *FaultRule
+	body io.Reader
+	read int64
+}
+
+func (r *faultReader) Read(p []byte) (int, error) {
+
+	rule := r.rule
+	limit := int64(-1)
+	if rule.Truncate > 0 {
+		limit = rule.Truncate
+	}
+	if rule.Reset && (limit < 0 || rule.ResetAfter < limit) {
+		limit = rule.ResetAfter
+	}
+
+	if limit >= 0 {
+		remaining := limit - r.read
+		if remaining <= 0 {
+			if rule.Reset && r.read >= rule.ResetAfter {
+				return 0, ERRFaultReset.Err()
+			}
+			return 0, io.EOF
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+
+	if rule.DripRate > 0 && len(p) > rule.DripRate {
+		p = p[:rule.DripRate]
+	}
+
+	n, err := r.body.Read(p)
+	r.read += int64(n)
+
+	if rule.Corrupt > 0 {
+		for i := 0; i < n; i++ {
+			if rand.Float64() < rule.Corrupt {
+				p[i] = byte(rand.Intn(256))
+			}
+		}
+	}
+
+	if rule.DripRate > 0 && n > 0 {
+		timer := time.NewTimer(time.Duration(n) * time.Second / time.Duration(rule.DripRate))
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			timer.Stop()
+			return n, r.ctx.Err()
+		}
+	}
+
+	return n, err
+}
+
+// resetConnection closes the client connection with a tcp reset. Connections that cannot be hijacked, such as
+// HTTP/2 streams, are aborted instead.
+func resetConnection(resp http.ResponseWriter) {
+
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+
+	// Body bytes sent before the reset are buffered, and are lost by Hijack unless flushed
+	if flusher, ok := resp.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+
+	netConn := conn
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		netConn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := netConn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = conn.Close()
+}
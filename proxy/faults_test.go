@@ -0,0 +1,223 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+func TestFaultRule_compile(t *testing.T) {
+
+	t.Parallel()
+
+	for _, rule := range []*FaultRule{
+		{Pattern: "/v2/*"},
+		{Pattern: "api.example.com", Probability: 1.5},
+		{Pattern: "api.example.com", Corrupt: -0.1},
+		{Pattern: "api.example.com", DelayMS: -1},
+		{Pattern: "api.example.com", Status: 42},
+		{Pattern: "api.example.com", DNSFailure: "timeout"},
+	} {
+		err := rule.compile()
+		if err == nil || !ERRFaultRuleInvalid.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s for %+v, but received %v", ERRFaultRuleInvalid, rule, err)
+		}
+	}
+}
+
+func TestFaultInjector_matchRequest(t *testing.T) {
+
+	t.Parallel()
+
+	faults := &FaultInjector{Rules: []*FaultRule{
+		{Pattern: "dns.example.com", DNSFailure: DNSFailureNXDomain},
+		{Pattern: "never.example.com", Probability: 0.000000001, Status: 503},
+		{Pattern: "*.example.com/v2/*", Status: 503},
+	}}
+	if err := faults.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	for _, test := range []struct {
+		target   string
+		expected *FaultRule
+	}{
+		{"http://api.example.com/v2/users", faults.Rules[2]},
+		{"http://api.example.com/v1/users", nil},
+		{"http://dns.example.com/", nil},
+		{"http://never.example.com/", nil},
+	} {
+		if rule := faults.matchRequest(httptest.NewRequest(http.MethodGet, test.target, nil)); rule != test.expected {
+			t.Fatalf("expected %s rule %v, but received %v", test.target, test.expected, rule)
+		}
+	}
+
+	if faults.Toggle() {
+		t.Fatalf("expected toggle to disable fault injection")
+	}
+	if rule := faults.matchRequest(httptest.NewRequest(http.MethodGet, "http://api.example.com/v2/", nil)); rule != nil {
+		t.Fatalf("expected no rule when disabled, but received %v", rule)
+	}
+	faults.SetEnabled(true)
+	if !faults.Enabled() {
+		t.Fatalf("expected fault injection enabled")
+	}
+
+	var nilFaults *FaultInjector
+	if rule := nilFaults.matchRequest(httptest.NewRequest(http.MethodGet, "http://api.example.com/v2/", nil)); rule != nil {
+		t.Fatalf("expected no rule without faults, but received %v", rule)
+	}
+}
+
+func TestReverseProxy_ServeHTTP_faults(t *testing.T) {
+
+	t.Parallel()
+
+	body := strings.Repeat("0123456789", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(body))
+	}))
+	defer upstream.Close()
+	upstreamHost := upstream.Listener.Addr().String()
+
+	for _, test := range []struct {
+		name     string
+		rule     *FaultRule
+		status   int
+		expected string
+		minTime  time.Duration
+	}{
+		{"status", &FaultRule{Status: http.StatusServiceUnavailable}, http.StatusServiceUnavailable, "", 0},
+		{"delay", &FaultRule{DelayMS: 100, JitterMS: 10}, http.StatusOK, body, 100 * time.Millisecond},
+		{"truncate", &FaultRule{Truncate: 10}, http.StatusOK, body[:10], 0},
+		{"drip", &FaultRule{DripRate: 4000}, http.StatusOK, body, 200 * time.Millisecond},
+	} {
+		test := test
+		t.Run(test.name, func(subTest *testing.T) {
+
+			test.rule.Pattern = "127.0.0.1"
+			p := &ReverseProxy{Faults: &FaultInjector{Rules: []*FaultRule{test.rule}}}
+			if err := p.Faults.Load(); err != nil {
+				subTest.Fatalf("expected no error, received %s", err.Error())
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = upstreamHost
+
+			start := time.Now()
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != test.status {
+				subTest.Fatalf("expected status code %d, but received %d", test.status, recorder.Code)
+			}
+			if recorder.Body.String() != test.expected {
+				subTest.Fatalf("expected body %q, but received %q", test.expected, recorder.Body.String())
+			}
+			if elapsed := time.Since(start); elapsed < test.minTime {
+				subTest.Fatalf("expected response after %s, but received after %s", test.minTime, elapsed)
+			}
+		})
+	}
+
+	t.Run("corrupt", func(subTest *testing.T) {
+
+		p := &ReverseProxy{Faults: &FaultInjector{Rules: []*FaultRule{{Pattern: "127.0.0.1", Corrupt: 1}}}}
+		if err := p.Faults.Load(); err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = upstreamHost
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+
+		if recorder.Body.Len() != len(body) || recorder.Body.String() == body {
+			subTest.Fatalf("expected %d corrupted bytes, but received %q", len(body), recorder.Body.String())
+		}
+	})
+
+	t.Run("reset", func(subTest *testing.T) {
+
+		p := &ReverseProxy{Faults: &FaultInjector{Rules: []*FaultRule{{Pattern: "127.0.0.1", Reset: true, ResetAfter: 100}}}}
+		if err := p.Faults.Load(); err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+		proxyServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			request.Host = upstreamHost
+			p.ServeHTTP(writer, request)
+		}))
+		defer proxyServer.Close()
+
+		resp, err := http.Get(proxyServer.URL)
+		if err != nil {
+			subTest.Fatalf("expected response headers, received %s", err.Error())
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		received, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			subTest.Fatalf("expected body read error, but received %d bytes", len(received))
+		}
+		if !bytes.Equal(received, []byte(body[:100])) {
+			subTest.Fatalf("expected %q before the reset, but received %q", body[:100], received)
+		}
+	})
+}
+
+func TestDNSServer_ServeDNS_faults(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := &testDNSRoundTripper{answers: map[string]*dns.Message{
+		"www.test.": {Answers: []dns.Resource{
+			{Name: "www.test.", Class: dns.ClassIN, TTL: time.Hour, Record: &dns.A{A: net.ParseIP("192.0.2.1").To4()}},
+		}},
+	}}
+
+	faults := &FaultInjector{Rules: []*FaultRule{
+		{Pattern: "*.blocked.test", DNSFailure: DNSFailureNXDomain},
+		{Pattern: "refused.test", DNSFailure: DNSFailureRefused},
+		{Pattern: "www.test/*", DNSFailure: DNSFailureServFail},
+		{Pattern: "www.test", Status: http.StatusServiceUnavailable},
+	}}
+	if err := faults.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	d := &DNSServer{forwarder: upstream, Faults: faults}
+
+	for _, test := range []struct {
+		name    string
+		status  dns.RCode
+		answers int
+	}{
+		{"ads.blocked.test.", dns.NXDomain, 0},
+		{"refused.test.", dns.Refused, 0},
+		{"www.test.", dns.NoError, 1},
+	} {
+		w := &testDNSWriter{}
+		d.ServeDNS(context.Background(), w, &dns.Query{
+			Message: &dns.Message{
+				Questions: []dns.Question{{Name: test.name, Type: dns.TypeA, Class: dns.ClassIN}},
+			},
+		})
+
+		if w.rcode != test.status {
+			t.Fatalf("%s expected rcode %d, but received %d", test.name, test.status, w.rcode)
+		}
+		if len(w.answers) != test.answers {
+			t.Fatalf("%s expected %d answers, but received %v", test.name, test.answers, w.answers)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/benburkert/dns"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// Error host filter configuration, or block list is invalid
+const ERRHostFilterInvalid = ErrorStr("invalid host filter")
+
+// DefaultBlockStatus is the status code of blocked requests, if HostFilter.Status is left unset
+const DefaultBlockStatus = http.StatusForbidden
+
+// defaultBlockPage is the html body of blocked requests, if HostFilter.Body is left unset
+const defaultBlockPage = `<!DOCTYPE html>
+<html>
+<head><title>Blocked</title></head>
+<body>
+<h1>Blocked</h1>
+<p>Requests to {host} are blocked by GoMITMProxy.</p>
+<p>Rule: {rule}</p>
+</body>
+</html>
+`
+
+// defaultBlockJSON is the json body of blocked requests, if HostFilter.Body is left unset
+const defaultBlockJSON = `{"error":"blocked","host":"{host}","url":"{url}","rule":"{rule}"}`
+
+// BlockPageFormat is the content type of the response to blocked requests
+type BlockPageFormat string
+
+const (
+	// BlockPageAuto responds with json to clients that accept json, but not html, and html to all others
+	BlockPageAuto BlockPageFormat = ""
+
+	// BlockPageHTML responds with an html page
+	BlockPageHTML BlockPageFormat = "html"
+
+	// BlockPageJSON responds with a json object
+	BlockPageJSON BlockPageFormat = "json"
+)
+
+// HostFilter blocks requests, and dns questions by host, and requests by url path. Allow entries are exceptions to
+// the block entries, and when BlockByDefault is set, every host not allowed is blocked.
+//
+// Allow, and Block are host, and optional path globs, matched as Route.Pattern. Dns questions are only matched
+// against entries without a path.
+//
+// BlockLists are files in common blocklist formats, detected by line. Hosts file lines, such as
+// 0.0.0.0 ads.example.com, block the listed names. Domain list lines, a single domain per line, and Adblock style
+// ||ads.example.com^ rules block the domain, and its subdomains. Adblock @@||example.com^ exception rules allow the
+// domain, and its subdomains. Comments, and other Adblock rules, such as cosmetic, and path rules, are skipped.
+type HostFilter struct {
+	Allow          []string `json:"allow"`
+	Block          []string `json:"block"`
+	BlockLists     []string `json:"block_lists"`
+	BlockByDefault bool     `json:"block_by_default"`
+
+	// Format, Status, and Body set the response to blocked requests, a 403 html page if unset. Body may contain
+	// {host}, {url}, and {rule} placeholders, replaced with values escaped for the format.
+	Format BlockPageFormat `json:"format"`
+	Status int             `json:"status"`
+	Body   string          `json:"body"`
+
+	// DNSAction is the answer to blocked dns questions, nxdomain, or refused. The default is nxdomain.
+	DNSAction DNSRuleAction `json:"dns_action"`
+
+	allow        []*hostPathPattern
+	block        []*hostPathPattern
+	allowDomains map[string]bool
+	blockDomains map[string]bool
+	blockHosts   map[string]bool
+}
+
+// Load compiles the allow, and block entries, and reads the block lists. It is called by MITMProxy.Run.
+func (f *HostFilter) Load() (err error) {
+
+	switch f.Format {
+	case BlockPageAuto, BlockPageHTML, BlockPageJSON:
+	default:
+		return ERRHostFilterInvalid.Err().WithReason("unknown format %s", f.Format)
+	}
+	if f.Status != 0 && (f.Status < 100 || f.Status > 999) {
+		return ERRHostFilterInvalid.Err().WithReason("invalid status code %d", f.Status)
+	}
+	switch f.DNSAction {
+	case "", DNSActionNXDomain, DNSActionRefused:
+	default:
+		return ERRHostFilterInvalid.Err().WithReason("unsupported dns action %s", f.DNSAction)
+	}
+
+	if f.allow, err = compileHostFilterPatterns(f.Allow); err != nil {
+		return err
+	}
+	if f.block, err = compileHostFilterPatterns(f.Block); err != nil {
+		return err
+	}
+
+	f.allowDomains, f.blockDomains, f.blockHosts = map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, filename := range f.BlockLists {
+		if err = f.loadBlockList(filename); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compileHostFilterPatterns compiles allow, or block entries.
+func compileHostFilterPatterns(entries []string) ([]*hostPathPattern, error) {
+
+	var patterns []*hostPathPattern
+	for _, entry := range entries {
+		pattern, err := compileHostPathPattern(entry)
+		if err != nil {
+			return nil, ERRHostFilterInvalid.Err().WithReason("pattern %q, %s", entry, err.Error())
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// loadBlockList reads the hosts, domain list, and Adblock rules of a block list file.
+func (f *HostFilter) loadBlockList(filename string) error {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return ERRHostFilterInvalid.Err().WithError(err)
+	}
+	defer func() { _ = file.Close() }()
+
+	var loaded, skipped int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hosts, domain, allow, ok := parseBlockListLine(scanner.Text())
+		if !ok {
+			skipped++
+			continue
+		}
+
+		for _, host := range hosts {
+			f.blockHosts[host] = true
+			loaded++
+		}
+		if domain != "" && allow {
+			f.allowDomains[domain] = true
+			loaded++
+		} else if domain != "" {
+			f.blockDomains[domain] = true
+			loaded++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ERRHostFilterInvalid.Err().WithReason("%s, %s", filename, err.Error())
+	}
+
+	log.WithField("block_list", filename).
+		WithField("entries", loaded).
+		WithField("skipped", skipped).
+		Info("block list loaded")
+
+	return nil
+}
+
+// parseBlockListLine returns the exact hosts of a hosts file line, or the domain of a domain list line, or Adblock
+// rule, with allow set for exception rules. It returns false for comments, blank lines, and unsupported rules.
+func parseBlockListLine(line string) (hosts []string, domain string, allow, ok bool) {
+
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "#") {
+		return nil, "", false, false
+	}
+
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+		allow = strings.HasPrefix(line, "@@")
+		rule := strings.TrimPrefix(strings.TrimPrefix(line, "@@"), "||")
+		if i := strings.Index(rule, "$"); i >= 0 {
+			rule = rule[:i]
+		}
+		rule = strings.TrimSuffix(strings.TrimSuffix(rule, "|"), "^")
+		if !isBlockListDomain(rule) {
+			return nil, "", false, false
+		}
+		return nil, strings.ToLower(rule), allow, true
+	}
+
+	// Trailing comments follow whitespace, other # characters are Adblock cosmetic rules
+	fields := strings.Fields(line)
+	for i, field := range fields {
+		if strings.HasPrefix(field, "#") {
+			fields = fields[:i]
+			break
+		}
+	}
+
+	if net.ParseIP(fields[0]) != nil {
+		for _, name := range fields[1:] {
+			name = strings.ToLower(name)
+			switch name {
+			case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback":
+				continue
+			}
+			if isBlockListDomain(name) {
+				hosts = append(hosts, name)
+			}
+		}
+		return hosts, "", false, len(hosts) > 0
+	}
+
+	if len(fields) == 1 && isBlockListDomain(fields[0]) {
+		return nil, strings.ToLower(strings.TrimSuffix(fields[0], ".")), false, true
+	}
+
+	return nil, "", false, false
+}
+
+// isBlockListDomain returns true when the name is a plain domain, without wildcards, paths, or ports.
+func isBlockListDomain(name string) bool {
+
+	if name == "" || net.ParseIP(name) != nil {
+		return false
+	}
+
+	return !strings.ContainsAny(name, "*/:^|$@# ")
+}
+
+// matchRequest returns true, and the matching entry when the request is blocked. A nil filter blocks nothing.
+func (f *HostFilter) matchRequest(req *http.Request) (bool, string) {
+
+	if f == nil {
+		return false, ""
+	}
+
+	return f.match(req.Host, req.URL.Path, true)
+}
+
+// matchQuestion returns true, and the matching entry when the dns question is blocked. Entries with a path are
+// skipped. A nil filter blocks nothing.
+func (f *HostFilter) matchQuestion(q dns.Question) (bool, string) {
+
+	if f == nil {
+		return false, ""
+	}
+
+	return f.match(q.Name, "", false)
+}
+
+// match checks the allow entries, then the block entries, and then BlockByDefault.
+func (f *HostFilter) match(host, path string, matchPaths bool) (bool, string) {
+
+	host, _ = splitHostPort(strings.ToLower(host))
+	host = strings.TrimSuffix(host, ".")
+
+	for i, pattern := range f.allow {
+		if (matchPaths || pattern.path == nil) && pattern.match(host, path) {
+			return false, f.Allow[i]
+		}
+	}
+	if domain, ok := matchDomain(f.allowDomains, host); ok {
+		return false, domain
+	}
+
+	for i, pattern := range f.block {
+		if (matchPaths || pattern.path == nil) && pattern.match(host, path) {
+			return true, f.Block[i]
+		}
+	}
+	if f.blockHosts[host] {
+		return true, host
+	}
+	if domain, ok := matchDomain(f.blockDomains, host); ok {
+		return true, domain
+	}
+
+	if f.BlockByDefault {
+		return true, "block_by_default"
+	}
+
+	return false, ""
+}
+
+// matchDomain returns the domain in the set that is the host, or a parent domain of the host.
+func matchDomain(domains map[string]bool, host string) (string, bool) {
+
+	if len(domains) == 0 {
+		return "", false
+	}
+
+	for name := host; name != ""; {
+		if domains[name] {
+			return name, true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+
+	return "", false
+}
+
+// writeBlockPage writes the block response, and returns the status code.
+func (f *HostFilter) writeBlockPage(resp http.ResponseWriter, req *http.Request, rule string) int {
+
+	status := f.Status
+	if status == 0 {
+		status = DefaultBlockStatus
+	}
+
+	format := f.Format
+	if format == BlockPageAuto {
+		format = BlockPageHTML
+		accept := req.Header.Get("Accept")
+		if strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html") {
+			format = BlockPageJSON
+		}
+	}
+
+	body, escape, contentType := f.Body, html.EscapeString, "text/html; charset=utf-8"
+	if format == BlockPageJSON {
+		escape, contentType = jsonEscape, "application/json"
+		if body == "" {
+			body = defaultBlockJSON
+		}
+	} else if body == "" {
+		body = defaultBlockPage
+	}
+
+	host, _ := splitHostPort(req.Host)
+	body = strings.NewReplacer(
+		"{host}", escape(host),
+		"{url}", escape(req.URL.String()),
+		"{rule}", escape(rule),
+	).Replace(body)
+
+	resp.Header().Set("Content-Type", contentType)
+	resp.Header().Add(GoMITMProxyHeader, Version)
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(status)
+	_, _ = resp.Write([]byte(body))
+
+	return status
+}
+
+// dnsRCode returns the response code of blocked dns questions.
+func (f *HostFilter) dnsRCode() dns.RCode {
+
+	if f.DNSAction == DNSActionRefused {
+		return dns.Refused
+	}
+
+	return dns.NXDomain
+}
+
+// jsonEscape returns the string escaped for use inside a json string.
+func jsonEscape(s string) string {
+
+	data, _ := json.Marshal(s)
+
+	return string(data[1 : len(data)-1])
+}
@@ -0,0 +1,244 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benburkert/dns"
+)
+
+func TestParseBlockListLine(t *testing.T) {
+
+	t.Parallel()
+
+	for _, test := range []struct {
+		line   string
+		hosts  []string
+		domain string
+		allow  bool
+		ok     bool
+	}{
+		{"0.0.0.0 ads.example.com tracker.example.com # ads", []string{"ads.example.com", "tracker.example.com"}, "", false, true},
+		{"127.0.0.1\tlocalhost", nil, "", false, false},
+		{"::1 ip6-localhost Ads.Example.NET", []string{"ads.example.net"}, "", false, true},
+		{"metrics.example.com", nil, "metrics.example.com", false, true},
+		{"||doubleclick.net^", nil, "doubleclick.net", false, true},
+		{"||ads.example.org^$third-party", nil, "ads.example.org", false, true},
+		{"@@||cdn.example.org^", nil, "cdn.example.org", true, true},
+		{"# comment", nil, "", false, false},
+		{"! adblock comment", nil, "", false, false},
+		{"[Adblock Plus 2.0]", nil, "", false, false},
+		{"example.com##.banner", nil, "", false, false},
+		{"||example.com/ads/*", nil, "", false, false},
+		{"/banner/*/img^", nil, "", false, false},
+		{"", nil, "", false, false},
+	} {
+		hosts, domain, allow, ok := parseBlockListLine(test.line)
+		if !reflect.DeepEqual(hosts, test.hosts) || domain != test.domain || allow != test.allow || ok != test.ok {
+			t.Fatalf("expected %q to parse as %v %q %t %t, but received %v %q %t %t",
+				test.line, test.hosts, test.domain, test.allow, test.ok, hosts, domain, allow, ok)
+		}
+	}
+}
+
+// loadTestHostFilter returns a filter loaded with a block list of every supported format.
+func loadTestHostFilter(t *testing.T, filter *HostFilter) *HostFilter {
+
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatalf("failed to create temp file, %s", err.Error())
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	_, err = f.WriteString("0.0.0.0 ads.example.com\nmetrics.test\n||doubleclick.net^\n@@||static.doubleclick.net^\n")
+	if err != nil {
+		t.Fatalf("failed to write temp file, %s", err.Error())
+	}
+	_ = f.Close()
+
+	filter.BlockLists = []string{f.Name()}
+	if err := filter.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	return filter
+}
+
+func TestHostFilter_matchRequest(t *testing.T) {
+
+	t.Parallel()
+
+	filter := loadTestHostFilter(t, &HostFilter{
+		Allow: []string{"www.example.com/track/allowed"},
+		Block: []string{"*.analytics.test", "www.example.com/track/*"},
+	})
+
+	for _, test := range []struct {
+		url     string
+		blocked bool
+		rule    string
+	}{
+		{"http://ads.example.com/", true, "ads.example.com"},
+		{"http://sub.ads.example.com/", false, ""},
+		{"http://metrics.test:8080/", true, "metrics.test"},
+		{"http://eu.metrics.test/", true, "metrics.test"},
+		{"http://ad.doubleclick.net/", true, "doubleclick.net"},
+		{"http://static.doubleclick.net/", false, "static.doubleclick.net"},
+		{"http://www.analytics.test/", true, "*.analytics.test"},
+		{"http://www.example.com/track/pixel", true, "www.example.com/track/*"},
+		{"http://www.example.com/track/allowed", false, "www.example.com/track/allowed"},
+		{"http://www.example.com/", false, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		blocked, rule := filter.matchRequest(req)
+		if blocked != test.blocked || rule != test.rule {
+			t.Fatalf("expected %s blocked %t by %q, but received %t by %q", test.url, test.blocked, test.rule, blocked, rule)
+		}
+	}
+
+	var nilFilter *HostFilter
+	if blocked, _ := nilFilter.matchRequest(httptest.NewRequest(http.MethodGet, "http://ads.example.com/", nil)); blocked {
+		t.Fatalf("expected a nil filter to block nothing")
+	}
+
+	allowOnly := &HostFilter{Allow: []string{"*.example.com"}, BlockByDefault: true}
+	if err := allowOnly.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if blocked, _ := allowOnly.matchRequest(httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)); blocked {
+		t.Fatalf("expected an allowed host to pass when blocking by default")
+	}
+	if blocked, _ := allowOnly.matchRequest(httptest.NewRequest(http.MethodGet, "http://www.example.org/", nil)); !blocked {
+		t.Fatalf("expected a host not allowed to be blocked by default")
+	}
+}
+
+func TestHostFilter_Load(t *testing.T) {
+
+	t.Parallel()
+
+	for _, filter := range []*HostFilter{
+		{Format: "xml"},
+		{Status: 42},
+		{DNSAction: DNSActionRedirect},
+		{Block: []string{"/path/only"}},
+		{BlockLists: []string{"/nonexistent/blocklist"}},
+	} {
+		err := filter.Load()
+		if err == nil || !ERRHostFilterInvalid.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s for %+v, but received %v", ERRHostFilterInvalid, filter, err)
+		}
+	}
+}
+
+func TestReverseProxy_ServeHTTP_filter(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("okay"))
+	}))
+	defer upstream.Close()
+	upstreamHost := upstream.Listener.Addr().String()
+
+	p := &ReverseProxy{Filter: &HostFilter{Block: []string{"127.0.0.1/blocked/*"}}}
+	if err := p.Filter.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	serve := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = upstreamHost
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	if recorder := serve("/allowed", ""); recorder.Code != http.StatusOK || recorder.Body.String() != "okay" {
+		t.Fatalf("expected status code %d okay, but received %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	recorder := serve("/blocked/<pixel>", "text/html")
+	if recorder.Code != DefaultBlockStatus {
+		t.Fatalf("expected status code %d, but received %d", DefaultBlockStatus, recorder.Code)
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("expected an html block page, but received %s", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "127.0.0.1/blocked/*") || strings.Contains(recorder.Body.String(), "<pixel>") {
+		t.Fatalf("expected the escaped rule in the block page, but received %s", recorder.Body.String())
+	}
+
+	recorder = serve("/blocked/pixel", "application/json")
+	var body map[string]string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected a json block response, received %s", err.Error())
+	}
+	if body["error"] != "blocked" || body["host"] != "127.0.0.1" || body["rule"] != "127.0.0.1/blocked/*" {
+		t.Fatalf("expected the blocked host, and rule, but received %v", body)
+	}
+}
+
+func TestDNSServer_ServeDNS_filter(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := &testDNSRoundTripper{answers: map[string]*dns.Message{
+		"www.test.": {Answers: []dns.Resource{
+			{Name: "www.test.", Class: dns.ClassIN, TTL: time.Hour, Record: &dns.A{A: net.ParseIP("192.0.2.1").To4()}},
+		}},
+	}}
+
+	filter := loadTestHostFilter(t, &HostFilter{Block: []string{"www.test/ads/*"}})
+	d := &DNSServer{forwarder: upstream, Filter: filter}
+
+	for _, test := range []struct {
+		name    string
+		status  dns.RCode
+		answers int
+	}{
+		{"ads.example.com.", dns.NXDomain, 0},
+		{"eu.metrics.test.", dns.NXDomain, 0},
+		{"www.test.", dns.NoError, 1},
+	} {
+		w := &testDNSWriter{}
+		d.ServeDNS(context.Background(), w, &dns.Query{
+			Message: &dns.Message{
+				Questions: []dns.Question{{Name: test.name, Type: dns.TypeA, Class: dns.ClassIN}},
+			},
+		})
+
+		if w.rcode != test.status {
+			t.Fatalf("%s expected rcode %d, but received %d", test.name, test.status, w.rcode)
+		}
+		if len(w.answers) != test.answers {
+			t.Fatalf("%s expected %d answers, but received %v", test.name, test.answers, w.answers)
+		}
+	}
+
+	filter.DNSAction = DNSActionRefused
+	w := &testDNSWriter{}
+	d.ServeDNS(context.Background(), w, &dns.Query{
+		Message: &dns.Message{
+			Questions: []dns.Question{{Name: "ads.example.com.", Type: dns.TypeA, Class: dns.ClassIN}},
+		},
+	})
+	if w.rcode != dns.Refused {
+		t.Fatalf("expected rcode %d, but received %d", dns.Refused, w.rcode)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// Error descriptor set file could not be read, or parsed
+const ERRGRPCDescriptorSet = ErrorStr("invalid grpc descriptor set")
+
+// Error message could not be decoded with the method descriptor
+const ERRGRPCDecode = ErrorStr("grpc message decode failed")
+
+// isGRPC returns true for a gRPC request, application/grpc, or application/grpc+proto. gRPC-Web is not matched, as
+// it carries trailers in the body.
+func isGRPC(req *http.Request) bool {
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// grpcDecoder decodes gRPC messages to json, using the method input, and output types from a set of file
+// descriptors.
+type grpcDecoder struct {
+	files *protoregistry.Files
+}
+
+// newGRPCDecoder loads FileDescriptorSet files, as written by protoc --descriptor_set_out --include_imports. Files
+// present in more than one set are loaded once.
+func newGRPCDecoder(paths []string) (*grpcDecoder, error) {
+
+	set := &descriptorpb.FileDescriptorSet{}
+	loaded := map[string]bool{}
+	for _, path := range paths {
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, ERRGRPCDescriptorSet.Err().WithError(err)
+		}
+
+		fileSet := &descriptorpb.FileDescriptorSet{}
+		if err = proto.Unmarshal(data, fileSet); err != nil {
+			return nil, ERRGRPCDescriptorSet.Err().WithReason("%s, %s", path, err.Error())
+		}
+
+		for _, file := range fileSet.File {
+			if loaded[file.GetName()] {
+				continue
+			}
+			loaded[file.GetName()] = true
+			set.File = append(set.File, file)
+		}
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, ERRGRPCDescriptorSet.Err().WithError(err)
+	}
+
+	return &grpcDecoder{files: files}, nil
+}
+
+// method returns the descriptor of a method, or nil when the service, or method is unknown.
+func (d *grpcDecoder) method(service, method string) protoreflect.MethodDescriptor {
+
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil
+	}
+
+	serviceDesc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil
+	}
+
+	return serviceDesc.Methods().ByName(protoreflect.Name(method))
+}
+
+// decode unmarshals a message payload of the descriptor type, and returns it as json. The json is compacted, as
+// protojson output whitespace is not stable.
+func (d *grpcDecoder) decode(desc protoreflect.MessageDescriptor, payload []byte) (json.RawMessage, error) {
+
+	msg := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil, ERRGRPCDecode.Err().WithError(err)
+	}
+
+	data, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, ERRGRPCDecode.Err().WithError(err)
+	}
+
+	compacted := &bytes.Buffer{}
+	if err = json.Compact(compacted, data); err != nil {
+		return nil, ERRGRPCDecode.Err().WithError(err)
+	}
+
+	return compacted.Bytes(), nil
+}
+
+// decodeMessages sets the json of each complete message. Compressed messages are decoded when the encoding is gzip,
+// other encodings are left as the raw payload.
+func (d *grpcDecoder) decodeMessages(desc protoreflect.MessageDescriptor, messages []*log.GRPCMessage, encoding string) error {
+
+	for _, message := range messages {
+
+		if message.Truncated {
+			continue
+		}
+
+		payload := message.Bytes()
+		if message.Compressed {
+			if encoding != "gzip" {
+				continue
+			}
+			reader, err := gzip.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				return ERRGRPCDecode.Err().WithError(err)
+			}
+			if payload, err = ioutil.ReadAll(reader); err != nil {
+				return ERRGRPCDecode.Err().WithError(err)
+			}
+		}
+
+		data, err := d.decode(desc, payload)
+		if err != nil {
+			return err
+		}
+		message.JSON = data
+	}
+
+	return nil
+}
+
+// LoadGRPCDescriptorSets loads GRPCDescriptorSets, used to decode logged gRPC messages to json. It is called by
+// MITMProxy.Run, and must be called before serving when the proxy is used on its own.
+func (p *ReverseProxy) LoadGRPCDescriptorSets() error {
+
+	if len(p.GRPCDescriptorSets) == 0 {
+		p.grpcDecoder = nil
+		return nil
+	}
+
+	decoder, err := newGRPCDecoder(p.GRPCDescriptorSets)
+	if err != nil {
+		return err
+	}
+	p.grpcDecoder = decoder
+
+	return nil
+}
+
+// readGRPC completes the record once the response body, and trailers are read, splitting the captured bodies into
+// messages, and decoding them when the method is found in the descriptor sets.
+func (p *ReverseProxy) readGRPC(record *log.GRPCRecord, req *http.Request, res *http.Response) {
+
+	record.ReadStatus(res)
+	record.ReadMessages()
+
+	if p.grpcDecoder == nil {
+		return
+	}
+
+	method := p.grpcDecoder.method(record.Service, record.Method)
+	if method == nil {
+		log.WithField("service", record.Service).
+			WithField("method", record.Method).
+			Debug("grpc method not found in descriptor sets")
+		return
+	}
+
+	if err := p.grpcDecoder.decodeMessages(method.Input(), record.Requests, req.Header.Get("Grpc-Encoding")); err != nil {
+		log.WithError(err).WithField("method", method.FullName()).Warning("failed to decode grpc request")
+	}
+
+	if err := p.grpcDecoder.decodeMessages(method.Output(), record.Responses, res.Header.Get("Grpc-Encoding")); err != nil {
+		log.WithError(err).WithField("method", method.FullName()).Warning("failed to decode grpc response")
+	}
+}
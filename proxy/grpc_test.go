@@ -0,0 +1,165 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+func TestReverseProxy_readGRPC(t *testing.T) {
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	descriptorSet := filepath.Join(dir, "echo.pb")
+	writeTestDescriptorSet(t, descriptorSet)
+
+	p := &ReverseProxy{GRPCDescriptorSets: []string{descriptorSet, descriptorSet}}
+	if err := p.LoadGRPCDescriptorSets(); err != nil {
+		t.Fatalf("expected no error loading descriptor sets, received %s", err.Error())
+	}
+
+	// field 1, length delimited, "hello"
+	requestMessage := []byte{0x0a, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	compressed := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(compressed)
+	_, _ = gzipWriter.Write([]byte{0x0a, 0x02, 'h', 'i'})
+	_ = gzipWriter.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/test.Echo/Say", bytes.NewReader(testGRPCFrame(false, requestMessage)))
+	req.Header.Set("Content-Type", "application/grpc")
+	if !isGRPC(req) {
+		t.Fatalf("expected request to be grpc")
+	}
+
+	record := &log.GRPCRecord{}
+	record.Load(req)
+	_, _ = ioutil.ReadAll(req.Body)
+
+	res := &http.Response{
+		Header:  http.Header{"Grpc-Encoding": []string{"gzip"}},
+		Trailer: http.Header{"Grpc-Status": []string{"3"}, "Grpc-Message": []string{"bad%20text"}},
+		Body: ioutil.NopCloser(bytes.NewReader(append(
+			testGRPCFrame(true, compressed.Bytes()),
+			testGRPCFrame(false, requestMessage)[:8]...,
+		))),
+	}
+	record.LoadResponse(res)
+	_, _ = ioutil.ReadAll(res.Body)
+
+	p.readGRPC(record, req, res)
+
+	if record.Service != "test.Echo" || record.Method != "Say" {
+		t.Fatalf("expected test.Echo/Say, but received %s/%s", record.Service, record.Method)
+	}
+	if record.Status != "3" || record.StatusMessage != "bad text" {
+		t.Fatalf("expected status 3 bad text, but received %s %s", record.Status, record.StatusMessage)
+	}
+	if len(record.Requests) != 1 || string(record.Requests[0].JSON) != `{"text":"hello"}` {
+		t.Fatalf("expected one decoded request message, but received %+v", record.Requests)
+	}
+	if len(record.Responses) != 2 {
+		t.Fatalf("expected two response messages, but received %d", len(record.Responses))
+	}
+	if !record.Responses[0].Compressed || string(record.Responses[0].JSON) != `{"text":"hi"}` {
+		t.Fatalf("expected compressed response decoded, but received %+v", record.Responses[0])
+	}
+	if !record.Responses[1].Truncated || record.Responses[1].JSON != nil {
+		t.Fatalf("expected truncated response to not be decoded, but received %+v", record.Responses[1])
+	}
+}
+
+func TestReverseProxy_LoadGRPCDescriptorSets_invalid(t *testing.T) {
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	invalid := filepath.Join(dir, "invalid.pb")
+	if err := ioutil.WriteFile(invalid, []byte("not a descriptor set"), 0600); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	for _, path := range []string{invalid, filepath.Join(dir, "missing.pb")} {
+		p := &ReverseProxy{GRPCDescriptorSets: []string{path}}
+		err := p.LoadGRPCDescriptorSets()
+		if err == nil {
+			t.Fatalf("expected error loading %s", path)
+		}
+		if !ERRGRPCDescriptorSet.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s, but received %s", ERRGRPCDescriptorSet, err.Error())
+		}
+	}
+}
+
+// testGRPCFrame prefixes a message with the gRPC compressed flag, and length.
+func testGRPCFrame(compressed bool, message []byte) []byte {
+
+	frame := make([]byte, 5, 5+len(message))
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+
+	return append(frame, message...)
+}
+
+// writeTestDescriptorSet writes a descriptor set of the service test.Echo, with the method Say taking, and returning
+// the message test.Text, with a single string field text.
+func writeTestDescriptorSet(t *testing.T, path string) {
+
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("echo.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Text"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("text"),
+				JsonName: proto.String("text"),
+				Number:   proto.Int32(1),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			}},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Say"),
+				InputType:  proto.String(".test.Text"),
+				OutputType: proto.String(".test.Text"),
+			}},
+		}},
+	}}}
+
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+}
@@ -6,7 +6,6 @@ package proxy
 import (
 	"bufio"
 	"context"
-	"fmt"
 	"io"
 	standardLogger "log"
 	"net"
@@ -21,6 +20,9 @@ type HTTPServer struct {
 
 	ListenAddr string // TCP address for the server to listen on
 	Port       int    // TCP Port of the server to listen on
+
+	Shaping   []*ShapingRule // Compiled network profiles applied to connections from matching clients, read only
+	ClientACL *ClientACL     // Clients allowed to connect, every client when nil
 }
 
 // ListenAndServe creates the server process, and blocks until an error occurs. A ready channel is used to signal
@@ -49,22 +51,19 @@ func (p *HTTPServer) ListenAndServe(ready chan bool, handler http.Handler) error
 		ErrorLog: standardLogger.New(writer, "", 0),
 	}
 
-	listenAddress := fmt.Sprintf("%s:", p.ListenAddr)
-	if p.Port > 0 {
-		listenAddress = fmt.Sprintf("%s:%d", p.ListenAddr, p.Port)
-	}
-	connection, err := net.Listen("tcp", listenAddress)
+	connection, err := net.Listen("tcp", listenAddress(p.ListenAddr, p.Port))
 	if err != nil {
 		return err
 	}
 
+	listener := shapeListener(p.ClientACL.listener(connection), p.Shaping)
+
 	p.Port = connection.Addr().(*net.TCPAddr).Port
-	ip := connection.Addr().(*net.TCPAddr).IP
-	log.WithField("addr", fmt.Sprintf("%s:%d", ip, p.Port)).
+	log.WithField("addr", connection.Addr().String()).
 		Info("http server started")
 
 	ready <- true
-	return p.server.Serve(connection)
+	return p.server.Serve(listener)
 }
 
 // GetPort returns the Port that TLSServer will listen to. In the case that Port is a nil value, this value will change
@@ -0,0 +1,337 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error rate limit configuration is invalid
+const ERRRateLimitInvalid = ErrorStr("invalid rate limit")
+
+// Error request exceeded a rate limit, or concurrency cap
+const ERRRateLimited = ErrorStr("rate limited")
+
+// rateLimitPruneInterval is how often idle client, and host states are removed from a limit
+const rateLimitPruneInterval = time.Minute
+
+// RateLimit caps the request rate, and concurrent requests of each client address within Client, or of each upstream
+// host matching Host. Every client, and host has separate limits.
+type RateLimit struct {
+	Client string `json:"client"` // Client ip, or cidr, such as 0.0.0.0/0 for every ipv4 client
+	Host   string `json:"host"`   // Upstream host glob, matched without the port, unless the pattern includes one
+
+	Rate          float64 `json:"rate"`           // Requests per second, refilling a token bucket, zero is unlimited
+	Burst         int     `json:"burst"`          // Token bucket size, the rate rounded up if zero
+	MaxConcurrent int     `json:"max_concurrent"` // Requests in flight at once, zero is unlimited
+
+	// Queue waits for a token, or a free slot instead of rejecting the request, for up to QueueTimeout seconds, or
+	// until the client cancels the request when QueueTimeout is zero.
+	Queue        bool `json:"queue"`
+	QueueTimeout int  `json:"queue_timeout"`
+
+	Status     int    `json:"status"`      // Rejection status code, 429 if zero
+	Body       string `json:"body"`        // Rejection response body
+	RetryAfter int    `json:"retry_after"` // Seconds sent in the Retry-After header of rejections, omitted if zero
+
+	client *net.IPNet
+	host   *hostPathPattern
+	lock   sync.Mutex
+	states map[string]*rateLimitState
+	pruned time.Time
+}
+
+// compile validates the limit.
+func (l *RateLimit) compile() (err error) {
+
+	if (l.Client == "") == (l.Host == "") {
+		return ERRRateLimitInvalid.Err().WithReason("one of client, or host is required")
+	}
+
+	l.client, l.host = nil, nil
+	if l.Client != "" {
+		if l.client, err = parseCIDR(l.Client); err != nil {
+			return ERRRateLimitInvalid.Err().WithReason("client %q, %s", l.Client, err.Error())
+		}
+	} else if strings.Contains(l.Host, "/") {
+		return ERRRateLimitInvalid.Err().WithReason("host %q, must not contain a path", l.Host)
+	} else if l.host, err = compileHostPathPattern(l.Host); err != nil {
+		return ERRRateLimitInvalid.Err().WithReason("host %q, %s", l.Host, err.Error())
+	}
+
+	if l.Rate < 0 || l.Burst < 0 || l.MaxConcurrent < 0 || l.QueueTimeout < 0 || l.RetryAfter < 0 {
+		return ERRRateLimitInvalid.Err().WithReason("%s, negative value", l.String())
+	}
+	if l.Status != 0 && (l.Status < 100 || l.Status > 999) {
+		return ERRRateLimitInvalid.Err().WithReason("%s, invalid status code %d", l.String(), l.Status)
+	}
+
+	l.states = map[string]*rateLimitState{}
+
+	return nil
+}
+
+// String returns the client, or host the limit applies to.
+func (l *RateLimit) String() string {
+
+	if l.Client != "" {
+		return "client " + l.Client
+	}
+
+	return "host " + l.Host
+}
+
+// key returns the client ip, or upstream host the request is limited by, or false when the limit does not apply.
+func (l *RateLimit) key(req *http.Request) (string, bool) {
+
+	if l.client != nil {
+		host, _ := splitHostPort(req.RemoteAddr)
+		ip := net.ParseIP(host)
+		if ip == nil || !l.client.Contains(ip) {
+			return "", false
+		}
+		return ip.String(), true
+	}
+
+	if !l.host.match(req.Host, "") {
+		return "", false
+	}
+	if l.host.matchPort {
+		return strings.ToLower(req.Host), true
+	}
+	host, _ := splitHostPort(strings.ToLower(req.Host))
+
+	return host, true
+}
+
+// state returns the limit state of the key, creating it with a full token bucket. The state is held until put is
+// called, and idle states are pruned at most once every rateLimitPruneInterval.
+func (l *RateLimit) state(key string) *rateLimitState {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.pruned) >= rateLimitPruneInterval {
+		l.prune(now)
+	}
+
+	state, ok := l.states[key]
+	if !ok {
+		burst := float64(l.Burst)
+		if burst == 0 {
+			burst = math.Max(1, math.Ceil(l.Rate))
+		}
+		state = &rateLimitState{burst: burst, tokens: burst, last: now, released: make(chan struct{})}
+		l.states[key] = state
+	}
+	state.refs++
+
+	return state
+}
+
+// put releases a state held by state, recording when it was last used.
+func (l *RateLimit) put(state *rateLimitState) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	state.refs--
+	state.used = time.Now()
+}
+
+// prune removes the states no request holds, that have been idle longer than the bucket takes to refill. A pruned
+// state is recreated with a full bucket, the same as the state it replaces.
+func (l *RateLimit) prune(now time.Time) {
+
+	for key, state := range l.states {
+		var window time.Duration
+		if l.Rate > 0 {
+			window = time.Duration(state.burst / l.Rate * float64(time.Second))
+		}
+		if state.refs == 0 && now.Sub(state.used) > window {
+			delete(l.states, key)
+		}
+	}
+	l.pruned = now
+}
+
+// acquire takes a token, and a concurrency slot for the request, queueing when enabled. The returned release func must
+// be called when the request completes.
+func (l *RateLimit) acquire(ctx context.Context, key string) (func(), error) {
+
+	state := l.state(key)
+
+	var deadline <-chan time.Time
+	if l.Queue && l.QueueTimeout > 0 {
+		timer := time.NewTimer(time.Duration(l.QueueTimeout) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		wait, released, ok := state.tryAcquire(l.Rate, l.MaxConcurrent)
+		if ok {
+			return func() {
+				state.release()
+				l.put(state)
+			}, nil
+		}
+		if !l.Queue {
+			l.put(state)
+			return nil, ERRRateLimited.Err().WithReason("%s %s", l.String(), key)
+		}
+
+		if err := waitLimit(ctx, wait, released, deadline); err != nil {
+			l.put(state)
+			return nil, ERRRateLimited.Err().WithReason("%s %s, %s", l.String(), key, err.Error())
+		}
+	}
+}
+
+// waitLimit waits for the next token, or a released slot. It returns an error when the queue deadline passes, or the
+// context is canceled first.
+func waitLimit(ctx context.Context, wait time.Duration, released <-chan struct{}, deadline <-chan time.Time) error {
+
+	var tokenTimer <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		tokenTimer = timer.C
+	}
+
+	select {
+	case <-tokenTimer:
+	case <-released:
+	case <-deadline:
+		return fmt.Errorf("queue timeout")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// reject writes the rejection response.
+func (l *RateLimit) reject(resp http.ResponseWriter) int {
+
+	status := l.Status
+	if status == 0 {
+		status = http.StatusTooManyRequests
+	}
+
+	resp.Header().Add(GoMITMProxyHeader, Version)
+	if l.RetryAfter > 0 {
+		resp.Header().Set("Retry-After", strconv.Itoa(l.RetryAfter))
+	}
+	if l.Body != "" {
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	resp.WriteHeader(status)
+	_, _ = resp.Write([]byte(l.Body))
+
+	return status
+}
+
+// rateLimitState is the token bucket, and requests in flight of a client, or host. Refs, and used are guarded by the
+// RateLimit lock.
+type rateLimitState struct {
+	lock     sync.Mutex
+	burst    float64
+	tokens   float64
+	last     time.Time
+	active   int
+	released chan struct{}
+
+	refs int
+	used time.Time
+}
+
+// tryAcquire takes a token, and a slot if both are available. Otherwise it returns how long until the next token,
+// or a channel closed when a slot is released.
+func (s *rateLimitState) tryAcquire(rate float64, maxConcurrent int) (time.Duration, <-chan struct{}, bool) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if maxConcurrent > 0 && s.active >= maxConcurrent {
+		return 0, s.released, false
+	}
+
+	if rate > 0 {
+		now := time.Now()
+		s.tokens = math.Min(s.burst, s.tokens+now.Sub(s.last).Seconds()*rate)
+		s.last = now
+		if s.tokens < 1 {
+			return time.Duration((1 - s.tokens) / rate * float64(time.Second)), nil, false
+		}
+		s.tokens--
+	}
+	s.active++
+
+	return 0, nil, true
+}
+
+// release frees the slot of a completed request, waking queued requests.
+func (s *rateLimitState) release() {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.active--
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// LoadLimits compiles Limits. It is called by MITMProxy.Run, and must be called before serving when the proxy is used
+// on its own.
+func (p *ReverseProxy) LoadLimits() error {
+
+	for _, limit := range p.Limits {
+		if err := limit.compile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// acquireLimits applies every matching limit to the request, in order. It returns a func releasing the acquired
+// limits, or the limit that rejected the request, with the error.
+func (p *ReverseProxy) acquireLimits(req *http.Request) (func(), *RateLimit, error) {
+
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+
+	for _, limit := range p.Limits {
+		if limit.states == nil {
+			continue
+		}
+		key, ok := limit.key(req)
+		if !ok {
+			continue
+		}
+
+		r, err := limit.acquire(req.Context(), key)
+		if err != nil {
+			release()
+			return nil, limit, err
+		}
+		releases = append(releases, r)
+	}
+
+	return release, nil, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimit_compile(t *testing.T) {
+
+	t.Parallel()
+
+	for _, limit := range []*RateLimit{
+		{Rate: 1},
+		{Client: "10.0.0.0/8", Host: "example.com"},
+		{Client: "not an ip"},
+		{Host: "example.com/path"},
+		{Host: "example.com", Rate: -1},
+		{Host: "example.com", Status: 42},
+	} {
+		err := limit.compile()
+		if err == nil || !ERRRateLimitInvalid.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s for %s, but received %v", ERRRateLimitInvalid, limit.String(), err)
+		}
+	}
+}
+
+func TestRateLimit_acquire(t *testing.T) {
+
+	t.Parallel()
+
+	t.Run("token_bucket", func(subTest *testing.T) {
+
+		limit := &RateLimit{Client: "0.0.0.0/0", Rate: 10, Burst: 2}
+		if err := limit.compile(); err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+
+		for i := 0; i < 2; i++ {
+			release, err := limit.acquire(context.Background(), "10.0.0.1")
+			if err != nil {
+				subTest.Fatalf("expected request %d within the burst, received %s", i, err.Error())
+			}
+			release()
+		}
+		if _, err := limit.acquire(context.Background(), "10.0.0.1"); err == nil || !ERRRateLimited.Err().Match(err.(*ProxyError)) {
+			subTest.Fatalf("expected error %s after the burst, but received %v", ERRRateLimited, err)
+		}
+		if _, err := limit.acquire(context.Background(), "10.0.0.2"); err != nil {
+			subTest.Fatalf("expected a separate bucket per client, received %s", err.Error())
+		}
+
+		time.Sleep(110 * time.Millisecond)
+		if _, err := limit.acquire(context.Background(), "10.0.0.1"); err != nil {
+			subTest.Fatalf("expected a token after refill, received %s", err.Error())
+		}
+	})
+
+	t.Run("queue", func(subTest *testing.T) {
+
+		limit := &RateLimit{Host: "*", MaxConcurrent: 1, Queue: true}
+		if err := limit.compile(); err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+
+		release, err := limit.acquire(context.Background(), "example.com")
+		if err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+		time.AfterFunc(100*time.Millisecond, release)
+
+		start := time.Now()
+		if _, err := limit.acquire(context.Background(), "example.com"); err != nil {
+			subTest.Fatalf("expected the queued request to acquire, received %s", err.Error())
+		}
+		if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+			subTest.Fatalf("expected the queued request to wait for release, but waited %s", elapsed)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := limit.acquire(ctx, "example.com"); err == nil || !ERRRateLimited.Err().Match(err.(*ProxyError)) {
+			subTest.Fatalf("expected error %s when the client cancels, but received %v", ERRRateLimited, err)
+		}
+	})
+}
+
+func TestRateLimit_prune(t *testing.T) {
+
+	t.Parallel()
+
+	limit := &RateLimit{Host: "*", Rate: 10, Burst: 2, MaxConcurrent: 1}
+	if err := limit.compile(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	held, err := limit.acquire(context.Background(), "held.test")
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	defer held()
+	for _, host := range []string{"a.test", "b.test", "c.test"} {
+		release, err := limit.acquire(context.Background(), host)
+		if err != nil {
+			t.Fatalf("expected no error, received %s", err.Error())
+		}
+		release()
+	}
+	if _, err := limit.acquire(context.Background(), "c.test"); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	// Hosts are client controlled, so states idle longer than the 200ms refill are removed
+	time.Sleep(250 * time.Millisecond)
+	limit.lock.Lock()
+	limit.pruned = time.Now().Add(-rateLimitPruneInterval)
+	limit.lock.Unlock()
+
+	release, err := limit.acquire(context.Background(), "d.test")
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	release()
+
+	limit.lock.Lock()
+	defer limit.lock.Unlock()
+	for _, host := range []string{"a.test", "b.test"} {
+		if _, ok := limit.states[host]; ok {
+			t.Fatalf("expected the idle state of %s pruned", host)
+		}
+	}
+	for _, host := range []string{"held.test", "c.test", "d.test"} {
+		if _, ok := limit.states[host]; !ok {
+			t.Fatalf("expected the state of %s in use kept", host)
+		}
+	}
+}
+
+func TestReverseProxy_ServeHTTP_limits(t *testing.T) {
+
+	t.Parallel()
+
+	block := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/block" {
+			<-block
+		}
+		_, _ = writer.Write([]byte("okay"))
+	}))
+	defer upstream.Close()
+	upstreamHost := upstream.Listener.Addr().String()
+
+	p := &ReverseProxy{Limits: []*RateLimit{
+		{Client: "192.0.2.0/24", Rate: 1, Burst: 1},
+		{Host: "127.0.0.1", MaxConcurrent: 1, Status: http.StatusServiceUnavailable, Body: "busy", RetryAfter: 2},
+	}}
+	if err := p.LoadLimits(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	serve := func(remoteAddr, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = upstreamHost
+		req.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	if recorder := serve("192.0.2.1:1234", "/"); recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, but received %d", http.StatusOK, recorder.Code)
+	}
+	recorder := serve("192.0.2.1:1234", "/")
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status code %d, but received %d", http.StatusTooManyRequests, recorder.Code)
+	}
+	if recorder.Header().Get(GoMITMProxyHeader) != Version {
+		t.Fatalf("expected header %s on rejections", GoMITMProxyHeader)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serve("198.51.100.1:1234", "/block")
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	recorder = serve("198.51.100.2:1234", "/")
+	close(block)
+	wg.Wait()
+
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Body.String() != "busy" {
+		t.Fatalf("expected status code %d busy, but received %d %s", http.StatusServiceUnavailable, recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected Retry-After 2, but received %s", recorder.Header().Get("Retry-After"))
+	}
+
+	if recorder := serve("198.51.100.2:1234", "/"); recorder.Code != http.StatusOK {
+		t.Fatalf("expected status code %d after release, but received %d", http.StatusOK, recorder.Code)
+	}
+}
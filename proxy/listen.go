@@ -0,0 +1,80 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+	"strconv"
+)
+
+// Error listen address is not an ip, host name, or network interface
+const ERRListenAddr = ErrorStr("invalid listen address")
+
+// resolveListenAddrs expands network interface names to the ip addresses assigned to the interface. Addresses that
+// are not interface names, such as ips, 0.0.0.0, ::, and host names, are returned unchanged. An empty list returns
+// the fallback address.
+func resolveListenAddrs(addrs []string, fallback string) ([]string, error) {
+
+	if len(addrs) == 0 {
+		return []string{fallback}, nil
+	}
+
+	var resolved []string
+	for _, addr := range addrs {
+
+		if addr == "" || net.ParseIP(addr) != nil {
+			resolved = append(resolved, addr)
+			continue
+		}
+
+		iface, err := net.InterfaceByName(addr)
+		if err != nil {
+			resolved = append(resolved, addr)
+			continue
+		}
+
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, ERRListenAddr.Err().WithReason("interface %s, %s", addr, err.Error())
+		}
+
+		var found bool
+		for _, ifaceAddr := range ifaceAddrs {
+			ipNet, ok := ifaceAddr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			resolved = append(resolved, ipNet.IP.String())
+			found = true
+		}
+
+		if !found {
+			return nil, ERRListenAddr.Err().WithReason("interface %s has no usable addresses", addr)
+		}
+	}
+
+	return resolved, nil
+}
+
+// listenAddress joins a host, and port. A zero port selects a random port.
+func listenAddress(host string, port int) string {
+
+	if port > 0 {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	return net.JoinHostPort(host, "")
+}
+
+// advertisableAddr returns the first address that is a specific ip, and not 0.0.0.0, or ::.
+func advertisableAddr(addrs []string) string {
+
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && !ip.IsUnspecified() {
+			return addr
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestResolveListenAddrs(t *testing.T) {
+
+	t.Parallel()
+
+	t.Run("fallback", func(subTest *testing.T) {
+		addrs, err := resolveListenAddrs(nil, "127.0.0.1")
+		if err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+		if !reflect.DeepEqual(addrs, []string{"127.0.0.1"}) {
+			subTest.Fatalf("expected [127.0.0.1], but received %v", addrs)
+		}
+	})
+
+	t.Run("addresses", func(subTest *testing.T) {
+		addrs, err := resolveListenAddrs([]string{"0.0.0.0", "::", "localhost"}, "127.0.0.1")
+		if err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+		if !reflect.DeepEqual(addrs, []string{"0.0.0.0", "::", "localhost"}) {
+			subTest.Fatalf("expected addresses unchanged, but received %v", addrs)
+		}
+	})
+
+	t.Run("interface", func(subTest *testing.T) {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			subTest.Skipf("unable to list interfaces, %s", err.Error())
+		}
+
+		var loopback string
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				loopback = iface.Name
+				break
+			}
+		}
+		if loopback == "" {
+			subTest.Skip("no loopback interface")
+		}
+
+		addrs, err := resolveListenAddrs([]string{loopback}, "")
+		if err != nil {
+			subTest.Fatalf("expected no error, received %s", err.Error())
+		}
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip == nil || !ip.IsLoopback() {
+				subTest.Fatalf("expected loopback addresses for %s, but received %v", loopback, addrs)
+			}
+		}
+	})
+}
+
+func TestAdvertisableAddr(t *testing.T) {
+
+	t.Parallel()
+
+	if addr := advertisableAddr([]string{"0.0.0.0", "::", "eth0", "10.0.0.5"}); addr != "10.0.0.5" {
+		t.Fatalf("expected 10.0.0.5, but received %s", addr)
+	}
+
+	if addr := advertisableAddr([]string{"0.0.0.0"}); addr != "" {
+		t.Fatalf("expected no address, but received %s", addr)
+	}
+}
+
+func TestMITMProxy_runProxyServers_listenAddrs(t *testing.T) {
+
+	t.Parallel()
+
+	p := &MITMProxy{
+		ListenAddr:      "127.0.0.1",
+		HTTPListenAddrs: []string{"127.0.0.1", "127.0.0.2"},
+		HTTPPorts:       []int{0},
+	}
+	defer func() {
+		for _, srv := range p.servers {
+			_ = srv.Shutdown()
+		}
+	}()
+
+	if err := p.runProxyServers(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	if len(p.servers) != 2 {
+		t.Fatalf("expected 2 servers, but received %d", len(p.servers))
+	}
+	if cap(p.serverErrors) != len(p.servers) {
+		t.Fatalf("expected room for %d server errors, but received %d", len(p.servers), cap(p.serverErrors))
+	}
+	if len(p.HTTPPorts) != 1 || p.HTTPPorts[0] == 0 {
+		t.Fatalf("expected one selected port, but received %v", p.HTTPPorts)
+	}
+
+	for _, addr := range []string{"127.0.0.1", "127.0.0.2"} {
+		conn, err := net.Dial("tcp", listenAddress(addr, p.HTTPPorts[0]))
+		if err != nil {
+			t.Fatalf("expected server listening on %s, received %s", addr, err.Error())
+		}
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// BodyCaptureLimit is the largest request, or response body in bytes captured in a log message, when Capture is
+// configured, and BodyCapture.MaxSize is left unset. Zero captures bodies in full. Without a Capture config, bodies
+// are always captured in full.
+var BodyCaptureLimit int64
+
+// DefaultSpillSize is the size in bytes over which bodies are written to the spill directory, if
+// BodyCapture.SpillSize is left unset
+const DefaultSpillSize int64 = 64 << 10
+
+// BodyCapture limits the request, and response bodies captured in log messages. Bodies are always sent on the wire in
+// full, only the logged copy is limited.
+type BodyCapture struct {
+
+	// MaxSize is the largest body in bytes captured, the rest is discarded, and the record is marked BodyTruncated.
+	// The default is BodyCaptureLimit, and a negative size captures bodies in full.
+	MaxSize int64 `json:"max_size"`
+
+	// IncludeContentTypes, when set, captures only bodies with a matching content type. ExcludeContentTypes skips
+	// bodies with a matching content type, and the record is marked BodySkipped. Entries are media types, such as
+	// application/json, or type wildcards, such as image/*.
+	IncludeContentTypes []string `json:"include_content_types"`
+	ExcludeContentTypes []string `json:"exclude_content_types"`
+
+	// SpillDir, when set, writes bodies larger than SpillSize to files in the directory, named by the sha256 of the
+	// captured body, instead of holding them in memory. The record references the file with BodyFile, and BodyHash,
+	// and has an empty Body. Spilled bodies are not redacted, so Config.Load rejects a SpillDir when Redact is set.
+	SpillDir  string `json:"spill_dir"`
+	SpillSize int64  `json:"spill_size"`
+}
+
+// Load validates the content types, and creates the spill directory. Call Load before GetLogger.
+func (c *BodyCapture) Load() error {
+
+	for _, contentType := range append(append([]string{}, c.IncludeContentTypes...), c.ExcludeContentTypes...) {
+		if !strings.Contains(contentType, "/") {
+			return fmt.Errorf("invalid content type %q", contentType)
+		}
+	}
+
+	if c.SpillSize < 0 {
+		return fmt.Errorf("invalid spill size %d", c.SpillSize)
+	}
+
+	if c.SpillDir != "" {
+		if err := os.MkdirAll(c.SpillDir, 0700); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newBuffer returns the capture buffer of a body with the content type. A nil capture captures bodies in full.
+func (c *BodyCapture) newBuffer(contentType string) *captureBuffer {
+
+	if c == nil {
+		return &captureBuffer{limit: -1}
+	}
+
+	b := &captureBuffer{limit: c.MaxSize, spillDir: c.SpillDir, spillSize: c.SpillSize}
+	if b.limit == 0 {
+		b.limit = BodyCaptureLimit
+	}
+	if b.limit == 0 {
+		b.limit = -1
+	}
+	if b.spillSize == 0 {
+		b.spillSize = DefaultSpillSize
+	}
+
+	mediaType := contentTypeOf(contentType)
+	if len(c.IncludeContentTypes) > 0 && !matchContentType(c.IncludeContentTypes, mediaType) {
+		b.skipped = true
+	}
+	if matchContentType(c.ExcludeContentTypes, mediaType) {
+		b.skipped = true
+	}
+
+	return b
+}
+
+// contentTypeOf returns the lower case media type of a content type header, without parameters.
+func contentTypeOf(contentType string) string {
+
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+// matchContentType returns true when the media type matches an entry, or type wildcard. An empty media type matches
+// nothing.
+func matchContentType(entries []string, mediaType string) bool {
+
+	if mediaType == "" {
+		return false
+	}
+
+	for _, entry := range entries {
+		entry = strings.ToLower(entry)
+		if entry == mediaType || entry == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(entry, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(entry, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// captureBuffer stores a body up to limit bytes, in memory, or in a spill file once it grows over spillSize. Writes
+// never fail, so a body being streamed is not interrupted by the log capture. A failed spill file leaves the body in
+// memory. It is safe to read while the body is still being written, as a request body may be sent by the transport
+// while the message is logged.
+type captureBuffer struct {
+	lock      sync.Mutex
+	buffer    bytes.Buffer
+	limit     int64
+	size      int64
+	captured  int64
+	truncated bool
+	skipped   bool
+
+	spillDir  string
+	spillSize int64
+	spill     *os.File
+	hash      hash.Hash
+	file      string
+	sum       string
+	err       error
+	closed    bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n := len(p)
+	b.size += int64(n)
+	if b.skipped {
+		return n, nil
+	}
+
+	if b.closed || (b.limit >= 0 && b.captured+int64(len(p)) > b.limit) {
+		b.truncated = true
+		room := b.limit - b.captured
+		if b.closed || room <= 0 {
+			return n, nil
+		}
+		p = p[:room]
+	}
+	b.captured += int64(len(p))
+
+	if b.spill == nil && b.spillDir != "" && b.err == nil && b.captured > b.spillSize {
+		b.startSpill()
+	}
+
+	if b.spill != nil {
+		_, _ = b.hash.Write(p)
+		if _, err := b.spill.Write(p); err != nil {
+			b.err, b.truncated = err, true
+		}
+		return n, nil
+	}
+
+	_, _ = b.buffer.Write(p)
+
+	return n, nil
+}
+
+// Bytes returns a copy of the body captured in memory.
+func (b *captureBuffer) Bytes() []byte {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]byte{}, b.buffer.Bytes()...)
+}
+
+// captureResult is the state of a capture, read under the lock
+type captureResult struct {
+	body      []byte
+	size      int64
+	truncated bool
+	skipped   bool
+	file      string
+	sum       string
+}
+
+// result returns a copy of the body captured in memory, and the state of the capture.
+func (b *captureBuffer) result() captureResult {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return captureResult{
+		body:      append([]byte{}, b.buffer.Bytes()...),
+		size:      b.size,
+		truncated: b.truncated,
+		skipped:   b.skipped,
+		file:      b.file,
+		sum:       b.sum,
+	}
+}
+
+// startSpill moves the buffered body to a temporary file in the spill directory.
+func (b *captureBuffer) startSpill() {
+
+	spill, err := ioutil.TempFile(b.spillDir, ".body-")
+	if err != nil {
+		b.err = err
+		return
+	}
+
+	b.spill, b.hash = spill, sha256.New()
+	_, _ = b.hash.Write(b.buffer.Bytes())
+	if _, err = b.spill.Write(b.buffer.Bytes()); err != nil {
+		b.err, b.truncated = err, true
+	}
+	b.buffer.Reset()
+}
+
+// Close ends the capture, and renames a spill file to the sha256 of the body. Bodies with the same hash share a
+// file. Writes after Close are discarded, and mark the body truncated.
+func (b *captureBuffer) Close() error {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return b.err
+	}
+	b.closed = true
+
+	if b.spill == nil {
+		return nil
+	}
+
+	name := b.spill.Name()
+	if err := b.spill.Close(); err != nil && b.err == nil {
+		b.err = err
+	}
+	if b.err != nil {
+		_ = os.Remove(name)
+		return b.err
+	}
+
+	b.sum = hex.EncodeToString(b.hash.Sum(nil))
+	b.file = filepath.Join(b.spillDir, b.sum)
+	if _, err := os.Stat(b.file); err == nil {
+		_ = os.Remove(name)
+		return nil
+	}
+	if b.err = os.Rename(name, b.file); b.err != nil {
+		_ = os.Remove(name)
+		b.file, b.sum = "", ""
+	}
+
+	return b.err
+}
+
+// captureReadCloser reads from the tee of a body, closes the original body, and then ends the capture.
+type captureReadCloser struct {
+	io.Reader
+	body   io.Closer
+	buffer *captureBuffer
+}
+
+func (r *captureReadCloser) Close() error {
+
+	err := r.body.Close()
+	_ = r.buffer.Close()
+
+	return err
+}
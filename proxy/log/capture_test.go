@@ -0,0 +1,190 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBodyCapture_newBuffer(t *testing.T) {
+
+	t.Parallel()
+
+	capture := &BodyCapture{
+		IncludeContentTypes: []string{"application/json", "text/*", "image/*"},
+		ExcludeContentTypes: []string{"image/*"},
+	}
+	if err := capture.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	for _, test := range []struct {
+		contentType string
+		skipped     bool
+	}{
+		{"application/json; charset=utf-8", false},
+		{"Text/HTML", false},
+		{"image/png", true},
+		{"video/mp4", true},
+		{"", true},
+	} {
+		if b := capture.newBuffer(test.contentType); b.skipped != test.skipped {
+			t.Fatalf("expected %q skipped %t, but received %t", test.contentType, test.skipped, b.skipped)
+		}
+	}
+
+	var nilCapture *BodyCapture
+	if b := nilCapture.newBuffer("image/png"); b.skipped || b.limit >= 0 {
+		t.Fatalf("expected a nil capture to capture every body in full, but received limit %d", b.limit)
+	}
+	if b := (&BodyCapture{}).newBuffer(""); b.limit >= 0 {
+		t.Fatalf("expected an unset max size to capture bodies in full, but received limit %d", b.limit)
+	}
+
+	if err := (&BodyCapture{ExcludeContentTypes: []string{"image"}}).Load(); err == nil {
+		t.Fatalf("expected an error for a content type without a subtype")
+	}
+}
+
+func TestCaptureBuffer_Write(t *testing.T) {
+
+	t.Parallel()
+
+	buf := &captureBuffer{limit: 8}
+	for _, chunk := range []string{"12345", "67890", "abc"} {
+		n, err := buf.Write([]byte(chunk))
+		if err != nil || n != len(chunk) {
+			t.Fatalf("expected write of %d bytes without error, but wrote %d, %v", len(chunk), n, err)
+		}
+	}
+
+	if string(buf.Bytes()) != "12345678" || !buf.truncated || buf.size != 13 {
+		t.Fatalf("expected 12345678 of 13 bytes truncated, but found %s of %d bytes", buf.Bytes(), buf.size)
+	}
+
+	unlimited := &captureBuffer{limit: -1}
+	_, _ = unlimited.Write(bytes.Repeat([]byte("a"), 100))
+	_ = unlimited.Close()
+	_, _ = unlimited.Write([]byte("b"))
+	if len(unlimited.Bytes()) != 100 || !unlimited.truncated {
+		t.Fatalf("expected writes after close to be discarded, and marked truncated")
+	}
+}
+
+func TestCaptureBuffer_concurrent(t *testing.T) {
+
+	t.Parallel()
+
+	buf := &captureBuffer{limit: -1}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			_, _ = buf.Write([]byte("body"))
+		}
+		done <- true
+	}()
+
+	// The message may be logged while the transport is still sending the body
+	for i := 0; i < 100; i++ {
+		if captured := buf.result(); int64(len(captured.body)) > captured.size {
+			t.Fatalf("expected at most %d captured bytes, but received %d", captured.size, len(captured.body))
+		}
+	}
+	<-done
+
+	if len(buf.Bytes()) != 4000 {
+		t.Fatalf("expected 4000 bytes captured, but received %d", len(buf.Bytes()))
+	}
+}
+
+func TestResponseRecord_spill(t *testing.T) {
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "bodies")
+	if err != nil {
+		t.Fatalf("failed to create temp dir, %s", err.Error())
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	handler := NewHandler(INFO)
+	handler.Capture = &BodyCapture{MaxSize: -1, SpillDir: dir, SpillSize: 16}
+
+	body := strings.Repeat("spilled body ", 100)
+	sum := sha256.Sum256([]byte(body))
+
+	for _, content := range []string{"small", body, body} {
+		recorder := httptest.NewRecorder()
+		_, _ = recorder.WriteString(content)
+		res := recorder.Result()
+
+		msg := handler.WithField("test", true).WithResponse(res)
+		data, _ := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		_ = msg.Response.ReadBody()
+
+		if string(data) != content {
+			t.Fatalf("expected the client to receive the full body, but received %d bytes", len(data))
+		}
+		if msg.Response.BodySize != int64(len(content)) {
+			t.Fatalf("expected body size %d, but received %d", len(content), msg.Response.BodySize)
+		}
+
+		if content == "small" {
+			if msg.Response.Body != "small" || msg.Response.BodyFile != "" {
+				t.Fatalf("expected a small body logged inline, but received %+v", msg.Response)
+			}
+			continue
+		}
+
+		if msg.Response.Body != "" || msg.Response.BodyHash != hex.EncodeToString(sum[:]) {
+			t.Fatalf("expected a spilled body referenced by hash, but received %+v", msg.Response)
+		}
+		spilled, err := ioutil.ReadFile(msg.Response.BodyFile)
+		if err != nil || string(spilled) != body {
+			t.Fatalf("expected the spill file to hold the body, but received %v", err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Fatalf("expected identical bodies to share 1 spill file, but found %v", files)
+	}
+}
+
+func TestRequestRecord_capture(t *testing.T) {
+
+	t.Parallel()
+
+	handler := NewHandler(INFO)
+	handler.Capture = &BodyCapture{MaxSize: 4, ExcludeContentTypes: []string{"image/*"}}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("truncated"))
+	msg := handler.WithRequest(req)
+	_, _ = ioutil.ReadAll(req.Body)
+	_ = msg.Request.ReadBody()
+
+	if msg.Request.Body != "trun" || !msg.Request.BodyTruncated {
+		t.Fatalf("expected a body truncated at 4 bytes, but received %+v", msg.Request)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("png"))
+	req.Header.Set("Content-Type", "image/png")
+	msg = handler.WithRequest(req)
+	_, _ = ioutil.ReadAll(req.Body)
+	_ = msg.Request.ReadBody()
+
+	if msg.Request.Body != "" || !msg.Request.BodySkipped || msg.Request.BodySize != 3 {
+		t.Fatalf("expected an excluded body skipped, but received %+v", msg.Request)
+	}
+}
@@ -3,16 +3,56 @@
 
 package log
 
+import "fmt"
+
 type Config struct {
 	Level          Level  `json:"log_level"`
 	Format         Format `json:"log_format"`
 	RequestLogFile string `json:"request_log_file"`
 	WebHookURL     string `json:"webhook_url"`
+
+	// RequestLogMaxSize in bytes, and RequestLogRotateInterval in seconds rotate the request log file.
+	// RequestLogMaxFiles is the number of rotated files kept, and RequestLogCompress gzips rotated files.
+	RequestLogMaxSize        int64 `json:"request_log_max_size"`
+	RequestLogRotateInterval int   `json:"request_log_rotate_interval"`
+	RequestLogMaxFiles       int   `json:"request_log_max_files"`
+	RequestLogCompress       bool  `json:"request_log_compress"`
+
+	// Redact replaces sensitive values in messages before they are written to any writer.
+	Redact *Redactor `json:"redact"`
+
+	// Capture limits the size, and content types of request, and response bodies captured in messages, and spills
+	// large bodies to files.
+	Capture *BodyCapture `json:"capture"`
+}
+
+// Load loads the redact, and capture configs, and rejects a spill dir when bodies are redacted. Call Load before
+// GetLogger.
+func (c *Config) Load() error {
+
+	if c.Redact != nil {
+		if err := c.Redact.Load(); err != nil {
+			return fmt.Errorf("invalid redact config, %s", err.Error())
+		}
+	}
+
+	if c.Capture != nil {
+		if c.Redact != nil && c.Capture.SpillDir != "" {
+			return fmt.Errorf("invalid capture config, spill_dir can't be used with redact, spilled bodies are not redacted")
+		}
+		if err := c.Capture.Load(); err != nil {
+			return fmt.Errorf("invalid capture config, %s", err.Error())
+		}
+	}
+
+	return nil
 }
 
 func (c Config) GetLogger() (handler *DefaultHandler, requestWriter *RequestWriter) {
 
 	handler = NewHandler(c.Level)
+	handler.Redactor = c.Redact
+	handler.Capture = c.Capture
 
 	if c.Format == JSON {
 		handler.SetWriter(&JSONWriter{})
@@ -21,7 +61,13 @@ func (c Config) GetLogger() (handler *DefaultHandler, requestWriter *RequestWrit
 	}
 
 	if c.RequestLogFile != "" {
-		requestWriter = &RequestWriter{RequestLogFile: c.RequestLogFile}
+		requestWriter = &RequestWriter{
+			RequestLogFile: c.RequestLogFile,
+			MaxSize:        c.RequestLogMaxSize,
+			RotateInterval: c.RequestLogRotateInterval,
+			MaxFiles:       c.RequestLogMaxFiles,
+			Compress:       c.RequestLogCompress,
+		}
 		handler.AddWriter(requestWriter)
 	}
 
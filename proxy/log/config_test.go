@@ -97,3 +97,26 @@ func TestConfig_GetLogger(t *testing.T) {
 		}
 	})
 }
+
+func TestConfig_Load(t *testing.T) {
+
+	t.Parallel()
+
+	config := NewDefaultConfig()
+	config.Redact = &Redactor{Headers: []string{"Cookie"}}
+	config.Capture = &BodyCapture{MaxSize: 1024}
+	if err := config.Load(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	config.Capture.SpillDir = "bodies"
+	if err := config.Load(); err == nil {
+		t.Fatalf("expected an error for a spill dir with redact, spilled bodies are not redacted")
+	}
+
+	config.Redact.Patterns = []string{"("}
+	config.Capture = nil
+	if err := config.Load(); err == nil {
+		t.Fatalf("expected an error for an invalid redact config")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DecodedBodyLimit is the largest body in bytes logged after decompression. Larger bodies are cut at the limit, and
+// the record is marked BodyTruncated.
+var DecodedBodyLimit int64 = 16 << 20
+
+const (
+	// BodyEncodingBase64 is the BodyEncoding of binary bodies, logged as base64
+	BodyEncodingBase64 = "base64"
+
+	// BodyEncodingUTF8 is the BodyEncoding of textual bodies, logged as a utf-8 string
+	BodyEncodingUTF8 = "utf-8"
+)
+
+// decodeBody removes the content encodings of a captured body, in the reverse of the order they were applied, and
+// returns the decoded body, and the encodings removed. A body in an unsupported encoding, or that fails to decode is
+// returned as captured, unless the capture was truncated, when the part decoded before the cut is returned.
+func decodeBody(body []byte, contentEncoding string, truncated bool) ([]byte, string, bool) {
+
+	var encodings []string
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		if encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding != "" && encoding != "identity" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(body) == 0 || len(encodings) == 0 {
+		return body, "", truncated
+	}
+
+	decoded := body
+	for i := len(encodings) - 1; i >= 0; i-- {
+		reader, err := newDecoder(encodings[i], decoded)
+		if err != nil {
+			return body, "", truncated
+		}
+
+		var out bytes.Buffer
+		_, err = io.Copy(&out, io.LimitReader(reader, DecodedBodyLimit+1))
+		_ = reader.Close()
+		if err != nil && !(truncated && out.Len() > 0) {
+			return body, "", truncated
+		}
+		decoded = out.Bytes()
+		if int64(len(decoded)) > DecodedBodyLimit {
+			decoded, truncated = decoded[:DecodedBodyLimit], true
+		}
+	}
+
+	return decoded, strings.Join(encodings, ", "), truncated
+}
+
+// newDecoder returns a reader of the body decompressed with the content encoding.
+func newDecoder(encoding string, body []byte) (io.ReadCloser, error) {
+
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// Deflate is zlib wrapped, though some servers send a raw deflate stream
+		if reader, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			return reader, nil
+		}
+		return flate.NewReader(bytes.NewReader(body)), nil
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(bytes.NewReader(body))), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+}
+
+// encodeBody returns a textual body with valid utf-8 as a string, and other bodies as base64, with the encoding used.
+// Bodies without a content type are sniffed.
+func encodeBody(body []byte, contentType string) (string, string) {
+
+	if len(body) == 0 {
+		return "", ""
+	}
+
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	if isTextContentType(contentTypeOf(contentType)) && utf8.Valid(body) {
+		return string(body), BodyEncodingUTF8
+	}
+
+	return base64.StdEncoding.EncodeToString(body), BodyEncodingBase64
+}
+
+// decodeBodyString returns the bytes of a logged body. Bodies without an encoding are base64.
+func decodeBodyString(body, encoding string) []byte {
+
+	if encoding == BodyEncodingUTF8 {
+		return []byte(body)
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(body)
+
+	return data
+}
+
+// isTextContentType returns true for text, json, xml, javascript, and form media types.
+func isTextContentType(mediaType string) bool {
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json", strings.HasSuffix(mediaType, "+json"),
+		mediaType == "application/xml", strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/javascript", mediaType == "application/ecmascript",
+		mediaType == "application/x-www-form-urlencoded", mediaType == "multipart/form-data",
+		mediaType == "application/graphql":
+		return true
+	}
+
+	return false
+}
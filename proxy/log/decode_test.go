@@ -0,0 +1,149 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compress returns the data compressed with the writer.
+func compress(t *testing.T, data []byte, newWriter func(io.Writer) io.WriteCloser) []byte {
+
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	return buf.Bytes()
+}
+
+func TestResponseRecord_decode(t *testing.T) {
+
+	t.Parallel()
+
+	body := []byte(strings.Repeat(`{"message":"hello, wörld"}`, 20))
+	gzipped := compress(t, body, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+
+	for _, test := range []struct {
+		name     string
+		encoding string
+		wire     []byte
+	}{
+		{"gzip", "gzip", gzipped},
+		{"deflate", "deflate", compress(t, body, func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })},
+		{"raw_deflate", "deflate", compress(t, body, func(w io.Writer) io.WriteCloser {
+			writer, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return writer
+		})},
+		{"brotli", "br", compress(t, body, func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) })},
+		{"zstd", "zstd", compress(t, body, func(w io.Writer) io.WriteCloser {
+			writer, _ := zstd.NewWriter(w)
+			return writer
+		})},
+		{"chained", "gzip, br", compress(t, gzipped, func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) })},
+	} {
+		test := test
+		t.Run(test.name, func(subTest *testing.T) {
+
+			subTest.Parallel()
+
+			res := &http.Response{
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Content-Type":     []string{"application/json; charset=utf-8"},
+					"Content-Encoding": []string{test.encoding},
+				},
+				Body: ioutil.NopCloser(bytes.NewReader(test.wire)),
+			}
+
+			msg := NewMSG(&TestHandler{}).WithResponse(res)
+			wire, _ := ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+
+			if !bytes.Equal(wire, test.wire) {
+				subTest.Fatalf("expected the wire bytes unchanged")
+			}
+			if msg.Response.ReadBody(); msg.Response.Body != string(body) {
+				subTest.Fatalf("expected the decompressed body, but received %s", msg.Response.Body)
+			}
+			if msg.Response.BodyEncoding != BodyEncodingUTF8 || msg.Response.BodyDecompressed != test.encoding {
+				subTest.Fatalf("expected a %s body decompressed from %s, but received %s from %s",
+					BodyEncodingUTF8, test.encoding, msg.Response.BodyEncoding, msg.Response.BodyDecompressed)
+			}
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+
+	t.Parallel()
+
+	body := []byte(strings.Repeat("a truncated gzip body ", 200))
+	gzipped := compress(t, body, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+
+	decoded, encodings, truncated := decodeBody(gzipped[:len(gzipped)/2], "gzip", true)
+	if len(decoded) == 0 || !bytes.HasPrefix(body, decoded) || encodings != "gzip" || !truncated {
+		t.Fatalf("expected the part of a truncated body decoded, but received %d bytes", len(decoded))
+	}
+
+	if decoded, encodings, _ = decodeBody([]byte("not gzip"), "gzip", false); string(decoded) != "not gzip" || encodings != "" {
+		t.Fatalf("expected an invalid body logged as captured, but received %s from %s", decoded, encodings)
+	}
+
+	if decoded, encodings, _ = decodeBody([]byte("packed"), "compress", false); string(decoded) != "packed" || encodings != "" {
+		t.Fatalf("expected an unsupported encoding logged as captured, but received %s from %s", decoded, encodings)
+	}
+}
+
+func TestEncodeBody(t *testing.T) {
+
+	t.Parallel()
+
+	binary := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	for _, test := range []struct {
+		body        []byte
+		contentType string
+		encoded     string
+		encoding    string
+	}{
+		{[]byte("a=1&b=2"), "application/x-www-form-urlencoded", "a=1&b=2", BodyEncodingUTF8},
+		{[]byte("<p>hi</p>"), "", "<p>hi</p>", BodyEncodingUTF8},
+		{[]byte(`{"a":1}`), "application/problem+json", `{"a":1}`, BodyEncodingUTF8},
+		{binary, "image/png", base64.StdEncoding.EncodeToString(binary), BodyEncodingBase64},
+		{binary, "text/plain", base64.StdEncoding.EncodeToString(binary), BodyEncodingBase64},
+		{nil, "text/plain", "", ""},
+	} {
+		encoded, encoding := encodeBody(test.body, test.contentType)
+		if encoded != test.encoded || encoding != test.encoding {
+			t.Fatalf("expected %q as %s, but received %q as %s", test.body, test.encoding, encoded, encoding)
+		}
+		if !bytes.Equal(decodeBodyString(encoded, encoding), test.body) {
+			t.Fatalf("expected %q to decode to the body", encoded)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("text"))
+	msg := NewMSG(&TestHandler{}).WithRequest(req)
+	_, _ = ioutil.ReadAll(req.Body)
+	if !strings.Contains(string(msg.JSON()), `"Body":"text","BodyEncoding":"utf-8"`) {
+		t.Fatalf("expected a utf-8 body in the json message, but received %s", msg.JSON())
+	}
+}
@@ -51,6 +51,11 @@ func WithDNSNXDomain() *MSG {
 	return DefaultLogger.WithDNSNXDomain()
 }
 
+func WithWebSocketMessage(url, direction, opcode string, length int, payload []byte) *MSG {
+
+	return DefaultLogger.WithWebSocketMessage(url, direction, opcode, length, payload)
+}
+
 func Info(format string, a ...interface{}) {
 
 	DefaultLogger.Info(format, a...)
@@ -0,0 +1,140 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GRPCBodyLimit is the largest request, or response stream in bytes captured for gRPC message logging. Messages past
+// the limit are not logged, and a message cut by the limit is marked truncated.
+var GRPCBodyLimit int64 = 1 << 20
+
+// grpcMessageHeaderLength is the compressed flag, and the four byte message length that prefix each gRPC message
+const grpcMessageHeaderLength = 5
+
+// GRPCMessage is a single length prefixed gRPC message. Payload is the base64 encoded message as sent on the wire,
+// and JSON is the decoded message, when a descriptor for the method is known.
+type GRPCMessage struct {
+	Compressed bool            `json:"compressed,omitempty"`
+	Length     int             `json:"length"`
+	Payload    string          `json:"payload"`
+	Truncated  bool            `json:"truncated,omitempty"`
+	JSON       json.RawMessage `json:"json,omitempty"`
+
+	payload []byte
+}
+
+// Bytes returns the captured message payload.
+func (m *GRPCMessage) Bytes() []byte {
+
+	return m.payload
+}
+
+// GRPCRecord is a gRPC call relayed by the proxy. Service, and Method are parsed from the request path, and Status,
+// and StatusMessage are the grpc-status, and grpc-message trailers of the response.
+type GRPCRecord struct {
+	Service       string         `json:"service"`
+	Method        string         `json:"method"`
+	Status        string         `json:"status,omitempty"`
+	StatusMessage string         `json:"status_message,omitempty"`
+	Requests      []*GRPCMessage `json:"requests,omitempty"`
+	Responses     []*GRPCMessage `json:"responses,omitempty"`
+	TimeStamp     time.Time      `json:"timestamp"`
+
+	requestBuffer  *captureBuffer
+	responseBuffer *captureBuffer
+}
+
+// Load parses the service, and method from the request path, and captures the messages of the request body as it
+// is read.
+func (g *GRPCRecord) Load(req *http.Request) {
+
+	g.TimeStamp = time.Now()
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		g.Service, g.Method = path[:i], path[i+1:]
+	} else {
+		g.Method = path
+	}
+
+	if req.Body == nil {
+		return
+	}
+
+	g.requestBuffer = &captureBuffer{limit: GRPCBodyLimit}
+	req.Body = &captureReadCloser{Reader: io.TeeReader(req.Body, g.requestBuffer), body: req.Body, buffer: g.requestBuffer}
+}
+
+// LoadResponse captures the messages of the response body as it is read.
+func (g *GRPCRecord) LoadResponse(res *http.Response) {
+
+	g.responseBuffer = &captureBuffer{limit: GRPCBodyLimit}
+	res.Body = &captureReadCloser{Reader: io.TeeReader(res.Body, g.responseBuffer), body: res.Body, buffer: g.responseBuffer}
+}
+
+// ReadStatus sets the status from the response trailers, falling back to the headers for a trailers only response.
+// The grpc-message value is percent decoded.
+func (g *GRPCRecord) ReadStatus(res *http.Response) {
+
+	for _, header := range []http.Header{res.Trailer, res.Header} {
+		if status := header.Get("Grpc-Status"); status != "" {
+			g.Status = status
+			g.StatusMessage = header.Get("Grpc-Message")
+			if message, err := url.PathUnescape(g.StatusMessage); err == nil {
+				g.StatusMessage = message
+			}
+			return
+		}
+	}
+}
+
+// ReadMessages splits the captured request, and response bodies into messages.
+func (g *GRPCRecord) ReadMessages() {
+
+	if g.requestBuffer != nil {
+		g.Requests = SplitGRPCMessages(g.requestBuffer.Bytes())
+	}
+
+	if g.responseBuffer != nil {
+		g.Responses = SplitGRPCMessages(g.responseBuffer.Bytes())
+	}
+}
+
+// SplitGRPCMessages splits a gRPC body into length prefixed messages. A final message shorter than its length prefix
+// is returned truncated.
+func SplitGRPCMessages(data []byte) []*GRPCMessage {
+
+	var messages []*GRPCMessage
+	for len(data) >= grpcMessageHeaderLength {
+
+		message := &GRPCMessage{
+			Compressed: data[0]&0x1 != 0,
+			Length:     int(binary.BigEndian.Uint32(data[1:grpcMessageHeaderLength])),
+		}
+		data = data[grpcMessageHeaderLength:]
+
+		if len(data) < message.Length {
+			message.payload = data
+			message.Truncated = true
+			data = nil
+		} else {
+			message.payload = data[:message.Length]
+			data = data[message.Length:]
+		}
+		message.Payload = base64.StdEncoding.EncodeToString(message.payload)
+
+		messages = append(messages, message)
+	}
+
+	return messages
+}
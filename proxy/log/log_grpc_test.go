@@ -0,0 +1,52 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSplitGRPCMessages(t *testing.T) {
+
+	t.Parallel()
+
+	data := []byte{
+		0, 0, 0, 0, 2, 'h', 'i',
+		1, 0, 0, 0, 0,
+		0, 0, 0, 0, 4, 'a', 'b',
+	}
+
+	messages := SplitGRPCMessages(data)
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages, but received %d", len(messages))
+	}
+	if string(messages[0].Bytes()) != "hi" || messages[0].Compressed || messages[0].Payload != "aGk=" {
+		t.Fatalf("expected first message hi, but received %+v", messages[0])
+	}
+	if !messages[1].Compressed || messages[1].Length != 0 {
+		t.Fatalf("expected second message compressed, and empty, but received %+v", messages[1])
+	}
+	if !messages[2].Truncated || messages[2].Length != 4 || string(messages[2].Bytes()) != "ab" {
+		t.Fatalf("expected third message truncated, but received %+v", messages[2])
+	}
+}
+
+func TestGRPCRecord_ReadStatus(t *testing.T) {
+
+	t.Parallel()
+
+	// trailers only responses carry the status in the headers
+	record := &GRPCRecord{}
+	record.ReadStatus(&http.Response{Header: http.Header{"Grpc-Status": []string{"5"}, "Grpc-Message": []string{"not%20found"}}})
+	if record.Status != "5" || record.StatusMessage != "not found" {
+		t.Fatalf("expected status 5 not found, but received %s %s", record.Status, record.StatusMessage)
+	}
+
+	msg := NewMSG(NewHandler(INFO)).WithGRPC(&GRPCRecord{Service: "test.Echo", Method: "Say", Status: "0"})
+	if str := msg.String(); !strings.Contains(str, `grpc="test.Echo/Say" grpc_status="0"`) {
+		t.Fatalf("expected grpc method, and status in %s", str)
+	}
+}
@@ -23,7 +23,10 @@ type MSG struct {
 	Request      *RequestRecord         `json:"request,omitempty"`
 	Response     *ResponseRecord        `json:"response,omitempty"`
 	DNS          *DNSRecord             `json:"dns,omitempty"`
+	WebSocket    *WebSocketRecord       `json:"websocket,omitempty"`
+	GRPC         *GRPCRecord            `json:"grpc,omitempty"`
 	ErrorMessage string                 `json:"error,omitempty"`
+	User         string                 `json:"user,omitempty"`
 	Level        Level                  `json:"level"`
 }
 
@@ -49,6 +52,13 @@ func (l *MSG) WithError(err error) *MSG {
 	return l
 }
 
+func (l *MSG) WithUser(user string) *MSG {
+
+	l.User = user
+
+	return l
+}
+
 func (l *MSG) WithField(key string, value interface{}) *MSG {
 
 	l.Fields[key] = value
@@ -58,7 +68,7 @@ func (l *MSG) WithField(key string, value interface{}) *MSG {
 
 func (l *MSG) WithRequest(req *http.Request) *MSG {
 
-	l.Request = &RequestRecord{}
+	l.Request = &RequestRecord{capture: l.bodyCapture()}
 	err := l.Request.Load(req)
 	if err != nil {
 		l.logger.WithError(err).Error("failed to log request")
@@ -69,7 +79,7 @@ func (l *MSG) WithRequest(req *http.Request) *MSG {
 
 func (l *MSG) WithResponse(res *http.Response) *MSG {
 
-	l.Response = &ResponseRecord{}
+	l.Response = &ResponseRecord{capture: l.bodyCapture()}
 	err := l.Response.Load(res)
 	if err != nil {
 		l.logger.WithError(err).Error("failed to log response")
@@ -78,6 +88,16 @@ func (l *MSG) WithResponse(res *http.Response) *MSG {
 	return l
 }
 
+// bodyCapture returns the body capture limits of the handler, or nil for the defaults.
+func (l *MSG) bodyCapture() *BodyCapture {
+
+	if handler, ok := l.logger.(*DefaultHandler); ok {
+		return handler.Capture
+	}
+
+	return nil
+}
+
 func (l *MSG) WithDNSQuestions(questions []dns.Question) *MSG {
 
 	if l.DNS == nil {
@@ -111,6 +131,21 @@ func (l *MSG) WithDNSNXDomain() *MSG {
 	return l
 }
 
+func (l *MSG) WithWebSocketMessage(url, direction, opcode string, length int, payload []byte) *MSG {
+
+	l.WebSocket = &WebSocketRecord{}
+	l.WebSocket.Load(url, direction, opcode, length, payload)
+
+	return l
+}
+
+func (l *MSG) WithGRPC(record *GRPCRecord) *MSG {
+
+	l.GRPC = record
+
+	return l
+}
+
 func (l *MSG) Info(format string, a ...interface{}) {
 
 	l.log(INFO, format, a...)
@@ -154,6 +189,9 @@ func (l *MSG) String() (msg string) {
 		msg = fmt.Sprintf("%s [%s] %s", msg, l.Request.Method, l.Request.URL.String())
 	} else if l.DNS != nil {
 		msg = fmt.Sprintf("%s [DNS]", msg)
+	} else if l.WebSocket != nil {
+		msg = fmt.Sprintf("%s [WS] %s %s %s length=%d",
+			msg, l.WebSocket.URL, l.WebSocket.Direction, l.WebSocket.Opcode, l.WebSocket.Length)
 	}
 
 	if l.Message != "" {
@@ -164,6 +202,10 @@ func (l *MSG) String() (msg string) {
 		msg = fmt.Sprintf("%s err=\"%s\"", msg, strings.Replace(l.ErrorMessage, "\"", "\\\"", -1))
 	}
 
+	if l.User != "" {
+		msg = fmt.Sprintf("%s user=\"%s\"", msg, strings.Replace(l.User, "\"", "\\\"", -1))
+	}
+
 	var keys []string
 	for key := range l.Fields {
 		keys = append(keys, key)
@@ -177,6 +219,11 @@ func (l *MSG) String() (msg string) {
 			strings.Replace(fmt.Sprintf("%v", l.Fields[key]), "\"", "\\\"", -1))
 	}
 
+	if l.GRPC != nil {
+		msg = fmt.Sprintf("%s grpc=\"%s/%s\" grpc_status=\"%s\" grpc_messages=\"%d/%d\"",
+			msg, l.GRPC.Service, l.GRPC.Method, l.GRPC.Status, len(l.GRPC.Requests), len(l.GRPC.Responses))
+	}
+
 	if l.DNS != nil && len(l.DNS.Questions) > 0 {
 
 		var qSlice []string
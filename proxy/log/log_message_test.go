@@ -4,6 +4,7 @@
 package log
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -75,6 +76,26 @@ func TestMSG_WithField(t *testing.T) {
 	}
 }
 
+func TestMSG_WithUser(t *testing.T) {
+
+	t.Parallel()
+
+	testHandler := &TestHandler{}
+	msg := NewMSG(testHandler)
+	msg.WithUser("test_user")
+
+	if msg.User != "test_user" {
+		t.Fatalf("expected user %s to match original value test_user", msg.User)
+	}
+
+	msg.Timestamp = time.Now()
+	msg.Level = INFO
+	expectedMsg := fmt.Sprintf("%s INFO: user=\"test_user\"", msg.Timestamp.Format(time.RFC3339))
+	if msg.String() != expectedMsg {
+		t.Fatalf("expected message string \n%s\nbut found\n%s", expectedMsg, msg.String())
+	}
+}
+
 func TestMSG_String(t *testing.T) {
 
 	t.Parallel()
@@ -241,3 +262,25 @@ func (t *TestHandler) Fatal(string, ...interface{}) {}
 func (t *TestHandler) Warning(string, ...interface{}) {}
 
 func (t *TestHandler) Error(string, ...interface{}) {}
+
+func TestMSG_WithWebSocketMessage(t *testing.T) {
+
+	t.Parallel()
+
+	testHandler := &TestHandler{}
+	msg := NewMSG(testHandler)
+	payload := make([]byte, WebSocketPayloadLimit+10)
+	msg.WithWebSocketMessage("ws://localhost/socket", "client_to_server", "text", len(payload), payload)
+
+	if msg.WebSocket.Length != len(payload) {
+		t.Fatalf("expected length %d, but found %d", len(payload), msg.WebSocket.Length)
+	}
+
+	if !msg.WebSocket.Truncated {
+		t.Fatalf("expected payload to be marked truncated")
+	}
+
+	if len(msg.WebSocket.Payload) != base64.StdEncoding.EncodedLen(WebSocketPayloadLimit) {
+		t.Fatalf("expected payload capped at %d bytes", WebSocketPayloadLimit)
+	}
+}
@@ -4,11 +4,8 @@
 package log
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/url"
@@ -23,6 +20,13 @@ type RequestRecord struct {
 	ProtoMinor       int
 	Header           map[string][]string
 	Body             string
+	BodyEncoding     string `json:",omitempty"`
+	BodyDecompressed string `json:",omitempty"`
+	BodySize         int64  `json:",omitempty"`
+	BodyTruncated    bool   `json:",omitempty"`
+	BodySkipped      bool   `json:",omitempty"`
+	BodyFile         string `json:",omitempty"`
+	BodyHash         string `json:",omitempty"`
 	ContentLength    int64
 	TransferEncoding []string
 	Host             string
@@ -35,7 +39,9 @@ type RequestRecord struct {
 	TLS              bool
 	TimeStamp        time.Time
 
-	bodyBuffer *bytes.Buffer
+	capture    *BodyCapture
+	bodyBuffer *captureBuffer
+	bodyRead   bool
 }
 
 func (r *RequestRecord) Load(req *http.Request) (err error) {
@@ -59,27 +65,46 @@ func (r *RequestRecord) Load(req *http.Request) (err error) {
 	r.RequestURI = req.RequestURI
 	r.TLS = req.TLS != nil
 
-	r.bodyBuffer = bytes.NewBuffer(make([]byte, 0))
-	req.Body = ioutil.NopCloser(io.TeeReader(req.Body, r.bodyBuffer))
+	r.bodyBuffer = r.capture.newBuffer(req.Header.Get("Content-Type"))
+	if req.Body != nil {
+		req.Body = &captureReadCloser{Reader: io.TeeReader(req.Body, r.bodyBuffer), body: req.Body, buffer: r.bodyBuffer}
+	}
 
 	return nil
 }
 
 func (r *RequestRecord) ReadBody() error {
 
-	if r.bodyBuffer == nil {
+	if r.bodyBuffer == nil || r.bodyRead {
 		return nil
 	}
 
-	bodyBytes, err := ioutil.ReadAll(r.bodyBuffer)
-	if err != nil {
-		return err
-	}
-	r.Body = base64.StdEncoding.EncodeToString(bodyBytes)
+	// Reading the body ends the capture, so it is only decoded once
+	_ = r.bodyBuffer.Close()
+	r.bodyRead = true
+
+	captured := r.bodyBuffer.result()
+	header := http.Header(r.Header)
+	body, decompressed, truncated := decodeBody(captured.body, header.Get("Content-Encoding"), captured.truncated)
+	r.Body, r.BodyEncoding = encodeBody(body, header.Get("Content-Type"))
+	r.BodyDecompressed = decompressed
+	r.BodySize = captured.size
+	r.BodyTruncated = truncated
+	r.BodySkipped = captured.skipped
+	r.BodyFile = captured.file
+	r.BodyHash = captured.sum
 
 	return nil
 }
 
+// bodyBytes returns the logged body, decompressed, without consuming the capture buffer.
+func (r *RequestRecord) bodyBytes() []byte {
+
+	_ = r.ReadBody()
+
+	return decodeBodyString(r.Body, r.BodyEncoding)
+}
+
 func (r *RequestRecord) MarshalJSON() ([]byte, error) {
 	type RequestRecordAlias RequestRecord
 
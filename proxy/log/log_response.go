@@ -4,11 +4,8 @@
 package log
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"time"
 )
@@ -21,6 +18,13 @@ type ResponseRecord struct {
 	ProtoMinor       int
 	Header           http.Header
 	Body             string
+	BodyEncoding     string `json:",omitempty"`
+	BodyDecompressed string `json:",omitempty"`
+	BodySize         int64  `json:",omitempty"`
+	BodyTruncated    bool   `json:",omitempty"`
+	BodySkipped      bool   `json:",omitempty"`
+	BodyFile         string `json:",omitempty"`
+	BodyHash         string `json:",omitempty"`
 	ContentLength    int64
 	TransferEncoding []string
 	Uncompressed     bool
@@ -28,7 +32,9 @@ type ResponseRecord struct {
 	TLS              bool
 	TimeStamp        time.Time
 
-	bodyBuffer *bytes.Buffer
+	capture    *BodyCapture
+	bodyBuffer *captureBuffer
+	bodyRead   bool
 }
 
 func (r *ResponseRecord) Load(res *http.Response) (err error) {
@@ -46,27 +52,45 @@ func (r *ResponseRecord) Load(res *http.Response) (err error) {
 	r.Trailer = res.Trailer
 	r.TLS = res.TLS != nil
 
-	r.bodyBuffer = bytes.NewBuffer(make([]byte, 0))
-	res.Body = ioutil.NopCloser(io.TeeReader(res.Body, r.bodyBuffer))
+	r.bodyBuffer = r.capture.newBuffer(res.Header.Get("Content-Type"))
+	if res.Body != nil {
+		res.Body = &captureReadCloser{Reader: io.TeeReader(res.Body, r.bodyBuffer), body: res.Body, buffer: r.bodyBuffer}
+	}
 
 	return nil
 }
 
 func (r *ResponseRecord) ReadBody() error {
 
-	if r.bodyBuffer == nil {
+	if r.bodyBuffer == nil || r.bodyRead {
 		return nil
 	}
 
-	bodyBytes, err := ioutil.ReadAll(r.bodyBuffer)
-	if err != nil {
-		return err
-	}
-	r.Body = base64.StdEncoding.EncodeToString(bodyBytes)
+	// Reading the body ends the capture, so it is only decoded once
+	_ = r.bodyBuffer.Close()
+	r.bodyRead = true
+
+	captured := r.bodyBuffer.result()
+	body, decompressed, truncated := decodeBody(captured.body, r.Header.Get("Content-Encoding"), captured.truncated)
+	r.Body, r.BodyEncoding = encodeBody(body, r.Header.Get("Content-Type"))
+	r.BodyDecompressed = decompressed
+	r.BodySize = captured.size
+	r.BodyTruncated = truncated
+	r.BodySkipped = captured.skipped
+	r.BodyFile = captured.file
+	r.BodyHash = captured.sum
 
 	return nil
 }
 
+// bodyBytes returns the logged body, decompressed, without consuming the capture buffer.
+func (r *ResponseRecord) bodyBytes() []byte {
+
+	_ = r.ReadBody()
+
+	return decodeBodyString(r.Body, r.BodyEncoding)
+}
+
 func (r *ResponseRecord) MarshalJSON() ([]byte, error) {
 	type RequestRecordAlias ResponseRecord
 
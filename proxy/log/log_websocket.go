@@ -0,0 +1,41 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/base64"
+	"time"
+)
+
+// WebSocketPayloadLimit is the largest websocket payload in bytes stored in a log message. Longer payloads are cut
+// at the limit, and marked truncated.
+var WebSocketPayloadLimit = 4096
+
+// WebSocketRecord is a single websocket message relayed by the proxy. Direction is client_to_server, or
+// server_to_client, Length is the full message length, and Payload is the base64 encoded message payload, capped at
+// WebSocketPayloadLimit.
+type WebSocketRecord struct {
+	URL       string    `json:"url"`
+	Direction string    `json:"direction"`
+	Opcode    string    `json:"opcode"`
+	Length    int       `json:"length"`
+	Payload   string    `json:"payload"`
+	Truncated bool      `json:"truncated,omitempty"`
+	TimeStamp time.Time `json:"timestamp"`
+}
+
+func (w *WebSocketRecord) Load(url, direction, opcode string, length int, payload []byte) {
+
+	w.TimeStamp = time.Now()
+	w.URL = url
+	w.Direction = direction
+	w.Opcode = opcode
+	w.Length = length
+
+	if len(payload) > WebSocketPayloadLimit {
+		payload = payload[:WebSocketPayloadLimit]
+	}
+	w.Truncated = len(payload) < length
+	w.Payload = base64.StdEncoding.EncodeToString(payload)
+}
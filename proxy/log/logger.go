@@ -29,6 +29,12 @@ type Handler interface {
 type DefaultHandler struct {
 	Writers []Writer `json:"-"`
 	Level   Level    `json:"log_level"`
+
+	// Redactor replaces sensitive values in every message before it is passed to the writers
+	Redactor *Redactor `json:"-"`
+
+	// Capture limits the request, and response bodies captured in messages
+	Capture *BodyCapture `json:"-"`
 }
 
 func NewHandler(level Level) *DefaultHandler {
@@ -57,6 +63,10 @@ func (l *DefaultHandler) Write(msg *MSG) {
 		l.Writers = []Writer{&TextWriter{}}
 	}
 
+	if l.Redactor != nil {
+		msg = l.Redactor.Redact(msg)
+	}
+
 	for _, w := range l.Writers {
 		err := w.Write(msg)
 		if err != nil {
@@ -122,6 +132,11 @@ func (l *DefaultHandler) WithDNSNXDomain() *MSG {
 	return l.NewMSG().WithDNSNXDomain()
 }
 
+func (l *DefaultHandler) WithWebSocketMessage(url, direction, opcode string, length int, payload []byte) *MSG {
+
+	return l.NewMSG().WithWebSocketMessage(url, direction, opcode, length, payload)
+}
+
 func (l *DefaultHandler) Info(format string, a ...interface{}) {
 
 	l.NewMSG().Info(format, a...)
@@ -0,0 +1,481 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RedactedValue replaces redacted values, when Redactor.Hash is not set
+const RedactedValue = "[REDACTED]"
+
+// RedactionPatterns are named regexes that may be used in Redactor.Patterns in place of a regex
+var RedactionPatterns = map[string]string{
+	"card_number":  `\b(?:\d[ -]?){12,18}\d\b`,
+	"bearer_token": `(?i)\bbearer\s+[a-z0-9._~+/-]+=*`,
+	"email":        `(?i)\b[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}\b`,
+	"aws_key":      `\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`,
+}
+
+// Redactor replaces sensitive values in log messages before any Writer sees them. Redaction is applied to a copy of
+// the message, and never changes the proxied requests, or responses.
+//
+// Headers are header, and trailer names, matched case insensitive. FormFields are url query, form, and multipart
+// field names. JSONPaths are dot separated object keys in json bodies, websocket messages, and decoded gRPC messages,
+// such as user.password, where * matches any key, or array index, and arrays are searched for the remaining path.
+// Patterns are regexes, or RedactionPatterns names, replaced in urls, header values, bodies, messages, and fields.
+//
+// Redacted values are replaced with RedactedValue, or when Hash is set, a hash of the value, so the same value is
+// always replaced with the same hash. HashKey keys the hash with hmac, so short values can't be found by guessing.
+type Redactor struct {
+	Headers    []string `json:"headers"`
+	FormFields []string `json:"form_fields"`
+	JSONPaths  []string `json:"json_paths"`
+	Patterns   []string `json:"patterns"`
+	Hash       bool     `json:"hash"`
+	HashKey    string   `json:"hash_key"`
+
+	headers  map[string]bool
+	fields   map[string]bool
+	paths    [][]string
+	patterns []*regexp.Regexp
+}
+
+// Load compiles the redaction rules. It must be called before the redactor is used.
+func (r *Redactor) Load() error {
+
+	r.headers = map[string]bool{}
+	for _, name := range r.Headers {
+		r.headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+	}
+
+	r.fields = map[string]bool{}
+	for _, name := range r.FormFields {
+		r.fields[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	r.paths = nil
+	for _, path := range r.JSONPaths {
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+		if path == "" {
+			return fmt.Errorf("invalid json path %q", path)
+		}
+		r.paths = append(r.paths, strings.Split(path, "."))
+	}
+
+	r.patterns = nil
+	for _, pattern := range r.Patterns {
+		expr := pattern
+		if preset, ok := RedactionPatterns[pattern]; ok {
+			expr = preset
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid redaction pattern %q, %s", pattern, err.Error())
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	return nil
+}
+
+// Redact returns a copy of the message with sensitive values replaced.
+func (r *Redactor) Redact(msg *MSG) *MSG {
+
+	redacted := *msg
+	redacted.Message = r.redactString(msg.Message)
+	redacted.ErrorMessage = r.redactString(msg.ErrorMessage)
+
+	if msg.Fields != nil {
+		redacted.Fields = make(map[string]interface{}, len(msg.Fields))
+		for key, value := range msg.Fields {
+			if s, ok := value.(string); ok {
+				value = r.redactString(s)
+			}
+			redacted.Fields[key] = value
+		}
+	}
+
+	if msg.Request != nil {
+		redacted.Request = r.redactRequest(msg.Request)
+	}
+	if msg.Response != nil {
+		redacted.Response = r.redactResponse(msg.Response)
+	}
+
+	if msg.WebSocket != nil {
+		record := *msg.WebSocket
+		record.URL = r.redactURLString(record.URL)
+		if payload, err := base64.StdEncoding.DecodeString(record.Payload); err == nil {
+			record.Payload = base64.StdEncoding.EncodeToString(r.redactBody(payload, ""))
+		}
+		redacted.WebSocket = &record
+	}
+
+	if msg.GRPC != nil {
+		record := *msg.GRPC
+		record.StatusMessage = r.redactString(record.StatusMessage)
+		record.Requests = r.redactGRPCMessages(record.Requests)
+		record.Responses = r.redactGRPCMessages(record.Responses)
+		redacted.GRPC = &record
+	}
+
+	return &redacted
+}
+
+// replacement returns the value redacted values are replaced with.
+func (r *Redactor) replacement(value string) string {
+
+	if !r.Hash {
+		return RedactedValue
+	}
+
+	var sum []byte
+	if r.HashKey != "" {
+		mac := hmac.New(sha256.New, []byte(r.HashKey))
+		_, _ = mac.Write([]byte(value))
+		sum = mac.Sum(nil)
+	} else {
+		hash := sha256.Sum256([]byte(value))
+		sum = hash[:]
+	}
+
+	return "[REDACTED:" + hex.EncodeToString(sum[:8]) + "]"
+}
+
+// redactString replaces pattern matches in the string.
+func (r *Redactor) redactString(s string) string {
+
+	for _, re := range r.patterns {
+		s = re.ReplaceAllStringFunc(s, r.replacement)
+	}
+
+	return s
+}
+
+// redactBytes replaces pattern matches in the bytes.
+func (r *Redactor) redactBytes(b []byte) []byte {
+
+	for _, re := range r.patterns {
+		b = re.ReplaceAllFunc(b, func(match []byte) []byte {
+			return []byte(r.replacement(string(match)))
+		})
+	}
+
+	return b
+}
+
+// redactRequest returns a copy of the request record, with the body captured, and redacted.
+func (r *Redactor) redactRequest(req *RequestRecord) *RequestRecord {
+
+	_ = req.ReadBody()
+	record := *req
+	record.URL = r.redactURL(req.URL)
+	record.RequestURI = r.redactURLString(req.RequestURI)
+	record.Header = r.redactHeader(req.Header)
+	record.Trailer = r.redactHeader(req.Trailer)
+	record.Form = r.redactValues(req.Form)
+	record.PostForm = r.redactValues(req.PostForm)
+	if req.MultipartForm != nil {
+		form := *req.MultipartForm
+		form.Value = r.redactValues(req.MultipartForm.Value)
+		record.MultipartForm = &form
+	}
+
+	contentType := http.Header(req.Header).Get("Content-Type")
+	record.Body, record.BodyEncoding = encodeBody(r.redactBody(req.bodyBytes(), contentType), contentType)
+	record.bodyBuffer = nil
+
+	return &record
+}
+
+// redactResponse returns a copy of the response record, with the body captured, and redacted.
+func (r *Redactor) redactResponse(res *ResponseRecord) *ResponseRecord {
+
+	_ = res.ReadBody()
+	record := *res
+	record.Header = r.redactHeader(res.Header)
+	record.Trailer = r.redactHeader(res.Trailer)
+
+	contentType := res.Header.Get("Content-Type")
+	record.Body, record.BodyEncoding = encodeBody(r.redactBody(res.bodyBytes(), contentType), contentType)
+	record.bodyBuffer = nil
+
+	return &record
+}
+
+// redactGRPCMessages returns copies of the messages with the decoded json redacted.
+func (r *Redactor) redactGRPCMessages(messages []*GRPCMessage) []*GRPCMessage {
+
+	if len(messages) == 0 {
+		return messages
+	}
+
+	redacted := make([]*GRPCMessage, len(messages))
+	for i, message := range messages {
+		copied := *message
+		if payload, err := base64.StdEncoding.DecodeString(copied.Payload); err == nil {
+			copied.Payload = base64.StdEncoding.EncodeToString(r.redactBytes(payload))
+		}
+		if len(copied.JSON) > 0 {
+			copied.JSON = r.redactBytes(r.redactJSON(copied.JSON))
+			// A pattern replaced outside of a json string leaves invalid json, logged as a string instead
+			if !json.Valid(copied.JSON) {
+				copied.JSON, _ = json.Marshal(string(copied.JSON))
+			}
+		}
+		redacted[i] = &copied
+	}
+
+	return redacted
+}
+
+// redactHeader returns a copy of the header, with the values of redacted headers replaced.
+func (r *Redactor) redactHeader(header map[string][]string) map[string][]string {
+
+	if header == nil {
+		return nil
+	}
+
+	redacted := make(map[string][]string, len(header))
+	for name, values := range header {
+		copied := make([]string, len(values))
+		for i, value := range values {
+			if r.headers[http.CanonicalHeaderKey(name)] {
+				copied[i] = r.replacement(value)
+			} else {
+				copied[i] = r.redactString(value)
+			}
+		}
+		redacted[name] = copied
+	}
+
+	return redacted
+}
+
+// redactValues returns a copy of the values, with redacted form fields replaced.
+func (r *Redactor) redactValues(values map[string][]string) map[string][]string {
+
+	if values == nil {
+		return nil
+	}
+
+	redacted := make(map[string][]string, len(values))
+	for name, fieldValues := range values {
+		copied := make([]string, len(fieldValues))
+		for i, value := range fieldValues {
+			if r.fields[strings.ToLower(name)] {
+				copied[i] = r.replacement(value)
+			} else {
+				copied[i] = r.redactString(value)
+			}
+		}
+		redacted[name] = copied
+	}
+
+	return redacted
+}
+
+// redactQuery returns the url encoded query with redacted form fields replaced. The query is only re-encoded when a
+// field is redacted.
+func (r *Redactor) redactQuery(query string) string {
+
+	if len(r.fields) > 0 && query != "" {
+		values, err := url.ParseQuery(query)
+		if err == nil {
+			for name := range values {
+				if r.fields[strings.ToLower(name)] {
+					query = url.Values(r.redactValues(values)).Encode()
+					break
+				}
+			}
+		}
+	}
+
+	return r.redactString(query)
+}
+
+// redactURL returns a copy of the url with the query, and path redacted.
+func (r *Redactor) redactURL(u *url.URL) *url.URL {
+
+	if u == nil {
+		return nil
+	}
+
+	redacted := *u
+	redacted.RawQuery = r.redactQuery(u.RawQuery)
+	if path := r.redactString(u.Path); path != u.Path {
+		redacted.Path, redacted.RawPath = path, ""
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			redacted.User = url.UserPassword(u.User.Username(), r.replacement(password))
+		}
+	}
+
+	return &redacted
+}
+
+// redactURLString redacts a url, or request uri string.
+func (r *Redactor) redactURLString(s string) string {
+
+	if i := strings.Index(s, "?"); i >= 0 {
+		return r.redactString(s[:i]) + "?" + r.redactQuery(s[i+1:])
+	}
+
+	return r.redactString(s)
+}
+
+// redactBody redacts json paths of json bodies, form fields of form, and multipart bodies, and patterns of all
+// bodies. Bodies without a content type are redacted as json when they are valid json.
+func (r *Redactor) redactBody(body []byte, contentType string) []byte {
+
+	if len(body) == 0 {
+		return body
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		return []byte(r.redactQuery(string(body)))
+	case mediaType == "multipart/form-data" && params["boundary"] != "":
+		body = r.redactMultipart(body, params["boundary"])
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || (mediaType == "" && json.Valid(body)):
+		body = r.redactJSON(body)
+	}
+
+	return r.redactBytes(body)
+}
+
+// redactMultipart replaces the content of multipart parts with a redacted form field name. The body is returned
+// unchanged when it can't be parsed, such as when the capture was truncated.
+func (r *Redactor) redactMultipart(body []byte, boundary string) []byte {
+
+	if len(r.fields) == 0 {
+		return body
+	}
+
+	var redacted bytes.Buffer
+	writer := multipart.NewWriter(&redacted)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return body
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body
+		}
+
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return body
+		}
+		if r.fields[strings.ToLower(part.FormName())] {
+			content = []byte(r.replacement(string(content)))
+		}
+
+		w, err := writer.CreatePart(textproto.MIMEHeader(part.Header))
+		if err != nil {
+			return body
+		}
+		_, _ = w.Write(content)
+	}
+	if err := writer.Close(); err != nil {
+		return body
+	}
+
+	return redacted.Bytes()
+}
+
+// redactJSON replaces the values of json paths. The body is only re-encoded when a value is redacted, and returned
+// unchanged when it isn't valid json.
+func (r *Redactor) redactJSON(body []byte) []byte {
+
+	if len(r.paths) == 0 {
+		return body
+	}
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return body
+	}
+
+	var changed bool
+	for _, path := range r.paths {
+		var c bool
+		doc, c = r.redactJSONPath(doc, path)
+		changed = changed || c
+	}
+	if !changed {
+		return body
+	}
+
+	redacted, err := json.Marshal(doc)
+	if err != nil {
+		return body
+	}
+
+	return redacted
+}
+
+// redactJSONPath replaces the values at the path below the node, and returns true when a value was replaced.
+func (r *Redactor) redactJSONPath(node interface{}, path []string) (interface{}, bool) {
+
+	if len(path) == 0 {
+		value, ok := node.(string)
+		if !ok {
+			data, _ := json.Marshal(node)
+			value = string(data)
+		}
+		return r.replacement(value), true
+	}
+
+	var changed bool
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, value := range n {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if redacted, c := r.redactJSONPath(value, path[1:]); c {
+				n[key], changed = redacted, true
+			}
+		}
+	case []interface{}:
+		for i, value := range n {
+			next := path
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				next = path[1:]
+			}
+			if redacted, c := r.redactJSONPath(value, next); c {
+				n[i], changed = redacted, true
+			}
+		}
+	}
+
+	return node, changed
+}
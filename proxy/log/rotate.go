@@ -0,0 +1,156 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rotatedTimeFormat is the timestamp appended to rotated request log files, sortable by name
+const rotatedTimeFormat = "20060102T150405.000000"
+
+// open opens the request log file for appending, and starts the size, and age of the file.
+func (w *RequestWriter) open() (err error) {
+
+	w.file, err = os.OpenFile(w.RequestLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w.size, w.opened = 0, time.Now()
+	if info, err := w.file.Stat(); err == nil {
+		w.size = info.Size()
+	}
+
+	return nil
+}
+
+// shouldRotate returns true when writing n bytes grows the file over MaxSize, or the file is older than
+// RotateInterval. A file is never rotated empty.
+func (w *RequestWriter) shouldRotate(n int64) bool {
+
+	if w.size == 0 {
+		return false
+	}
+	if w.MaxSize > 0 && w.size+n > w.MaxSize {
+		return true
+	}
+
+	return w.RotateInterval > 0 && time.Since(w.opened) >= time.Duration(w.RotateInterval)*time.Second
+}
+
+// rotate closes, and renames the file with a timestamp suffix, then compresses, and prunes rotated files in the
+// background. The next write opens a new file.
+func (w *RequestWriter) rotate() error {
+
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rotated := w.RequestLogFile + "." + now.Format(rotatedTimeFormat)
+	for exists(rotated) || exists(rotated+".gz") {
+		now = now.Add(time.Microsecond)
+		rotated = w.RequestLogFile + "." + now.Format(rotatedTimeFormat)
+	}
+	if err := os.Rename(w.RequestLogFile, rotated); err != nil {
+		return err
+	}
+
+	w.rotations.Add(1)
+	go func() {
+		defer w.rotations.Done()
+		w.finishRotation(rotated)
+	}()
+
+	return nil
+}
+
+// finishRotation compresses the rotated file, and removes the oldest rotated files over MaxFiles.
+func (w *RequestWriter) finishRotation(rotated string) {
+
+	w.pruneLock.Lock()
+	defer w.pruneLock.Unlock()
+
+	if w.Compress {
+		if err := compressFile(rotated); err != nil {
+			WithError(err).WithField("file", rotated).Error("failed to compress rotated request log")
+		}
+	}
+
+	if w.MaxFiles <= 0 {
+		return
+	}
+
+	files := w.rotatedFiles()
+	for len(files) > w.MaxFiles {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			WithError(err).WithField("file", files[0]).Error("failed to remove rotated request log")
+		}
+		files = files[1:]
+	}
+}
+
+// rotatedFiles returns the rotated request log files, oldest first.
+func (w *RequestWriter) rotatedFiles() []string {
+
+	matches, _ := filepath.Glob(w.RequestLogFile + ".*")
+
+	var files []string
+	for _, name := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(name, w.RequestLogFile+"."), ".gz")
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err == nil {
+			files = append(files, name)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return strings.TrimSuffix(files[i], ".gz") < strings.TrimSuffix(files[j], ".gz")
+	})
+
+	return files
+}
+
+// compressFile gzips the file to a .gz file, and removes the original.
+func compressFile(name string) (err error) {
+
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// exists returns true when the file exists.
+func exists(name string) bool {
+
+	_, err := os.Stat(name)
+
+	return err == nil
+}
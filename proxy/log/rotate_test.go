@@ -0,0 +1,154 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRequestMessage returns a message the request writer logs. The request time is fixed, so every message has the
+// same length.
+func testRequestMessage() *MSG {
+
+	msg := NewMSG(&TestHandler{}).WithRequest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	msg.Message = "request"
+	msg.Request.TimeStamp = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	return msg
+}
+
+// testLogDir returns a temp dir for request logs, and a func to remove it.
+func testLogDir(t *testing.T) (string, func()) {
+
+	dir, err := ioutil.TempDir("", "requestlog")
+	if err != nil {
+		t.Fatalf("failed to create temp dir, %s", err.Error())
+	}
+
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestRequestWriter_rotateSize(t *testing.T) {
+
+	t.Parallel()
+
+	dir, cleanup := testLogDir(t)
+	defer cleanup()
+
+	line := len(testRequestMessage().JSON()) + 1
+	w := &RequestWriter{
+		RequestLogFile: filepath.Join(dir, "requests.log"),
+		MaxSize:        int64(line * 2),
+		MaxFiles:       2,
+		Compress:       true,
+	}
+
+	for i := 0; i < 9; i++ {
+		if err := w.Write(testRequestMessage()); err != nil {
+			t.Fatalf("expected no error, received %s", err.Error())
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	rotated := w.rotatedFiles()
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 rotated files kept, but found %v", rotated)
+	}
+	for _, name := range rotated {
+		if !strings.HasSuffix(name, ".gz") {
+			t.Fatalf("expected rotated file %s to be compressed", name)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("expected no error, received %s", err.Error())
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("expected a gzip file, received %s", err.Error())
+		}
+		data, _ := ioutil.ReadAll(gz)
+		_ = f.Close()
+		if lines := bytes.Count(data, []byte("\n")); lines != 2 {
+			t.Fatalf("expected 2 lines in %s, but found %d", name, lines)
+		}
+	}
+
+	data, err := ioutil.ReadFile(w.RequestLogFile)
+	if err != nil || bytes.Count(data, []byte("\n")) != 1 {
+		t.Fatalf("expected the current file to hold the last line, but received %d bytes, %v", len(data), err)
+	}
+}
+
+func TestRequestWriter_rotateInterval(t *testing.T) {
+
+	t.Parallel()
+
+	dir, cleanup := testLogDir(t)
+	defer cleanup()
+
+	w := &RequestWriter{RequestLogFile: filepath.Join(dir, "requests.log"), RotateInterval: 60}
+	defer func() { _ = w.Close() }()
+
+	for i := 0; i < 2; i++ {
+		if err := w.Write(testRequestMessage()); err != nil {
+			t.Fatalf("expected no error, received %s", err.Error())
+		}
+	}
+	if rotated := w.rotatedFiles(); len(rotated) != 0 {
+		t.Fatalf("expected no rotation before the interval, but found %v", rotated)
+	}
+
+	w.opened = time.Now().Add(-time.Minute)
+	if err := w.Write(testRequestMessage()); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if rotated := w.rotatedFiles(); len(rotated) != 1 {
+		t.Fatalf("expected 1 rotated file after the interval, but found %v", rotated)
+	}
+}
+
+func TestRequestWriter_Reopen(t *testing.T) {
+
+	t.Parallel()
+
+	dir, cleanup := testLogDir(t)
+	defer cleanup()
+
+	w := &RequestWriter{RequestLogFile: filepath.Join(dir, "requests.log")}
+	defer func() { _ = w.Close() }()
+
+	if err := w.Write(testRequestMessage()); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	// Move the file as logrotate does, then signal the writer
+	moved := filepath.Join(dir, "requests.log.1")
+	if err := os.Rename(w.RequestLogFile, moved); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if err := w.Reopen(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if err := w.Write(testRequestMessage()); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	for _, name := range []string{moved, w.RequestLogFile} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil || bytes.Count(data, []byte("\n")) != 1 {
+			t.Fatalf("expected 1 line in %s, but received %d bytes, %v", name, len(data), err)
+		}
+	}
+}
@@ -21,8 +21,8 @@ func (w *WebHookWriter) Write(msg *MSG) error {
 		return nil
 	}
 
-	// Only log requests, responses, and dns
-	if msg.Request == nil && msg.Response == nil && msg.DNS == nil {
+	// Only log requests, responses, dns, and websocket messages
+	if msg.Request == nil && msg.Response == nil && msg.DNS == nil && msg.WebSocket == nil {
 		return nil
 	}
 
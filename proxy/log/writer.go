@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 )
 
 type Writer interface {
@@ -47,10 +48,25 @@ func (w *TextWriter) SetLevel(level Level) {
 }
 
 type RequestWriter struct {
-	lock sync.Mutex
-	file *os.File
+	lock      sync.Mutex
+	file      *os.File
+	size      int64
+	opened    time.Time
+	rotations sync.WaitGroup
+	pruneLock sync.Mutex
 
 	RequestLogFile string `json:"request_log_file"`
+
+	// MaxSize rotates the file before a write grows it over MaxSize bytes, and RotateInterval rotates the file once it
+	// has been open for RotateInterval seconds. Zero disables either rotation.
+	MaxSize        int64 `json:"max_size"`
+	RotateInterval int   `json:"rotate_interval"`
+
+	// MaxFiles is the number of rotated files kept, the oldest are removed first. Zero keeps every rotated file.
+	MaxFiles int `json:"max_files"`
+
+	// Compress gzips rotated files in the background
+	Compress bool `json:"compress"`
 }
 
 func (w *RequestWriter) Write(msg *MSG) (err error) {
@@ -59,22 +75,30 @@ func (w *RequestWriter) Write(msg *MSG) (err error) {
 		return nil
 	}
 
-	// Only log requests, responses, and dns
-	if msg.Request == nil && msg.Response == nil && msg.DNS == nil {
+	// Only log requests, responses, dns, and websocket messages
+	if msg.Request == nil && msg.Response == nil && msg.DNS == nil && msg.WebSocket == nil {
 		return nil
 	}
 
+	line := append(msg.JSON(), []byte("\n")...)
+
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	if w.file != nil && w.shouldRotate(int64(len(line))) {
+		if err = w.rotate(); err != nil {
+			return err
+		}
+	}
+
 	if w.file == nil {
-		w.file, err = os.OpenFile(w.RequestLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
+		if err = w.open(); err != nil {
 			return err
 		}
 	}
 
-	_, err = w.file.Write(append(msg.JSON(), []byte("\n")...))
+	n, err := w.file.Write(line)
+	w.size += int64(n)
 	if err != nil {
 		return err
 	}
@@ -83,10 +107,33 @@ func (w *RequestWriter) Write(msg *MSG) (err error) {
 
 func (w *RequestWriter) SetLevel(level Level) {}
 
+// Reopen closes the file, and the next write opens it again, creating a new file if it was moved. It is used by
+// external log rotation, such as logrotate, after the file is moved.
+func (w *RequestWriter) Reopen() error {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.close()
+}
+
+// Close closes the file, and waits for rotated files to be compressed.
 func (w *RequestWriter) Close() error {
 
+	w.lock.Lock()
+	err := w.close()
+	w.lock.Unlock()
+
+	w.rotations.Wait()
+
+	return err
+}
+
+func (w *RequestWriter) close() error {
+
 	if w.file != nil {
 		err := w.file.Close()
+		w.file = nil
 		if err != nil {
 			return err
 		}
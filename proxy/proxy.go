@@ -40,6 +40,8 @@ type Server interface {
 type MITMProxy struct {
 	servers      []Server
 	serverErrors chan error
+	clientACL    *ClientACL
+	shaping      []*ShapingRule
 
 	// LogResponses enabled logging the the response with the request.
 	LogResponses bool `json:"log_responses"`
@@ -56,12 +58,102 @@ type MITMProxy struct {
 	HTTPSPorts []int  `json:"https_ports"` // List of ports to start a tls server on
 	HTTPPorts  []int  `json:"http_ports"`  // List of ports to start http server on
 
+	// QUICPorts are udp ports to start an HTTP/3 server on, listening on the https listen addresses.
+	QUICPorts []int `json:"quic_ports"`
+
+	// AltSvc injects, or strips the Alt-Svc header of https responses, to steer clients toward, or away from HTTP/3.
+	// Inject advertises AltSvcPort, defaulting to the first of QUICPorts.
+	AltSvc     AltSvcMode `json:"alt_svc"`
+	AltSvcPort int        `json:"alt_svc_port"`
+
+	// HTTPSListenAddrs, HTTPListenAddrs, and DNSListenAddrs replace ListenAddr for each type of listener. Each is an
+	// ip, 0.0.0.0, ::, or a network interface name that is expanded to the addresses of the interface. A server is
+	// started on every port for each address.
+	HTTPSListenAddrs []string `json:"https_listen_addrs"`
+	HTTPListenAddrs  []string `json:"http_listen_addrs"`
+	DNSListenAddrs   []string `json:"dns_listen_addrs"`
+
+	// DNSAdvertisedAddr is the ip the dns server returns for names matching DNSRegex. It defaults to the first dns
+	// listen address that is a specific ip, and should be set when clients reach the proxy through a different
+	// address than it binds to, such as a docker port mapping.
+	DNSAdvertisedAddr string `json:"dns_advertised_addr"`
+
 	ForwardDNSServer string `json:"forward_dns_server"` // Forward DNS server for the dns server to query
 	DNSPort          int    `json:"dns_port"`           // Port to start listening for dns requests on, a zero value disables the server
+	DNSTLSPort       int    `json:"dns_tls_port"`       // Port to listen for dns over tls requests on, a zero value disables the server
+	DNSHTTPSPort     int    `json:"dns_https_port"`     // Port to listen for dns over https requests on, a zero value disables the server
 	DNSRegex         string `json:"dns_regex"`          // A regex pattern representing the vhosts to redirect to the proxy
 
+	// ForwardDNSServers are fallback forwarders, tried in order when ForwardDNSServer fails. Each is an ip with an
+	// optional port, a tls:// dns over tls address, or a https:// dns over https url.
+	ForwardDNSServers      []string `json:"forward_dns_servers"`
+	DNSHealthCheckInterval int      `json:"dns_health_check_interval"` // Seconds between dns forwarder health checks
+
+	DNSRecordFile string `json:"dns_record_file"` // File the dns server records every forwarded answer to
+	DNSReplayFile string `json:"dns_replay_file"` // File of recorded answers the dns server replays instead of forwarding
+
+	// Cache settings for forwarded dns answers, see DNSServer. TTLs, and intervals are in seconds.
+	DNSCacheSize          int `json:"dns_cache_size"`           // Maximum cached answers, a negative value disables the cache
+	DNSCacheMinTTL        int `json:"dns_cache_min_ttl"`        // Lowest ttl forwarded answers are cached for
+	DNSCacheMaxTTL        int `json:"dns_cache_max_ttl"`        // Highest ttl forwarded answers are cached for
+	DNSNegativeCacheTTL   int `json:"dns_negative_cache_ttl"`   // TTL of cached nxdomain answers, the SOA minimum if zero
+	DNSCacheStatsInterval int `json:"dns_cache_stats_interval"` // Seconds between dns cache stats log messages
+	DNSRewriteTTL         int `json:"dns_rewrite_ttl"`          // TTL of answers redirected to the proxy
+
+	DNSRules         []*DNSRule         `json:"dns_rules"`          // Ordered dns rules, evaluated before DNSRegex
+	DNSStaticRecords []*DNSStaticRecord `json:"dns_static_records"` // Records the dns server answers without forwarding
+	DNSHostsFile     string             `json:"dns_hosts_file"`     // Hosts format file the dns server answers without forwarding
+
 	DNSResolverOverride string `json:"dns_resolver_override"` // DNSServer overrides net.DefaultResolver with this dns server address.
 
+	// GRPCDescriptorSets are FileDescriptorSet files used by ReverseProxy to decode logged gRPC messages to json.
+	GRPCDescriptorSets []string `json:"grpc_descriptor_sets"`
+
+	// UpstreamProtocol forces the http version ReverseProxy uses for upstream requests, http1, h2, h2c, or mirror
+	// to follow the client. The default negotiates HTTP/2 over tls when the upstream offers it.
+	UpstreamProtocol UpstreamProtocol `json:"upstream_protocol"`
+
+	// UpstreamProxy chains upstream requests through a parent proxy, an http://, https://, or socks5:// url with
+	// optional user:password credentials. Hosts matching UpstreamProxyBypass PAC style patterns, or the
+	// UpstreamNoProxy list are connected directly.
+	UpstreamProxy       string   `json:"upstream_proxy"`
+	UpstreamProxyBypass []string `json:"upstream_proxy_bypass"`
+	UpstreamNoProxy     []string `json:"upstream_no_proxy"`
+
+	// Routes send ReverseProxy requests matching a host, and path pattern, such as api.example.com/v2/*, to an
+	// alternate upstream, or a load balanced pool of upstreams, with optional Host header, and SNI rewrites.
+	Routes []*Route `json:"routes"`
+
+	// Faults inject delays, synthetic status codes, connection resets, body faults, and dns failures into requests,
+	// and dns questions matching fault rules. Injection can be toggled at runtime with Faults.SetEnabled.
+	Faults *FaultInjector `json:"faults"`
+
+	// Shaping applies network profiles, throughput caps, added latency, and stalls, to connections from matching
+	// client ips, and to upstream connections to matching hosts. Profiles may use the 3g, slow_4g, or satellite
+	// presets.
+	Shaping []*ShapingRule `json:"shaping"`
+
+	// Limits cap the request rate, and concurrent requests of each client address, and each upstream host. Requests
+	// over a limit are queued, or rejected with a 429, or the configured response.
+	Limits []*RateLimit `json:"limits"`
+
+	// Filter blocks requests, and dns questions for matching hosts, and requests for matching urls. Blocked requests
+	// get an html, or json block page, and blocked questions get nxdomain. Block lists may be hosts files, domain
+	// lists, or Adblock style domain rules.
+	Filter *HostFilter `json:"filter"`
+
+	// ProxyAuthFile is a credential file of user:password lines. When set, ReverseProxy requires every request on the
+	// http listeners to authenticate with Proxy-Authorization basic auth, and records the user on each log message.
+	// Passwords may be bcrypt, or {SHA} htpasswd hashes, or plain text. Https, and quic requests are not
+	// authenticated. ProxyAuthExemptRedirected also skips origin form http requests, redirected to the proxy by dns.
+	ProxyAuthFile             string `json:"proxy_auth_file"`
+	ProxyAuthExemptRedirected bool   `json:"proxy_auth_exempt_redirected"`
+
+	// AllowClients, and DenyClients are client ips, or cidrs accepted, or refused by the http, https, quic, and dns
+	// servers. Denied clients are checked first, and when AllowClients is not empty, other clients are refused.
+	AllowClients []string `json:"allow_clients"`
+	DenyClients  []string `json:"deny_clients"`
+
 	// ProxyTransport is the http.Handler that receives requests, and performs the round trip.
 	// If this value is nil, then ReverseProxy is used.
 	//
@@ -90,16 +182,84 @@ func NewProxyWithDefaults() *MITMProxy {
 // server error is received, or the servers exit.
 func (p *MITMProxy) Run() (err error) {
 
+	if p.Faults != nil {
+		if err := p.Faults.Load(); err != nil {
+			return err
+		}
+	}
+
+	if p.Filter != nil {
+		if err := p.Filter.Load(); err != nil {
+			return err
+		}
+	}
+
+	if len(p.AllowClients) > 0 || len(p.DenyClients) > 0 {
+		p.clientACL = &ClientACL{Allow: p.AllowClients, Deny: p.DenyClients}
+		if err := p.clientACL.Load(); err != nil {
+			return err
+		}
+	}
+
+	if p.shaping, err = compileShapingRules(p.Shaping); err != nil {
+		return err
+	}
+
 	if p.ProxyTransport == nil {
-		p.ProxyTransport = &ReverseProxy{LogResponses: p.LogResponses}
+		if err := p.UpstreamProtocol.Validate(); err != nil {
+			return err
+		}
+		altSvcPort := p.AltSvcPort
+		if altSvcPort == 0 && len(p.QUICPorts) > 0 {
+			altSvcPort = p.QUICPorts[0]
+		}
+		if err := p.AltSvc.Validate(altSvcPort); err != nil {
+			return err
+		}
+		reverseProxy := &ReverseProxy{
+			LogResponses:       p.LogResponses,
+			GRPCDescriptorSets: p.GRPCDescriptorSets,
+			UpstreamProtocol:   p.UpstreamProtocol,
+			AltSvc:             p.AltSvc,
+			AltSvcPort:         altSvcPort,
+			Faults:             p.Faults,
+			Filter:             p.Filter,
+		}
+		if err := reverseProxy.LoadGRPCDescriptorSets(); err != nil {
+			return err
+		}
+		if p.UpstreamProxy != "" {
+			upstreamProxy := &UpstreamProxy{URL: p.UpstreamProxy, Bypass: p.UpstreamProxyBypass, NoProxy: p.UpstreamNoProxy}
+			if reverseProxy.Transport, err = upstreamProxy.Transport(); err != nil {
+				return err
+			}
+		}
+		transport, ok := reverseProxy.Transport.(*http.Transport)
+		if !ok {
+			transport = http.DefaultTransport.(*http.Transport)
+		}
+		reverseProxy.Transport = shapeTransport(transport, p.shaping)
+		reverseProxy.Limits = p.Limits
+		if err := reverseProxy.LoadLimits(); err != nil {
+			return err
+		}
+		reverseProxy.Routes = p.Routes
+		if err := reverseProxy.LoadRoutes(); err != nil {
+			return err
+		}
+		if p.ProxyAuthFile != "" {
+			reverseProxy.Auth = &ProxyAuth{CredentialFile: p.ProxyAuthFile, ExemptRedirected: p.ProxyAuthExemptRedirected}
+			if err := reverseProxy.Auth.Load(); err != nil {
+				return err
+			}
+		}
+		p.ProxyTransport = reverseProxy
 	}
 
 	if p.ListenAddr == "" {
 		p.ListenAddr = "127.0.0.1"
 	}
 
-	p.serverErrors = make(chan error, len(p.HTTPSPorts)+len(p.HTTPPorts))
-
 	if p.Certs == nil {
 		p.Certs = &Certs{}
 		if p.CACertFile == "" || p.CAKeyFile == "" {
@@ -152,9 +312,33 @@ func (p *MITMProxy) runDNSServer() {
 
 	dnsServer := DNSServer{
 		ListenAddr:       p.ListenAddr,
+		ListenAddrs:      p.DNSListenAddrs,
+		AdvertisedAddr:   p.DNSAdvertisedAddr,
 		Port:             p.DNSPort,
 		ForwardDNSServer: p.ForwardDNSServer,
 		DNSRegex:         p.DNSRegex,
+		Rules:            p.DNSRules,
+		StaticRecords:    p.DNSStaticRecords,
+		HostsFile:        p.DNSHostsFile,
+		TLSPort:          p.DNSTLSPort,
+		HTTPSPort:        p.DNSHTTPSPort,
+		Certs:            p.Certs,
+
+		ForwardDNSServers:   p.ForwardDNSServers,
+		HealthCheckInterval: p.DNSHealthCheckInterval,
+		RecordFile:          p.DNSRecordFile,
+		ReplayFile:          p.DNSReplayFile,
+
+		CacheSize:          p.DNSCacheSize,
+		CacheMinTTL:        p.DNSCacheMinTTL,
+		CacheMaxTTL:        p.DNSCacheMaxTTL,
+		NegativeCacheTTL:   p.DNSNegativeCacheTTL,
+		CacheStatsInterval: p.DNSCacheStatsInterval,
+		RewriteTTL:         p.DNSRewriteTTL,
+
+		Faults:    p.Faults,
+		Filter:    p.Filter,
+		ClientACL: p.clientACL,
 	}
 
 	if err := dnsServer.ListenAndServe(); err != nil {
@@ -162,44 +346,107 @@ func (p *MITMProxy) runDNSServer() {
 	}
 }
 
+// runProxyServers starts a server for each port on every listen address. When a port is zero, the random port
+// selected for the first address is used for the remaining addresses.
 func (p *MITMProxy) runProxyServers() error {
 
+	httpsAddrs, err := resolveListenAddrs(p.HTTPSListenAddrs, p.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	httpAddrs, err := resolveListenAddrs(p.HTTPListenAddrs, p.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	// Every server sends its exit error, so no server blocks after Run returns
+	servers := (len(p.HTTPSPorts)+len(p.QUICPorts))*len(httpsAddrs) + len(p.HTTPPorts)*len(httpAddrs)
+	p.serverErrors = make(chan error, servers)
+
 	var httpsPorts []int
 	for _, port := range p.HTTPSPorts {
+		for _, addr := range httpsAddrs {
 
-		srv, err := p.runTLSServer(port)
-		if err != nil {
-			return err
-		}
+			srv, err := p.runTLSServer(addr, port)
+			if err != nil {
+				return err
+			}
 
-		httpsPorts = append(httpsPorts, srv.GetPort())
-		p.servers = append(p.servers, srv)
+			port = srv.GetPort()
+			p.servers = append(p.servers, srv)
+		}
+		httpsPorts = append(httpsPorts, port)
 	}
 	p.HTTPSPorts = httpsPorts
 
+	var quicPorts []int
+	for _, port := range p.QUICPorts {
+		for _, addr := range httpsAddrs {
+
+			srv, err := p.runQUICServer(addr, port)
+			if err != nil {
+				return err
+			}
+
+			port = srv.GetPort()
+			p.servers = append(p.servers, srv)
+		}
+		quicPorts = append(quicPorts, port)
+	}
+	p.QUICPorts = quicPorts
+
 	var httpPorts []int
 	for _, port := range p.HTTPPorts {
+		for _, addr := range httpAddrs {
 
-		srv, err := p.runHTTPServer(port)
-		if err != nil {
-			return err
-		}
+			srv, err := p.runHTTPServer(addr, port)
+			if err != nil {
+				return err
+			}
 
-		httpPorts = append(httpPorts, srv.GetPort())
-		p.servers = append(p.servers, srv)
+			port = srv.GetPort()
+			p.servers = append(p.servers, srv)
+		}
+		httpPorts = append(httpPorts, port)
 	}
 	p.HTTPPorts = httpPorts
 
 	return nil
 }
 
-func (p *MITMProxy) runTLSServer(port int) (*TLSServer, error) {
+func (p *MITMProxy) runTLSServer(addr string, port int) (*TLSServer, error) {
 
 	ready := make(chan bool, 1)
 	srv := &TLSServer{
-		ListenAddr: p.ListenAddr,
+		ListenAddr: addr,
+		Port:       port,
+		Certs:      p.Certs,
+		Shaping:    p.shaping,
+		ClientACL:  p.clientACL,
+	}
+
+	go func() {
+		p.serverErrors <- srv.ListenAndServe(ready, p.ProxyTransport)
+	}()
+
+	select {
+	case <-ready:
+	case <-time.After(1 * time.Second):
+		return nil, ERRTLSProxyStart.Err().WithReason("timed out waiting %s to be ready", listenAddress(addr, srv.GetPort()))
+	}
+
+	return srv, nil
+}
+
+func (p *MITMProxy) runQUICServer(addr string, port int) (*QUICServer, error) {
+
+	ready := make(chan bool, 1)
+	srv := &QUICServer{
+		ListenAddr: addr,
 		Port:       port,
 		Certs:      p.Certs,
+		ClientACL:  p.clientACL,
 	}
 
 	go func() {
@@ -209,18 +456,20 @@ func (p *MITMProxy) runTLSServer(port int) (*TLSServer, error) {
 	select {
 	case <-ready:
 	case <-time.After(1 * time.Second):
-		return nil, ERRTLSProxyStart.Err().WithReason("timed out waiting %s:%d to be ready", p.ListenAddr, srv.GetPort())
+		return nil, ERRQUICProxyStart.Err().WithReason("timed out waiting %s to be ready", listenAddress(addr, srv.GetPort()))
 	}
 
 	return srv, nil
 }
 
-func (p *MITMProxy) runHTTPServer(port int) (*HTTPServer, error) {
+func (p *MITMProxy) runHTTPServer(addr string, port int) (*HTTPServer, error) {
 
 	ready := make(chan bool, 1)
 	srv := &HTTPServer{
-		ListenAddr: p.ListenAddr,
+		ListenAddr: addr,
 		Port:       port,
+		Shaping:    p.shaping,
+		ClientACL:  p.clientACL,
 	}
 
 	go func() {
@@ -230,7 +479,7 @@ func (p *MITMProxy) runHTTPServer(port int) (*HTTPServer, error) {
 	select {
 	case <-ready:
 	case <-time.After(1 * time.Second):
-		return nil, ERRHTTPProxyStart.Err().WithReason("timed out waiting %s:%d to be ready", p.ListenAddr, srv.GetPort())
+		return nil, ERRHTTPProxyStart.Err().WithReason("timed out waiting %s to be ready", listenAddress(addr, srv.GetPort()))
 	}
 
 	return srv, nil
@@ -43,7 +43,7 @@ func TestProxy_Run(t *testing.T) {
 
 	go func() {
 		if err := proxy.Run(); err != nil {
-			t.Fatalf("server exited non-nil error, %s", err.Error())
+			t.Errorf("server exited non-nil error, %s", err.Error())
 		}
 	}()
 	defer func() {
@@ -172,7 +172,7 @@ func TestProxy_Run_http2(t *testing.T) {
 
 	go func() {
 		if err := proxy.Run(); err != nil {
-			t.Fatalf("server exited non-nil error, %s", err.Error())
+			t.Errorf("server exited non-nil error, %s", err.Error())
 		}
 	}()
 	defer func() {
@@ -0,0 +1,125 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// Error returned when quic server fails to start
+const ERRQUICProxyStart = ErrorStr("quic server failed to start")
+
+// Error alt-svc mode is not one of the AltSvcMode values, or inject has no port to advertise
+const ERRAltSvc = ErrorStr("invalid alt-svc config")
+
+// DefaultAltSvcMaxAge is the max age in seconds of injected Alt-Svc headers
+const DefaultAltSvcMaxAge = 86400
+
+// QUICServer handles incoming HTTP/3 requests over QUIC for MITMProxy
+type QUICServer struct {
+	server *http3.Server
+
+	ListenAddr string     // UDP address for the server to listen on
+	Port       int        // UDP Port of the server to listen on
+	ClientACL  *ClientACL // Clients allowed to connect, every client when nil
+	Certs      *Certs     // Certificate cache
+}
+
+// ListenAndServe creates the server process, and blocks until an error occurs. A ready channel is used to signal
+// when the server has started listening.
+func (p *QUICServer) ListenAndServe(ready chan bool, handler http.Handler) error {
+
+	p.server = &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{GetCertificate: p.sniLookup}),
+		Handler:   handler,
+	}
+
+	connection, err := net.ListenPacket("udp", listenAddress(p.ListenAddr, p.Port))
+	if err != nil {
+		return err
+	}
+
+	p.Port = connection.LocalAddr().(*net.UDPAddr).Port
+	log.WithField("addr", connection.LocalAddr().String()).
+		Info("quic server started")
+
+	ready <- true
+	return p.server.Serve(p.ClientACL.packetConn(connection))
+}
+
+// GetPort returns the Port that QUICServer will listen to. In the case that Port is a nil value, this value will
+// change to a randomly selected Port after calling ListenAndServe
+func (p *QUICServer) GetPort() int {
+
+	return p.Port
+}
+
+// Shutdown closes the listening server. Open QUIC connections are closed immediately, as clients may hold idle
+// connections open indefinitely.
+func (p *QUICServer) Shutdown() error {
+
+	if p.server != nil {
+		return p.server.Close()
+	}
+
+	return nil
+}
+
+func (p *QUICServer) sniLookup(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	log.WithField("server_name", clientHello.ServerName).Debug("[SNI] quic lookup with client hello")
+	return p.Certs.Get(clientHello.ServerName)
+}
+
+// AltSvcMode controls the Alt-Svc header of https responses, to steer clients toward, or away from HTTP/3
+type AltSvcMode string
+
+const (
+	// AltSvcUnchanged passes the upstream Alt-Svc header through
+	AltSvcUnchanged AltSvcMode = ""
+
+	// AltSvcInject replaces the upstream Alt-Svc header with h3 on the proxy QUIC port
+	AltSvcInject AltSvcMode = "inject"
+
+	// AltSvcStrip removes the Alt-Svc header, so clients stay on tcp
+	AltSvcStrip AltSvcMode = "strip"
+)
+
+// Validate returns an error if the mode is unknown, or if inject has no port to advertise.
+func (a AltSvcMode) Validate(port int) error {
+
+	switch a {
+	case AltSvcUnchanged, AltSvcStrip:
+		return nil
+	case AltSvcInject:
+		if port <= 0 {
+			return ERRAltSvc.Err().WithReason("inject requires a fixed quic port")
+		}
+		return nil
+	}
+
+	return ERRAltSvc.Err().WithReason("unknown mode %s", a)
+}
+
+// setAltSvc applies the AltSvc mode to the response header of a tls request. Plain http responses are unchanged, as
+// Alt-Svc is only honored by clients over https.
+func (p *ReverseProxy) setAltSvc(header http.Header, req *http.Request) {
+
+	if req.TLS == nil {
+		return
+	}
+
+	switch p.AltSvc {
+	case AltSvcStrip:
+		header.Del("Alt-Svc")
+	case AltSvcInject:
+		header.Set("Alt-Svc", fmt.Sprintf(`%s=":%d"; ma=%d`, http3.NextProtoH3, p.AltSvcPort, DefaultAltSvcMaxAge))
+	}
+}
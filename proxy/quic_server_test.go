@@ -0,0 +1,121 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestQUICServer_ListenAndServe(t *testing.T) {
+
+	t.Parallel()
+
+	certs := &Certs{}
+	if _, _, err := certs.GenerateCAPair(); err != nil {
+		t.Fatalf("failed to generate ca, %s", err.Error())
+	}
+
+	srv := &QUICServer{ListenAddr: "127.0.0.1", Certs: certs}
+	ready := make(chan bool, 1)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe(ready, &testProxyHandler{response: []byte("okay")})
+	}()
+
+	select {
+	case <-ready:
+	case err := <-serverErr:
+		t.Fatalf("quic server failed to start, %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for quic server")
+	}
+	defer func() { _ = srv.Shutdown() }()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(certs.caCert)
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs, ServerName: "localhost"}}
+	defer func() { _ = transport.Close() }()
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/", srv.GetPort()))
+	if err != nil {
+		t.Fatalf("failed to make a quic connection to test proxy, %s", err.Error())
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.ProtoMajor != 3 {
+		t.Fatalf("expected HTTP/3, but received %s", resp.Proto)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("response body read returned error, %s", err.Error())
+	}
+	if string(body) != "okay" {
+		t.Fatalf("expected response body okay, but received %s", body)
+	}
+
+	if err := srv.Shutdown(); err != nil {
+		t.Fatalf("expected no error on shutdown, received %s", err.Error())
+	}
+	if err := <-serverErr; err != http.ErrServerClosed {
+		t.Fatalf("expected %v, but received %v", http.ErrServerClosed, err)
+	}
+}
+
+func TestReverseProxy_setAltSvc(t *testing.T) {
+
+	t.Parallel()
+
+	for _, test := range []struct {
+		name     string
+		mode     AltSvcMode
+		tls      bool
+		expected string
+	}{
+		{"unchanged", AltSvcUnchanged, true, `h2=":443"`},
+		{"inject", AltSvcInject, true, `h3=":8443"; ma=86400`},
+		{"strip", AltSvcStrip, true, ""},
+		{"plain_http", AltSvcInject, false, `h2=":443"`},
+	} {
+		test := test
+		t.Run(test.name, func(subTest *testing.T) {
+
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+			if test.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			header := http.Header{"Alt-Svc": []string{`h2=":443"`}}
+			(&ReverseProxy{AltSvc: test.mode, AltSvcPort: 8443}).setAltSvc(header, req)
+
+			if value := header.Get("Alt-Svc"); value != test.expected {
+				subTest.Fatalf("expected alt-svc %s, but received %s", test.expected, value)
+			}
+		})
+	}
+}
+
+func TestAltSvcMode_Validate(t *testing.T) {
+
+	t.Parallel()
+
+	if err := AltSvcInject.Validate(443); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	for _, err := range []error{AltSvcInject.Validate(0), AltSvcMode("h3").Validate(443)} {
+		if err == nil || !ERRAltSvc.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s, but received %v", ERRAltSvc, err)
+		}
+	}
+}
@@ -5,7 +5,10 @@ package proxy
 
 import (
 	"io"
+	"mime"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/jmizell/GoMITMProxy/proxy/log"
 )
@@ -13,6 +16,13 @@ import (
 // GoMITMProxyHeader is the header key added to all requests, and server responses that are proxied.
 const GoMITMProxyHeader = "GoMITMProxy"
 
+// DefaultStreamingContentTypes are the response media types flushed to the client after each write, if
+// StreamingContentTypes is left unset
+var DefaultStreamingContentTypes = []string{"text/event-stream", "application/grpc", "application/x-ndjson"}
+
+// copyBufferSize is the size of reads from the upstream response body
+const copyBufferSize = 32 * 1024
+
 // ReverseProxy is an http.Handler that that receives requests, performs the round trip,
 // and handles logging.
 type ReverseProxy struct {
@@ -22,6 +32,50 @@ type ReverseProxy struct {
 
 	// Transport is the http transport used to perform proxy requests. If nil, http.DefaultTransport is used.
 	Transport http.RoundTripper `json:"-"`
+
+	// WebSocketHook is called with every websocket frame relayed in either direction, and may modify, or drop the
+	// frame. Sec-WebSocket-Extensions is removed from the upstream upgrade request, so permessage-deflate is never
+	// negotiated, and payloads are always uncompressed. Only HTTP/1.1 upgrades are relayed, websockets over HTTP/2,
+	// RFC 8441 extended CONNECT, are not supported. The tls server doesn't advertise extended CONNECT, so clients
+	// upgrade over HTTP/1.1 instead.
+	WebSocketHook WebSocketHook `json:"-"`
+
+	// StreamingContentTypes are response media types flushed to the client after each write, in addition to chunked
+	// responses. Media types match as a prefix, so application/grpc also matches application/grpc+proto.
+	StreamingContentTypes []string `json:"streaming_content_types"`
+
+	// GRPCDescriptorSets are FileDescriptorSet files used to decode logged gRPC messages to json. Messages of methods
+	// not found in the sets are logged as base64. Call LoadGRPCDescriptorSets after setting.
+	GRPCDescriptorSets []string `json:"grpc_descriptor_sets"`
+
+	// UpstreamProtocol forces the http version of upstream requests. The default uses Transport unchanged.
+	UpstreamProtocol UpstreamProtocol `json:"upstream_protocol"`
+
+	// AltSvc injects, or strips the Alt-Svc header of https responses. AltSvcPort is the QUIC port advertised when
+	// injecting.
+	AltSvc     AltSvcMode `json:"alt_svc"`
+	AltSvcPort int        `json:"alt_svc_port"`
+
+	// Faults inject delays, errors, resets, and body faults into matched requests. Call Faults.Load after setting.
+	Faults *FaultInjector `json:"faults"`
+
+	// Limits cap the request rate, and concurrent requests per client, and per upstream host. Call LoadLimits after
+	// setting.
+	Limits []*RateLimit `json:"limits"`
+
+	// Routes send requests matching a host, and path pattern to alternate upstreams. Call LoadRoutes after setting.
+	Routes []*Route `json:"routes"`
+
+	// Filter blocks requests to matching hosts, and urls with a block page. Call Filter.Load after setting.
+	Filter *HostFilter `json:"filter"`
+
+	// Auth requires Proxy-Authorization basic auth from clients of the http listeners, answering 407 to requests
+	// without valid credentials. Call Auth.Load after setting.
+	Auth *ProxyAuth `json:"auth"`
+
+	grpcDecoder    *grpcDecoder
+	transports     *upstreamTransports
+	transportsOnce sync.Once
 }
 
 func (p *ReverseProxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
@@ -36,6 +90,24 @@ func (p *ReverseProxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 
 	logMsg := log.WithRequest(req)
 
+	if p.Auth != nil && p.Auth.required(req) {
+		user, err := p.Auth.authenticate(req)
+		if err != nil {
+			status := p.Auth.challenge(resp)
+			logMsg.WithField("status_code", status).WithError(err).Warning("request rejected")
+			return
+		}
+		req.Header.Del("Proxy-Authorization")
+		req = withProxyUser(req, user)
+		logMsg.WithUser(user)
+	}
+
+	if blocked, rule := p.Filter.matchRequest(req); blocked {
+		status := p.Filter.writeBlockPage(resp, req, rule)
+		logMsg.WithField("blocked", rule).WithField("status_code", status).Info("")
+		return
+	}
+
 	outRequest := req.WithContext(req.Context())
 	if req.ContentLength == 0 {
 		outRequest.Body = nil
@@ -44,24 +116,96 @@ func (p *ReverseProxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	outRequest.Header = req.Header
 	outRequest.Close = false
 
-	transport := p.Transport
-	if transport == nil {
-		transport = http.DefaultTransport
+	release, limit, err := p.acquireLimits(req)
+	if err != nil {
+		status := limit.reject(resp)
+		logMsg.WithField("rate_limit", limit.String()).
+			WithField("status_code", status).
+			WithError(err).
+			Warning("request rejected")
+		return
+	}
+	defer release()
+
+	fault := p.Faults.matchRequest(req)
+	if fault != nil {
+		logMsg.WithField("fault", fault.String())
+		if wait := fault.delay(req.Context()); wait > 0 {
+			logMsg.WithField("fault_delay_ms", wait.Milliseconds())
+		}
+		if fault.Status > 0 {
+			resp.Header().Add(GoMITMProxyHeader, Version)
+			resp.WriteHeader(fault.Status)
+			logMsg.WithField("status_code", fault.Status).Info("")
+			return
+		}
+	}
+
+	transport := p.upstreamTransport(req)
+	baseTransport := p.Transport
+	if baseTransport == nil {
+		baseTransport = http.DefaultTransport
+	}
+
+	route := p.route(req)
+	var upstream *upstreamBackend
+	if route != nil {
+		var err error
+		if upstream, err = route.pool.pick(req); err != nil {
+			logMsg.WithField("route", route.Pattern).WithError(err).Error("failed to select upstream")
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer route.pool.release(upstream)
+
+		route.rewrite(outRequest, upstream.url)
+		transport = route.transports.forRequest(outRequest)
+		baseTransport = route.transports.base
+		logMsg.WithField("route", route.Pattern).WithField("upstream", upstream.url.Host)
+	}
+
+	var grpcRecord *log.GRPCRecord
+	if isGRPC(req) {
+		grpcRecord = &log.GRPCRecord{}
+		grpcRecord.Load(outRequest)
+		logMsg.WithGRPC(grpcRecord)
+	}
+
+	upgrade := isWebSocketUpgrade(req)
+	if upgrade {
+		outRequest.Header = outRequest.Header.Clone()
+		outRequest.Header.Del("Sec-WebSocket-Extensions")
+		transport = webSocketTransport(baseTransport)
 	}
+
 	roundTripResponse, err := transport.RoundTrip(outRequest)
+	if route != nil {
+		route.pool.report(upstream, err)
+	}
 	if err != nil {
 		logMsg.WithError(err).Error("failed round trip")
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	defer func() { _ = roundTripResponse.Body.Close() }()
 	roundTripResponse.Header.Add(GoMITMProxyHeader, Version)
 
+	if upgrade && roundTripResponse.StatusCode == http.StatusSwitchingProtocols {
+		logMsg.WithField("status_code", roundTripResponse.StatusCode).WithField("websocket", true).Info("")
+		if err := p.serveWebSocket(resp, req, roundTripResponse); err != nil {
+			log.WithError(err).WithField("url", req.URL.String()).Error("websocket failed")
+		}
+		return
+	}
+
 	if p.LogResponses {
 		logMsg.WithResponse(roundTripResponse)
 	}
 
-	// TODO implement trailers
+	if grpcRecord != nil {
+		grpcRecord.LoadResponse(roundTripResponse)
+	}
 
 	for k, vv := range roundTripResponse.Header {
 		for _, v := range vv {
@@ -69,14 +213,118 @@ func (p *ReverseProxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	p.setAltSvc(resp.Header(), req)
+
+	announcedTrailers := len(roundTripResponse.Trailer)
+	if announcedTrailers > 0 {
+		trailerKeys := make([]string, 0, announcedTrailers)
+		for k := range roundTripResponse.Trailer {
+			trailerKeys = append(trailerKeys, k)
+		}
+		resp.Header().Add("Trailer", strings.Join(trailerKeys, ", "))
+	}
+
 	resp.WriteHeader(roundTripResponse.StatusCode)
-	logMsg.WithField("status_code", roundTripResponse.StatusCode)
+	logMsg.WithField("status_code", roundTripResponse.StatusCode).
+		WithField("client_proto", req.Proto).
+		WithField("upstream_proto", roundTripResponse.Proto)
 
-	byteCount, err := io.Copy(resp, roundTripResponse.Body)
+	var body io.Reader = roundTripResponse.Body
+	streaming := p.isStreaming(roundTripResponse)
+	if fault != nil && fault.bodyFaults() {
+		body = fault.wrapBody(req.Context(), body)
+		streaming = streaming || fault.DripRate > 0
+	}
+	if streaming {
+		logMsg.WithField("streaming", true)
+	}
+
+	byteCount, err := copyResponse(resp, body, streaming)
+	if perr, ok := err.(*ProxyError); ok && ERRFaultReset.Err().Match(perr) {
+		logMsg.WithField("response_bytes", byteCount).WithField("fault_reset", true).Info("")
+		resetConnection(resp)
+		return
+	}
 	if err != nil {
 		logMsg.WithError(err).Error("failed to write response")
 		return
 	}
 
+	// Trailers are only known after the body is read. Trailers announced before the body are set on the header,
+	// others are sent with the http.TrailerPrefix.
+	if len(roundTripResponse.Trailer) > 0 {
+		trailerPrefix := ""
+		if len(roundTripResponse.Trailer) != announcedTrailers {
+			trailerPrefix = http.TrailerPrefix
+		}
+		for k, vv := range roundTripResponse.Trailer {
+			for _, v := range vv {
+				resp.Header().Add(trailerPrefix+k, v)
+			}
+		}
+		logMsg.WithField("trailers", len(roundTripResponse.Trailer))
+	}
+
+	if grpcRecord != nil {
+		p.readGRPC(grpcRecord, req, roundTripResponse)
+	}
+
 	logMsg.WithField("response_bytes", byteCount).Info("")
 }
+
+// isStreaming returns true when the response is chunked, or has a streaming content type, and should be flushed
+// to the client after each write.
+func (p *ReverseProxy) isStreaming(res *http.Response) bool {
+
+	for _, encoding := range res.TransferEncoding {
+		if encoding == "chunked" {
+			return true
+		}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	contentTypes := p.StreamingContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = DefaultStreamingContentTypes
+	}
+	for _, contentType := range contentTypes {
+		if strings.HasPrefix(mediaType, contentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copyResponse copies the body to the client, flushing after each write when streaming.
+func copyResponse(resp http.ResponseWriter, body io.Reader, streaming bool) (int64, error) {
+
+	flusher, ok := resp.(http.Flusher)
+	if !streaming || !ok {
+		return io.Copy(resp, body)
+	}
+
+	var written int64
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			m, err := resp.Write(buf[:n])
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+			flusher.Flush()
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
@@ -4,6 +4,7 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -123,4 +125,94 @@ func TestReverseProxy_ServeHTTP(t *testing.T) {
 			subTest.Fatalf("expected response body to be OKAY, but received %s", string(respBody))
 		}
 	})
-}
\ No newline at end of file
+}
+func TestReverseProxy_ServeHTTP_trailers(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Trailer", "Grpc-Status")
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write([]byte("OKAY"))
+		writer.Header().Set("Grpc-Status", "0")
+		writer.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	}))
+	defer upstream.Close()
+
+	proxyServer := httptest.NewServer(&ReverseProxy{})
+	defer proxyServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request, %s", err.Error())
+	}
+	req.Host = strings.TrimPrefix(upstream.URL, "http://")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading from response body %s", err.Error())
+	}
+	if string(body) != "OKAY" {
+		t.Fatalf("expected response body to be OKAY, but received %s", string(body))
+	}
+
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("expected trailer Grpc-Status 0, but received %v", resp.Trailer)
+	}
+	if resp.Trailer.Get("Grpc-Message") != "done" {
+		t.Fatalf("expected trailer Grpc-Message done, but received %v", resp.Trailer)
+	}
+}
+
+func TestReverseProxy_ServeHTTP_streaming(t *testing.T) {
+
+	t.Parallel()
+
+	next := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/event-stream")
+		writer.Header().Set("Content-Length", "28")
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write([]byte("data: first\n\n"))
+		writer.(http.Flusher).Flush()
+		<-next
+		_, _ = writer.Write([]byte("data: second\n\n"))
+	}))
+	defer upstream.Close()
+
+	proxyServer := httptest.NewServer(&ReverseProxy{})
+	defer proxyServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request, %s", err.Error())
+	}
+	req.Host = strings.TrimPrefix(upstream.URL, "http://")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	reader := bufio.NewReader(resp.Body)
+	for _, expected := range []string{"data: first\n", "\n", "data: second\n"} {
+		if expected == "data: second\n" {
+			next <- true
+		}
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading from response body %s", err.Error())
+		}
+		if line != expected {
+			t.Fatalf("expected line %q, but received %q", expected, line)
+		}
+	}
+}
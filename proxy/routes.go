@@ -0,0 +1,233 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Error route configuration is invalid
+const ERRRouteInvalid = ErrorStr("invalid route")
+
+// Route sends requests matching a host, and path pattern to an alternate upstream, instead of the request host.
+// Routes are evaluated in order, the first matching route is used.
+type Route struct {
+	// Pattern is a host, and optional path glob, where * matches any characters, and ? matches one, such as
+	// api.example.com/v2/*, or *.example.com. A pattern without a path matches every path. The host is matched
+	// without the port, unless the pattern includes one.
+	Pattern string `json:"pattern"`
+
+	// Upstream is the url of the alternate upstream, such as http://localhost:8081. Only the scheme, and host are
+	// used, the request path is unchanged.
+	Upstream string `json:"upstream"`
+
+	// Upstreams is a pool of upstream urls, used instead of Upstream, selected following Balance. HashHeader is the
+	// consistent hash key, the client ip is used when the header is empty, or unset.
+	Upstreams  []string    `json:"upstreams"`
+	Balance    BalanceMode `json:"balance"`
+	HashHeader string      `json:"hash_header"`
+
+	// HealthCheck actively checks upstreams, when set. Upstreams are also ejected for EjectTime seconds after MaxFails
+	// consecutive round trip errors, when MaxFails is greater than zero.
+	HealthCheck *HealthCheck `json:"health_check"`
+	MaxFails    int          `json:"max_fails"`
+	EjectTime   int          `json:"eject_time"`
+
+	Host               string `json:"host"`                 // Host header sent upstream, the request host if empty
+	SNI                string `json:"sni"`                  // TLS server name sent to https upstreams, the Host header if empty
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Accept any upstream certificate, for local services
+
+	pattern    *hostPathPattern
+	pool       *upstreamPool
+	transports *upstreamTransports
+}
+
+// compile validates the route, and creates the upstream transport, derived from the proxy transport.
+func (r *Route) compile(transport http.RoundTripper, protocol UpstreamProtocol) (err error) {
+
+	if r.pattern, err = compileHostPathPattern(r.Pattern); err != nil {
+		return ERRRouteInvalid.Err().WithReason("pattern %q, %s", r.Pattern, err.Error())
+	}
+
+	upstreams := r.Upstreams
+	if r.Upstream != "" {
+		upstreams = append([]string{r.Upstream}, upstreams...)
+	}
+	if len(upstreams) == 0 {
+		return ERRRouteInvalid.Err().WithReason("pattern %q, missing upstream", r.Pattern)
+	}
+
+	var upstreamURLs []*url.URL
+	for _, upstream := range upstreams {
+		upstreamURL, err := url.Parse(upstream)
+		if err != nil {
+			return ERRRouteInvalid.Err().WithReason("pattern %q, %s", r.Pattern, err.Error())
+		}
+		switch upstreamURL.Scheme {
+		case "http", "https":
+		default:
+			return ERRRouteInvalid.Err().WithReason("pattern %q, upstream %q must be an http, or https url", r.Pattern, upstream)
+		}
+		if upstreamURL.Host == "" {
+			return ERRRouteInvalid.Err().WithReason("pattern %q, upstream %q missing host", r.Pattern, upstream)
+		}
+		upstreamURLs = append(upstreamURLs, upstreamURL)
+	}
+
+	if err = r.Balance.Validate(); err != nil {
+		return err
+	}
+	r.pool = newUpstreamPool(upstreamURLs, r.Balance, r.HashHeader, r.MaxFails, time.Duration(r.EjectTime)*time.Second)
+
+	serverName := r.SNI
+	if serverName == "" {
+		serverName, _ = splitHostPort(r.Host)
+	}
+	if serverName != "" || r.InsecureSkipVerify {
+		base, ok := transport.(*http.Transport)
+		if !ok {
+			return ERRRouteInvalid.Err().WithReason("pattern %q, sni requires an *http.Transport", r.Pattern)
+		}
+		base = base.Clone()
+		if base.TLSClientConfig == nil {
+			base.TLSClientConfig = &tls.Config{}
+		}
+		base.TLSClientConfig.ServerName = serverName
+		base.TLSClientConfig.InsecureSkipVerify = r.InsecureSkipVerify
+		transport = base
+	}
+	r.transports = newUpstreamTransports(transport, protocol)
+
+	return nil
+}
+
+// Match returns true when the request host, and path match the route pattern.
+func (r *Route) Match(req *http.Request) bool {
+
+	return r.pattern.match(req.Host, req.URL.Path)
+}
+
+// rewrite points the upstream request at the selected upstream, and sets the Host header.
+func (r *Route) rewrite(outRequest *http.Request, upstream *url.URL) {
+
+	upstreamURL := *outRequest.URL
+	upstreamURL.Scheme = upstream.Scheme
+	upstreamURL.Host = upstream.Host
+	outRequest.URL = &upstreamURL
+
+	if r.Host != "" {
+		outRequest.Host = r.Host
+	}
+}
+
+// LoadRoutes compiles Routes with the current Transport, and UpstreamProtocol, and starts upstream health checks. It is
+// called by MITMProxy.Run, and must be called before serving when the proxy is used on its own.
+func (p *ReverseProxy) LoadRoutes() error {
+
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	for _, route := range p.Routes {
+		if err := route.compile(transport, p.UpstreamProtocol); err != nil {
+			return err
+		}
+		if route.HealthCheck != nil {
+			client := healthCheckClient(route.transports.base)
+			go route.pool.healthCheck(context.Background(), route.HealthCheck, client, route.Host)
+		}
+	}
+
+	return nil
+}
+
+// route returns the first compiled route matching the request, or nil.
+func (p *ReverseProxy) route(req *http.Request) *Route {
+
+	for _, route := range p.Routes {
+		if route.transports != nil && route.Match(req) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// hostPathPattern is a host, and optional path glob, such as api.example.com/v2/*. The host is matched case
+// insensitive, and without the port, unless the pattern includes one.
+type hostPathPattern struct {
+	host      *regexp.Regexp
+	path      *regexp.Regexp
+	matchPort bool
+}
+
+// compileHostPathPattern splits the pattern at the first /, and compiles the host, and path globs.
+func compileHostPathPattern(pattern string) (*hostPathPattern, error) {
+
+	hostPattern, pathPattern := pattern, ""
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		hostPattern, pathPattern = pattern[:i], pattern[i:]
+	}
+	if hostPattern == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+
+	p := &hostPathPattern{matchPort: strings.Contains(hostPattern, ":")}
+
+	var err error
+	if p.host, err = globRegexp(strings.ToLower(hostPattern)); err != nil {
+		return nil, err
+	}
+	if pathPattern != "" {
+		if p.path, err = globRegexp(pathPattern); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// match returns true when the host, and path match the pattern. A pattern without a path matches every path.
+func (p *hostPathPattern) match(host, path string) bool {
+
+	host = strings.ToLower(host)
+	if !p.matchPort {
+		host, _ = splitHostPort(host)
+	}
+	if !p.host.MatchString(host) {
+		return false
+	}
+
+	return p.path == nil || p.path.MatchString(path)
+}
+
+// globRegexp compiles a glob, where * matches any characters, and ? matches one, to an anchored regex.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+
+	return regexp.Compile("^" + expr + "$")
+}
+
+// splitHostPort returns the host, and port of an address, or the address unchanged when it has no port.
+func splitHostPort(addr string) (string, string) {
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+
+	return host, port
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRoute_Match(t *testing.T) {
+
+	t.Parallel()
+
+	for _, test := range []struct {
+		pattern string
+		target  string
+		match   bool
+	}{
+		{"api.example.com/v2/*", "http://api.example.com/v2/users", true},
+		{"api.example.com/v2/*", "https://API.example.com:8443/v2/", true},
+		{"api.example.com/v2/*", "http://api.example.com/v1/users", false},
+		{"api.example.com/v2/*", "http://www.example.com/v2/users", false},
+		{"*.example.com", "http://www.example.com/any/path", true},
+		{"*.example.com", "http://example.com/", false},
+		{"api.example.com:8080/*", "http://api.example.com:8080/", true},
+		{"api.example.com:8080/*", "http://api.example.com/", false},
+		{"cdn?.example.com/*.js", "http://cdn1.example.com/static/app.js", true},
+		{"cdn?.example.com/*.js", "http://cdn1.example.com/static/app.css", false},
+	} {
+		route := &Route{Pattern: test.pattern, Upstream: "http://localhost:8081"}
+		if err := route.compile(http.DefaultTransport, UpstreamProtocolAuto); err != nil {
+			t.Fatalf("expected no error, received %s", err.Error())
+		}
+
+		req := httptest.NewRequest(http.MethodGet, test.target, nil)
+		if match := route.Match(req); match != test.match {
+			t.Fatalf("expected %s match %s %t, but received %t", test.pattern, test.target, test.match, match)
+		}
+	}
+}
+
+func TestRoute_compile(t *testing.T) {
+
+	t.Parallel()
+
+	for _, route := range []*Route{
+		{Pattern: "/v2/*", Upstream: "http://localhost:8081"},
+		{Pattern: "api.example.com", Upstream: "ftp://localhost:8081"},
+		{Pattern: "api.example.com", Upstream: "localhost:8081"},
+		{Pattern: "api.example.com", Upstream: "http://"},
+	} {
+		err := route.compile(http.DefaultTransport, UpstreamProtocolAuto)
+		if err == nil || !ERRRouteInvalid.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s for %s, but received %v", ERRRouteInvalid, route.Upstream, err)
+		}
+	}
+
+	route := &Route{Pattern: "api.example.com", Upstream: "https://localhost:8443", SNI: "api.example.com"}
+	err := route.compile(&testRoundTripper{}, UpstreamProtocolAuto)
+	if err == nil || !ERRRouteInvalid.Err().Match(err.(*ProxyError)) {
+		t.Fatalf("expected error %s for a custom transport, but received %v", ERRRouteInvalid, err)
+	}
+}
+
+func TestReverseProxy_ServeHTTP_routes(t *testing.T) {
+
+	t.Parallel()
+
+	var defaultRequests int32
+	defaultUpstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&defaultRequests, 1)
+		_, _ = writer.Write([]byte("default"))
+	}))
+	defer defaultUpstream.Close()
+
+	plainUpstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("plain " + request.Host + " " + request.URL.Path))
+	}))
+	defer plainUpstream.Close()
+
+	serverNames := make(chan string, 1)
+	tlsUpstream := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("tls " + request.Host + " " + request.URL.Path))
+	}))
+	tlsUpstream.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverNames <- hello.ServerName
+		return nil, nil
+	}}
+	tlsUpstream.StartTLS()
+	defer tlsUpstream.Close()
+
+	p := &ReverseProxy{
+		Routes: []*Route{
+			{Pattern: "api.example.com/v2/*", Upstream: plainUpstream.URL},
+			{
+				Pattern:            "secure.example.com/*",
+				Upstream:           tlsUpstream.URL,
+				Host:               "staging.example.com",
+				SNI:                "sni.example.com",
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	if err := p.LoadRoutes(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	for _, test := range []struct {
+		name       string
+		host       string
+		path       string
+		expected   string
+		serverName string
+	}{
+		{"plain", "api.example.com", "/v2/users", "plain api.example.com /v2/users", ""},
+		{"tls_host_sni", "secure.example.com", "/login", "tls staging.example.com /login", "sni.example.com"},
+		{"unmatched", defaultUpstream.Listener.Addr().String(), "/v1/users", "default", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.Host = test.host
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s, expected status code %d, but received %d", test.name, http.StatusOK, recorder.Code)
+		}
+		if recorder.Body.String() != test.expected {
+			t.Fatalf("%s, expected response %s, but received %s", test.name, test.expected, recorder.Body.String())
+		}
+		if req.URL.Host != test.host {
+			t.Fatalf("%s, expected logged url host %s, but received %s", test.name, test.host, req.URL.Host)
+		}
+		if test.serverName != "" {
+			if serverName := <-serverNames; serverName != test.serverName {
+				t.Fatalf("%s, expected sni %s, but received %s", test.name, test.serverName, serverName)
+			}
+		}
+	}
+
+	if atomic.LoadInt32(&defaultRequests) != 1 {
+		t.Fatalf("expected 1 unrouted request, but received %d", defaultRequests)
+	}
+}
+
+// testRoundTripper is a transport other than *http.Transport, which fails every request.
+type testRoundTripper struct{}
+
+func (t *testRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+
+	return nil, http.ErrNotSupported
+}
@@ -0,0 +1,394 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// Error shaping rule configuration is invalid
+const ERRShapingRuleInvalid = ErrorStr("invalid shaping rule")
+
+// shapingMinBurst is the smallest number of bytes passed to a rate limited connection at once
+const shapingMinBurst = 1024
+
+// NetworkPresets are the named network profiles, selected with NetworkProfile.Preset
+var NetworkPresets = map[string]NetworkProfile{
+	"3g":        {DownloadKbps: 1600, UploadKbps: 768, LatencyMS: 300, StallProbability: 0.01, StallMS: 500},
+	"slow_4g":   {DownloadKbps: 4000, UploadKbps: 1500, LatencyMS: 150, StallProbability: 0.005, StallMS: 250},
+	"satellite": {DownloadKbps: 5000, UploadKbps: 1000, LatencyMS: 600, StallProbability: 0.02, StallMS: 1000},
+}
+
+// NetworkProfile describes emulated network conditions. Download is traffic towards the client, and upload is traffic
+// towards the upstream.
+type NetworkProfile struct {
+	Preset string `json:"preset"` // Name of a NetworkPresets profile, other fields set override the preset
+
+	DownloadKbps int `json:"download_kbps"` // Throughput cap towards the client, zero is unlimited
+	UploadKbps   int `json:"upload_kbps"`   // Throughput cap towards the upstream, zero is unlimited
+
+	// LatencyMS is the added round trip time. Half is added each time a connection turns from sending to receiving,
+	// or receiving to sending, once per request, and response exchange. Dialed upstream connections also wait
+	// LatencyMS to connect.
+	LatencyMS int `json:"latency_ms"`
+
+	// StallProbability is the chance from 0 to 1 each read, and write on a connection pauses for StallMS,
+	// emulating packet loss, and retransmits.
+	StallProbability float64 `json:"stall_probability"`
+	StallMS          int     `json:"stall_ms"`
+}
+
+// resolve returns the profile with unset fields filled from the preset.
+func (n NetworkProfile) resolve() (NetworkProfile, error) {
+
+	if n.Preset == "" {
+		return n, nil
+	}
+
+	preset, ok := NetworkPresets[n.Preset]
+	if !ok {
+		return n, ERRShapingRuleInvalid.Err().WithReason("unknown preset %s", n.Preset)
+	}
+	preset.Preset = n.Preset
+
+	if n.DownloadKbps != 0 {
+		preset.DownloadKbps = n.DownloadKbps
+	}
+	if n.UploadKbps != 0 {
+		preset.UploadKbps = n.UploadKbps
+	}
+	if n.LatencyMS != 0 {
+		preset.LatencyMS = n.LatencyMS
+	}
+	if n.StallProbability != 0 {
+		preset.StallProbability = n.StallProbability
+	}
+	if n.StallMS != 0 {
+		preset.StallMS = n.StallMS
+	}
+
+	return preset, nil
+}
+
+// ShapingRule applies a network profile to connections accepted from a Client ip, or cidr, or to upstream connections
+// dialed to a Host. Host is a glob, matched without the port, unless the pattern includes one. When the proxy chains
+// through an upstream proxy, Host is matched against the dialed proxy address.
+type ShapingRule struct {
+	Client string `json:"client"`
+	Host   string `json:"host"`
+	NetworkProfile
+
+	client  *net.IPNet
+	host    *hostPathPattern
+	profile NetworkProfile
+}
+
+// compile validates the rule, and resolves the profile preset.
+func (r *ShapingRule) compile() (err error) {
+
+	if (r.Client == "") == (r.Host == "") {
+		return ERRShapingRuleInvalid.Err().WithReason("one of client, or host is required")
+	}
+
+	r.client, r.host = nil, nil
+	if r.Client != "" {
+		if r.client, err = parseCIDR(r.Client); err != nil {
+			return ERRShapingRuleInvalid.Err().WithReason("client %q, %s", r.Client, err.Error())
+		}
+	} else if strings.Contains(r.Host, "/") {
+		return ERRShapingRuleInvalid.Err().WithReason("host %q, must not contain a path", r.Host)
+	} else if r.host, err = compileHostPathPattern(r.Host); err != nil {
+		return ERRShapingRuleInvalid.Err().WithReason("host %q, %s", r.Host, err.Error())
+	}
+
+	if r.profile, err = r.NetworkProfile.resolve(); err != nil {
+		return err
+	}
+
+	p := r.profile
+	if p.DownloadKbps < 0 || p.UploadKbps < 0 || p.LatencyMS < 0 || p.StallMS < 0 || p.StallProbability < 0 || p.StallProbability > 1 {
+		return ERRShapingRuleInvalid.Err().WithReason("%s, values must be positive, and stall probability from 0 to 1", r.String())
+	}
+
+	return nil
+}
+
+// String returns the client, or host of the rule, and the preset name.
+func (r *ShapingRule) String() string {
+
+	name := r.Client + r.Host
+	if r.Preset != "" {
+		name += " " + r.Preset
+	}
+
+	return name
+}
+
+// parseCIDR parses a cidr, or a single ip as a /32, or /128 network.
+func parseCIDR(s string) (*net.IPNet, error) {
+
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: s}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// compileShapingRules returns compiled copies of the rules, leaving the rules unchanged. The compiled rules are
+// shared by every listener, and the transport, and are never modified after.
+func compileShapingRules(rules []*ShapingRule) ([]*ShapingRule, error) {
+
+	compiled := make([]*ShapingRule, 0, len(rules))
+	for _, rule := range rules {
+		rule := *rule
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, &rule)
+	}
+
+	return compiled, nil
+}
+
+// shapeListener wraps the listener, shaping accepted connections from clients matching a compiled rule. The listener
+// is returned unchanged when no rule has a client.
+func shapeListener(listener net.Listener, rules []*ShapingRule) net.Listener {
+
+	for _, rule := range rules {
+		if rule.client != nil {
+			return &shapedListener{Listener: listener, rules: rules}
+		}
+	}
+
+	return listener
+}
+
+// shapedListener shapes accepted connections from clients matching a rule
+type shapedListener struct {
+	net.Listener
+	rules []*ShapingRule
+}
+
+func (l *shapedListener) Accept() (net.Conn, error) {
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return conn, nil
+	}
+
+	for _, rule := range l.rules {
+		if rule.client != nil && rule.client.Contains(addr.IP) {
+			log.WithField("client", addr.IP.String()).WithField("shaping", rule.String()).Debug("shaping connection")
+			return newShapedConn(conn, rule.profile, rule.profile.UploadKbps, rule.profile.DownloadKbps), nil
+		}
+	}
+
+	return conn, nil
+}
+
+// shapeTransport returns a clone of the transport, shaping connections dialed to hosts matching a compiled rule. The
+// transport is returned unchanged when no rule has a host.
+func shapeTransport(transport *http.Transport, rules []*ShapingRule) *http.Transport {
+
+	var hosts bool
+	for _, rule := range rules {
+		hosts = hosts || rule.host != nil
+	}
+	if !hosts {
+		return transport
+	}
+
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	transport = transport.Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+
+		var rule *ShapingRule
+		for _, r := range rules {
+			if r.host != nil && r.host.match(addr, "") {
+				rule = r
+				break
+			}
+		}
+		if rule == nil {
+			return dial(ctx, network, addr)
+		}
+
+		log.WithField("upstream", addr).WithField("shaping", rule.String()).Debug("shaping connection")
+		if err := sleepContext(ctx, time.Duration(rule.profile.LatencyMS)*time.Millisecond); err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// The connect wait covers the round trip before the first request, so the first write is not delayed
+		shaped := newShapedConn(conn, rule.profile, rule.profile.DownloadKbps, rule.profile.UploadKbps)
+		shaped.sending = 1
+
+		return shaped, nil
+	}
+
+	return transport
+}
+
+// shapedConn applies throughput caps, latency, and stalls to a connection.
+type shapedConn struct {
+	net.Conn
+	profile NetworkProfile
+	read    *rateLimiter
+	write   *rateLimiter
+
+	// sending is 1 after a write, and 0 after a read, to find when the connection changes direction
+	sending int32
+}
+
+// newShapedConn wraps the connection, with reads capped at readKbps, and writes capped at writeKbps.
+func newShapedConn(conn net.Conn, profile NetworkProfile, readKbps, writeKbps int) *shapedConn {
+
+	return &shapedConn{
+		Conn:    conn,
+		profile: profile,
+		read:    newRateLimiter(readKbps),
+		write:   newRateLimiter(writeKbps),
+	}
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+
+	if c.read != nil && len(p) > c.read.burst {
+		p = p[:c.read.burst]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		time.Sleep(c.delay(0, c.read, n))
+	}
+
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if c.write != nil && len(chunk) > c.write.burst {
+			chunk = chunk[:c.write.burst]
+		}
+		time.Sleep(c.delay(1, c.write, len(chunk)))
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// delay returns how long to wait before passing on n bytes, adding half the latency when the connection changes
+// direction, a stall when the stall probability hits, and the time to send n bytes at the throughput cap.
+func (c *shapedConn) delay(sending int32, limiter *rateLimiter, n int) time.Duration {
+
+	var wait time.Duration
+	if atomic.SwapInt32(&c.sending, sending) != sending {
+		wait += time.Duration(c.profile.LatencyMS) * time.Millisecond / 2
+	}
+	if c.profile.StallProbability > 0 && rand.Float64() < c.profile.StallProbability {
+		wait += time.Duration(c.profile.StallMS) * time.Millisecond
+	}
+	if limiter != nil {
+		wait += limiter.reserve(n)
+	}
+
+	return wait
+}
+
+// rateLimiter spaces bytes at a fixed rate.
+type rateLimiter struct {
+	lock           sync.Mutex
+	bytesPerSecond float64
+	burst          int
+	next           time.Time
+}
+
+// newRateLimiter returns a limiter for the rate, or nil when the rate is unlimited.
+func newRateLimiter(kbps int) *rateLimiter {
+
+	if kbps <= 0 {
+		return nil
+	}
+
+	bytesPerSecond := float64(kbps) * 1000 / 8
+	burst := int(bytesPerSecond / 20)
+	if burst < shapingMinBurst {
+		burst = shapingMinBurst
+	}
+
+	return &rateLimiter{bytesPerSecond: bytesPerSecond, burst: burst}
+}
+
+// reserve returns how long until n bytes may be sent, after the bytes reserved before them.
+func (r *rateLimiter) reserve(n int) time.Duration {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	r.next = r.next.Add(time.Duration(float64(n) / r.bytesPerSecond * float64(time.Second)))
+
+	return r.next.Sub(now)
+}
+
+// sleepContext waits for the duration, or returns the context error if it is canceled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShapingRule_compile(t *testing.T) {
+
+	t.Parallel()
+
+	rule := &ShapingRule{Client: "10.0.0.1", NetworkProfile: NetworkProfile{Preset: "3g", LatencyMS: 50}}
+	if err := rule.compile(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if rule.profile.LatencyMS != 50 || rule.profile.DownloadKbps != NetworkPresets["3g"].DownloadKbps {
+		t.Fatalf("expected 3g preset with 50ms latency, but received %+v", rule.profile)
+	}
+	if !rule.client.Contains(net.ParseIP("10.0.0.1")) || rule.client.Contains(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("expected client to match only 10.0.0.1, but received %s", rule.client)
+	}
+
+	for _, invalid := range []*ShapingRule{
+		{NetworkProfile: NetworkProfile{Preset: "3g"}},
+		{Client: "10.0.0.0/8", Host: "example.com"},
+		{Client: "10.0.0"},
+		{Host: "example.com/path"},
+		{Host: "example.com", NetworkProfile: NetworkProfile{Preset: "5g"}},
+		{Host: "example.com", NetworkProfile: NetworkProfile{StallProbability: 2}},
+	} {
+		err := invalid.compile()
+		if err == nil || !ERRShapingRuleInvalid.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s for %+v, but received %v", ERRShapingRuleInvalid, invalid, err)
+		}
+	}
+}
+
+func TestCompileShapingRules(t *testing.T) {
+
+	t.Parallel()
+
+	rules := []*ShapingRule{{Client: "10.0.0.1"}, {Host: "example.com", NetworkProfile: NetworkProfile{Preset: "3g"}}}
+	compiled, err := compileShapingRules(rules)
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	// Listeners already running read the compiled rules, so compiling again must not modify them
+	if rules[0].client != nil || rules[1].host != nil {
+		t.Fatalf("expected the configured rules unchanged")
+	}
+	if len(compiled) != 2 || compiled[0].client == nil || compiled[1].host == nil || compiled[1].profile.Preset != "3g" {
+		t.Fatalf("expected 2 compiled rules, but received %+v", compiled)
+	}
+
+	if _, err := compileShapingRules([]*ShapingRule{{Client: "10.0.0"}}); err == nil {
+		t.Fatalf("expected an error for an invalid rule")
+	}
+}
+
+// testShapingRules returns the compiled rules, failing the test on error.
+func testShapingRules(t *testing.T, rules ...*ShapingRule) []*ShapingRule {
+
+	compiled, err := compileShapingRules(rules)
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	return compiled
+}
+
+func TestRateLimiter_reserve(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := newRateLimiter(80)
+	if limiter.burst != shapingMinBurst {
+		t.Fatalf("expected burst %d, but received %d", shapingMinBurst, limiter.burst)
+	}
+
+	var wait time.Duration
+	for i := 0; i < 4; i++ {
+		wait = limiter.reserve(2500)
+	}
+	if wait < 900*time.Millisecond || wait > time.Second {
+		t.Fatalf("expected 10KB at 80kbps to wait 1s, but received %s", wait)
+	}
+
+	if newRateLimiter(0) != nil {
+		t.Fatalf("expected no limiter when unlimited")
+	}
+}
+
+func TestShapeListener(t *testing.T) {
+
+	t.Parallel()
+
+	body := strings.Repeat("x", 5000)
+	for _, test := range []struct {
+		name    string
+		rule    *ShapingRule
+		minTime time.Duration
+		maxTime time.Duration
+	}{
+		{"throughput", &ShapingRule{Client: "127.0.0.0/8", NetworkProfile: NetworkProfile{DownloadKbps: 80}}, 400 * time.Millisecond, 2 * time.Second},
+		{"latency", &ShapingRule{Client: "127.0.0.1", NetworkProfile: NetworkProfile{LatencyMS: 200}}, 100 * time.Millisecond, 2 * time.Second},
+		{"unmatched", &ShapingRule{Client: "10.0.0.0/8", NetworkProfile: NetworkProfile{Preset: "satellite"}}, 0, 300 * time.Millisecond},
+	} {
+		test := test
+		t.Run(test.name, func(subTest *testing.T) {
+
+			subTest.Parallel()
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				_, _ = writer.Write([]byte(body))
+			}))
+			server.Listener = shapeListener(server.Listener, testShapingRules(subTest, test.rule))
+			server.Start()
+			defer server.Close()
+
+			start := time.Now()
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				subTest.Fatalf("expected no error, received %s", err.Error())
+			}
+			received, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			elapsed := time.Since(start)
+
+			if string(received) != body {
+				subTest.Fatalf("expected %d bytes, but received %d", len(body), len(received))
+			}
+			if elapsed < test.minTime || elapsed > test.maxTime {
+				subTest.Fatalf("expected response in %s to %s, but received after %s", test.minTime, test.maxTime, elapsed)
+			}
+		})
+	}
+}
+
+func TestShapeTransport(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("okay"))
+	}))
+	defer upstream.Close()
+
+	unchanged := http.DefaultTransport.(*http.Transport)
+	if transport := shapeTransport(unchanged, testShapingRules(t, &ShapingRule{Client: "10.0.0.1"})); transport != unchanged {
+		t.Fatalf("expected the transport unchanged without host rules")
+	}
+
+	transport := shapeTransport(unchanged, testShapingRules(t,
+		&ShapingRule{Host: "example.com", NetworkProfile: NetworkProfile{LatencyMS: 5000}},
+		&ShapingRule{Host: "127.0.0.?", NetworkProfile: NetworkProfile{LatencyMS: 200}},
+	))
+
+	p := &ReverseProxy{Transport: transport}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = upstream.Listener.Addr().String()
+
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+	elapsed := time.Since(start)
+
+	if recorder.Body.String() != "okay" {
+		t.Fatalf("expected response okay, but received %s", recorder.Body.String())
+	}
+	if elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("expected a 200ms connect, and 100ms turnaround, but received after %s", elapsed)
+	}
+}
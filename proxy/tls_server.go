@@ -7,7 +7,6 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
-	"fmt"
 	"io"
 	standardLogger "log"
 	"net"
@@ -25,7 +24,10 @@ type TLSServer struct {
 
 	ListenAddr string // TCP address for the server to listen on
 	Port       int    // TCP Port of the server to listen on
-	Certs      *Certs // Certificate cache
+
+	Shaping   []*ShapingRule // Compiled network profiles applied to connections from matching clients, read only
+	ClientACL *ClientACL     // Clients allowed to connect, every client when nil
+	Certs     *Certs         // Certificate cache
 }
 
 // ListenAndServe creates the server process, and blocks until an error occurs. A ready channel is used to signal
@@ -64,19 +66,15 @@ func (p *TLSServer) ListenAndServe(ready chan bool, handler http.Handler) error
 		return err
 	}
 
-	listenAddress := fmt.Sprintf("%s:", p.ListenAddr)
-	if p.Port > 0 {
-		listenAddress = fmt.Sprintf("%s:%d", p.ListenAddr, p.Port)
-	}
-	connection, err := net.Listen("tcp", listenAddress)
+	connection, err := net.Listen("tcp", listenAddress(p.ListenAddr, p.Port))
 	if err != nil {
 		return err
 	}
-	tlsListener := tls.NewListener(connection, p.tlsConfig)
+	listener := shapeListener(p.ClientACL.listener(connection), p.Shaping)
+	tlsListener := tls.NewListener(listener, p.tlsConfig)
 
 	p.Port = connection.Addr().(*net.TCPAddr).Port
-	ip := connection.Addr().(*net.TCPAddr).IP
-	log.WithField("addr", fmt.Sprintf("%s:%d", ip, p.Port)).
+	log.WithField("addr", connection.Addr().String()).
 		Info("https server started")
 
 	ready <- true
@@ -0,0 +1,324 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// Error every upstream of a route is unhealthy, or ejected
+const ERRUpstreamUnavailable = ErrorStr("no upstream available")
+
+// DefaultUpstreamHealthCheckInterval is how often route upstreams are checked, if HealthCheck.Interval is left unset
+const DefaultUpstreamHealthCheckInterval = 10 * time.Second
+
+// DefaultUpstreamHealthCheckTimeout is how long an upstream is given to answer a health check, if HealthCheck.Timeout
+// is left unset
+const DefaultUpstreamHealthCheckTimeout = 5 * time.Second
+
+// DefaultUpstreamEjectTime is how long an upstream is removed after MaxFails round trip errors, if EjectTime is left
+// unset
+const DefaultUpstreamEjectTime = 30 * time.Second
+
+// upstreamHashReplicas is the number of points each upstream has on the consistent hash ring
+const upstreamHashReplicas = 100
+
+// BalanceMode selects how a route picks one of its upstreams
+type BalanceMode string
+
+const (
+	// BalanceRoundRobin uses each available upstream in turn
+	BalanceRoundRobin BalanceMode = ""
+
+	// BalanceLeastConnections uses the available upstream with the fewest requests in flight
+	BalanceLeastConnections BalanceMode = "least_connections"
+
+	// BalanceConsistentHash uses the same upstream for a client ip, or the HashHeader value, while it is available
+	BalanceConsistentHash BalanceMode = "consistent_hash"
+)
+
+// Validate returns an error if the mode is not one of the BalanceMode values.
+func (b BalanceMode) Validate() error {
+
+	switch b {
+	case BalanceRoundRobin, BalanceLeastConnections, BalanceConsistentHash:
+		return nil
+	}
+
+	return ERRRouteInvalid.Err().WithReason("unknown balance mode %s", b)
+}
+
+// HealthCheck actively probes route upstreams, removing upstreams from rotation until they pass again.
+type HealthCheck struct {
+	Path     string `json:"path"`     // Request path, / if empty
+	Interval int    `json:"interval"` // Seconds between checks
+	Timeout  int    `json:"timeout"`  // Seconds before a check fails
+	Status   int    `json:"status"`   // Expected status code, any 2xx, or 3xx if zero
+}
+
+// upstreamBackend is an upstream of a route, and its health state.
+type upstreamBackend struct {
+	url    *url.URL
+	active int64
+
+	lock         sync.Mutex
+	healthy      bool
+	fails        int
+	ejectedUntil time.Time
+}
+
+// available returns true when the upstream passed its last health check, and is not ejected.
+func (b *upstreamBackend) available(now time.Time) bool {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+// setHealthy updates the health state, logging the transition.
+func (b *upstreamBackend) setHealthy(healthy bool, err error) {
+
+	b.lock.Lock()
+	changed := b.healthy != healthy
+	b.healthy = healthy
+	b.lock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if healthy {
+		log.WithField("upstream", b.url.Host).Info("upstream healthy")
+	} else {
+		log.WithField("upstream", b.url.Host).WithError(err).Warning("upstream unhealthy")
+	}
+}
+
+// upstreamPool selects an upstream for each request, and tracks round trip errors for passive ejection.
+type upstreamPool struct {
+	backends   []*upstreamBackend
+	balance    BalanceMode
+	hashHeader string
+	maxFails   int
+	ejectTime  time.Duration
+	next       uint64
+	ring       []upstreamHashPoint
+}
+
+// upstreamHashPoint is a point on the consistent hash ring
+type upstreamHashPoint struct {
+	hash    uint32
+	backend *upstreamBackend
+}
+
+// newUpstreamPool creates a pool for the upstream urls, with every upstream initially healthy.
+func newUpstreamPool(upstreams []*url.URL, balance BalanceMode, hashHeader string, maxFails int, ejectTime time.Duration) *upstreamPool {
+
+	pool := &upstreamPool{
+		balance:    balance,
+		hashHeader: hashHeader,
+		maxFails:   maxFails,
+		ejectTime:  ejectTime,
+	}
+	if pool.ejectTime <= 0 {
+		pool.ejectTime = DefaultUpstreamEjectTime
+	}
+
+	for _, upstream := range upstreams {
+		backend := &upstreamBackend{url: upstream, healthy: true}
+		pool.backends = append(pool.backends, backend)
+
+		for i := 0; i < upstreamHashReplicas; i++ {
+			pool.ring = append(pool.ring, upstreamHashPoint{
+				hash:    hashString(upstream.Host + "#" + strconv.Itoa(i)),
+				backend: backend,
+			})
+		}
+	}
+	sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+
+	return pool
+}
+
+// pick returns an available upstream for the request, following the balance mode, and counts it as active until
+// release is called.
+func (p *upstreamPool) pick(req *http.Request) (*upstreamBackend, error) {
+
+	now := time.Now()
+
+	var backend *upstreamBackend
+	switch p.balance {
+	case BalanceLeastConnections:
+		for _, b := range p.backends {
+			if b.available(now) && (backend == nil || atomic.LoadInt64(&b.active) < atomic.LoadInt64(&backend.active)) {
+				backend = b
+			}
+		}
+	case BalanceConsistentHash:
+		hash := hashString(p.hashKey(req))
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+		for i := 0; i < len(p.ring); i++ {
+			if b := p.ring[(start+i)%len(p.ring)].backend; b.available(now) {
+				backend = b
+				break
+			}
+		}
+	default:
+		next := atomic.AddUint64(&p.next, 1) - 1
+		for i := 0; i < len(p.backends); i++ {
+			if b := p.backends[(next+uint64(i))%uint64(len(p.backends))]; b.available(now) {
+				backend = b
+				break
+			}
+		}
+	}
+
+	if backend == nil {
+		return nil, ERRUpstreamUnavailable.Err().WithReason("%d upstreams unhealthy, or ejected", len(p.backends))
+	}
+	atomic.AddInt64(&backend.active, 1)
+
+	return backend, nil
+}
+
+// hashKey returns the HashHeader value, or the client ip when the header is not set.
+func (p *upstreamPool) hashKey(req *http.Request) string {
+
+	if p.hashHeader != "" {
+		if value := req.Header.Get(p.hashHeader); value != "" {
+			return value
+		}
+	}
+
+	host, _ := splitHostPort(req.RemoteAddr)
+
+	return host
+}
+
+// release marks a request to the upstream complete.
+func (p *upstreamPool) release(backend *upstreamBackend) {
+
+	atomic.AddInt64(&backend.active, -1)
+}
+
+// report records the result of a round trip, ejecting the upstream for ejectTime after maxFails consecutive errors.
+func (p *upstreamPool) report(backend *upstreamBackend, err error) {
+
+	if p.maxFails <= 0 {
+		return
+	}
+
+	backend.lock.Lock()
+	if err == nil {
+		backend.fails = 0
+		backend.lock.Unlock()
+		return
+	}
+	backend.fails++
+	eject := backend.fails >= p.maxFails
+	if eject {
+		backend.fails = 0
+		backend.ejectedUntil = time.Now().Add(p.ejectTime)
+	}
+	backend.lock.Unlock()
+
+	if eject {
+		log.WithField("upstream", backend.url.Host).
+			WithField("eject_time", p.ejectTime.String()).
+			WithError(err).
+			Warning("upstream ejected")
+	}
+}
+
+// healthCheck probes every upstream each interval until the context is canceled.
+func (p *upstreamPool) healthCheck(ctx context.Context, check *HealthCheck, client *http.Client, host string) {
+
+	interval := DefaultUpstreamHealthCheckInterval
+	if check.Interval > 0 {
+		interval = time.Duration(check.Interval) * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, backend := range p.backends {
+				backend.setHealthy(p.check(ctx, check, client, host, backend))
+			}
+		}
+	}
+}
+
+// check requests the health check path from the upstream, returning true if it answered with the expected status.
+func (p *upstreamPool) check(ctx context.Context, check *HealthCheck, client *http.Client, host string, backend *upstreamBackend) (bool, error) {
+
+	timeout := DefaultUpstreamHealthCheckTimeout
+	if check.Timeout > 0 {
+		timeout = time.Duration(check.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	checkURL := *backend.url
+	checkURL.Path = check.Path
+	if checkURL.Path == "" {
+		checkURL.Path = "/"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	if host != "" {
+		req.Host = host
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+
+	if (check.Status == 0 && resp.StatusCode >= 200 && resp.StatusCode < 400) || resp.StatusCode == check.Status {
+		return true, nil
+	}
+
+	return false, ERRUpstreamUnavailable.Err().WithReason("health check status code %d", resp.StatusCode)
+}
+
+// hashString returns the fnv-1a hash of the string.
+func hashString(s string) uint32 {
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+
+	return h.Sum32()
+}
+
+// healthCheckClient returns a client for health checks, using the route transport, and not following redirects.
+func healthCheckClient(transport http.RoundTripper) *http.Client {
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPool_pick(t *testing.T) {
+
+	t.Parallel()
+
+	upstreams := testUpstreamURLs("http://a:80", "http://b:80", "http://c:80")
+
+	t.Run("round_robin", func(subTest *testing.T) {
+
+		pool := newUpstreamPool(upstreams, BalanceRoundRobin, "", 0, 0)
+		pool.backends[1].setHealthy(false, nil)
+
+		var picked []string
+		for i := 0; i < 4; i++ {
+			backend, err := pool.pick(httptest.NewRequest(http.MethodGet, "/", nil))
+			if err != nil {
+				subTest.Fatalf("expected no error, received %s", err.Error())
+			}
+			pool.release(backend)
+			picked = append(picked, backend.url.Host)
+		}
+
+		expected := []string{"a:80", "c:80", "c:80", "a:80"}
+		for i := range expected {
+			if picked[i] != expected[i] {
+				subTest.Fatalf("expected upstreams %v, but received %v", expected, picked)
+			}
+		}
+	})
+
+	t.Run("least_connections", func(subTest *testing.T) {
+
+		pool := newUpstreamPool(upstreams, BalanceLeastConnections, "", 0, 0)
+
+		first, _ := pool.pick(httptest.NewRequest(http.MethodGet, "/", nil))
+		second, _ := pool.pick(httptest.NewRequest(http.MethodGet, "/", nil))
+		third, _ := pool.pick(httptest.NewRequest(http.MethodGet, "/", nil))
+		if first == second || second == third || first == third {
+			subTest.Fatalf("expected each request on a different upstream")
+		}
+
+		pool.release(second)
+		backend, _ := pool.pick(httptest.NewRequest(http.MethodGet, "/", nil))
+		if backend != second {
+			subTest.Fatalf("expected upstream %s, but received %s", second.url.Host, backend.url.Host)
+		}
+	})
+
+	t.Run("consistent_hash", func(subTest *testing.T) {
+
+		pool := newUpstreamPool(upstreams, BalanceConsistentHash, "X-Session", 0, 0)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Session", "user-1")
+		backend, _ := pool.pick(req)
+		for i := 0; i < 10; i++ {
+			if again, _ := pool.pick(req); again != backend {
+				subTest.Fatalf("expected upstream %s, but received %s", backend.url.Host, again.url.Host)
+			}
+		}
+
+		backend.setHealthy(false, nil)
+		failover, _ := pool.pick(req)
+		if failover == nil || failover == backend {
+			subTest.Fatalf("expected a different upstream when %s is unhealthy", backend.url.Host)
+		}
+	})
+
+	t.Run("unavailable", func(subTest *testing.T) {
+
+		pool := newUpstreamPool(upstreams, BalanceRoundRobin, "", 0, 0)
+		for _, backend := range pool.backends {
+			backend.setHealthy(false, nil)
+		}
+
+		_, err := pool.pick(httptest.NewRequest(http.MethodGet, "/", nil))
+		if err == nil || !ERRUpstreamUnavailable.Err().Match(err.(*ProxyError)) {
+			subTest.Fatalf("expected error %s, but received %v", ERRUpstreamUnavailable, err)
+		}
+	})
+}
+
+func TestUpstreamPool_report(t *testing.T) {
+
+	t.Parallel()
+
+	pool := newUpstreamPool(testUpstreamURLs("http://a:80"), BalanceRoundRobin, "", 2, time.Hour)
+	backend := pool.backends[0]
+	roundTripErr := errors.New("connection refused")
+
+	pool.report(backend, roundTripErr)
+	pool.report(backend, nil)
+	pool.report(backend, roundTripErr)
+	if !backend.available(time.Now()) {
+		t.Fatalf("expected upstream available after non consecutive errors")
+	}
+
+	pool.report(backend, roundTripErr)
+	if backend.available(time.Now()) {
+		t.Fatalf("expected upstream ejected after 2 consecutive errors")
+	}
+	if !backend.available(time.Now().Add(2 * time.Hour)) {
+		t.Fatalf("expected upstream available after the eject time")
+	}
+}
+
+func TestUpstreamPool_check(t *testing.T) {
+
+	t.Parallel()
+
+	healthy := true
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/healthz" || request.Host != "app.example.com" || !healthy {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	pool := newUpstreamPool(testUpstreamURLs(upstream.URL), BalanceRoundRobin, "", 0, 0)
+	client := healthCheckClient(http.DefaultTransport)
+
+	for _, test := range []struct {
+		name    string
+		check   *HealthCheck
+		healthy bool
+		passed  bool
+	}{
+		{"any_success", &HealthCheck{Path: "/healthz"}, true, true},
+		{"expected_status", &HealthCheck{Path: "/healthz", Status: http.StatusNoContent}, true, true},
+		{"unexpected_status", &HealthCheck{Path: "/healthz", Status: http.StatusOK}, true, false},
+		{"unhealthy", &HealthCheck{Path: "/healthz"}, false, false},
+	} {
+		healthy = test.healthy
+		passed, err := pool.check(context.Background(), test.check, client, "app.example.com", pool.backends[0])
+		if passed != test.passed {
+			t.Fatalf("%s, expected health check passed %t, but received %t, %v", test.name, test.passed, passed, err)
+		}
+	}
+}
+
+func TestReverseProxy_ServeHTTP_upstreamPool(t *testing.T) {
+
+	t.Parallel()
+
+	live := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("live"))
+	}))
+	defer live.Close()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+
+	p := &ReverseProxy{
+		Routes: []*Route{{Pattern: "lb.example.com", Upstreams: []string{deadURL, live.URL}, MaxFails: 1}},
+	}
+	if err := p.LoadRoutes(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	var codes []int
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "lb.example.com"
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+		codes = append(codes, recorder.Code)
+	}
+
+	expected := []int{http.StatusInternalServerError, http.StatusOK, http.StatusOK, http.StatusOK}
+	for i := range expected {
+		if codes[i] != expected[i] {
+			t.Fatalf("expected status codes %v, but received %v", expected, codes)
+		}
+	}
+
+	for _, backend := range p.Routes[0].pool.backends {
+		backend.setHealthy(false, nil)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "lb.example.com"
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %d, but received %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+}
+
+// testUpstreamURLs parses the upstream urls.
+func testUpstreamURLs(upstreams ...string) []*url.URL {
+
+	var urls []*url.URL
+	for _, upstream := range upstreams {
+		u, _ := url.Parse(upstream)
+		urls = append(urls, u)
+	}
+
+	return urls
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// Error upstream protocol is not one of the UpstreamProtocol values
+const ERRUpstreamProtocol = ErrorStr("invalid upstream protocol")
+
+// UpstreamProtocol selects the http version ReverseProxy uses for upstream requests
+type UpstreamProtocol string
+
+const (
+	// UpstreamProtocolAuto uses the transport unchanged, which negotiates HTTP/2 over tls when offered
+	UpstreamProtocolAuto UpstreamProtocol = ""
+
+	// UpstreamProtocolHTTP1 forces HTTP/1.1 for all upstream requests
+	UpstreamProtocolHTTP1 UpstreamProtocol = "http1"
+
+	// UpstreamProtocolH2 forces HTTP/2 over tls for https requests, failing when the upstream does not negotiate h2.
+	// Plain http requests use HTTP/1.1.
+	UpstreamProtocolH2 UpstreamProtocol = "h2"
+
+	// UpstreamProtocolH2C forces HTTP/2 for all upstream requests, using prior knowledge cleartext HTTP/2 for plain
+	// http requests.
+	UpstreamProtocolH2C UpstreamProtocol = "h2c"
+
+	// UpstreamProtocolMirror uses HTTP/2 upstream when the client request was HTTP/2, or HTTP/3, as
+	// UpstreamProtocolH2C, and HTTP/1.1 otherwise.
+	UpstreamProtocolMirror UpstreamProtocol = "mirror"
+)
+
+// Validate returns an error if the protocol is not one of the UpstreamProtocol values.
+func (u UpstreamProtocol) Validate() error {
+
+	switch u {
+	case UpstreamProtocolAuto, UpstreamProtocolHTTP1, UpstreamProtocolH2, UpstreamProtocolH2C, UpstreamProtocolMirror:
+		return nil
+	}
+
+	return ERRUpstreamProtocol.Err().WithReason("unknown protocol %s", u)
+}
+
+// upstreamTransports are the transports for each forced protocol, derived from a base transport
+type upstreamTransports struct {
+	base     http.RoundTripper
+	protocol UpstreamProtocol
+	http1    http.RoundTripper
+	h2       http.RoundTripper
+	h2c      http.RoundTripper
+}
+
+// newUpstreamTransports derives the forced protocol transports. Protocols are only forced when the base transport is
+// an *http.Transport, other transports are used unchanged. HTTP/2 transports do not support http.Transport.Proxy, so
+// connections are dialed with the DialContext, and through the proxy of the base transport when it has them.
+func newUpstreamTransports(transport http.RoundTripper, protocol UpstreamProtocol) *upstreamTransports {
+
+	transports := &upstreamTransports{base: transport, protocol: protocol}
+
+	base, ok := transport.(*http.Transport)
+	if !ok || protocol == UpstreamProtocolAuto {
+		transports.protocol = UpstreamProtocolAuto
+		return transports
+	}
+
+	tlsConfig := &tls.Config{}
+	if base.TLSClientConfig != nil {
+		tlsConfig = base.TLSClientConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+
+	dial := upstreamProxyDialer(base)
+
+	transports.http1 = http1Transport(base)
+	transports.h2 = &http2.Transport{
+		TLSClientConfig: tlsConfig,
+		DialTLSContext: func(ctx context.Context, _, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := dial(ctx, "https", addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, cfg)
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			if protocol := tlsConn.ConnectionState().NegotiatedProtocol; protocol != http2.NextProtoTLS {
+				_ = conn.Close()
+				return nil, ERRUpstreamProtocol.Err().WithReason("%s negotiated %q, not h2", addr, protocol)
+			}
+			return tlsConn, nil
+		},
+	}
+	transports.h2c = &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, "http", addr)
+		},
+	}
+
+	return transports
+}
+
+// forRequest returns the transport for the upstream request, following the protocol.
+func (t *upstreamTransports) forRequest(req *http.Request) http.RoundTripper {
+
+	protocol := t.protocol
+	if protocol == UpstreamProtocolMirror {
+		protocol = UpstreamProtocolHTTP1
+		if req.ProtoMajor >= 2 {
+			protocol = UpstreamProtocolH2C
+		}
+	}
+
+	switch {
+	case protocol == UpstreamProtocolAuto:
+		return t.base
+	case protocol == UpstreamProtocolH2C:
+		if req.URL.Scheme == "https" {
+			return t.h2
+		}
+		return t.h2c
+	case protocol == UpstreamProtocolH2 && req.URL.Scheme == "https":
+		return t.h2
+	}
+
+	return t.http1
+}
+
+// upstreamTransport returns the transport for the request, following UpstreamProtocol.
+func (p *ReverseProxy) upstreamTransport(req *http.Request) http.RoundTripper {
+
+	p.transportsOnce.Do(func() {
+		transport := p.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		p.transports = newUpstreamTransports(transport, p.UpstreamProtocol)
+	})
+
+	return p.transports.forRequest(req)
+}
+
+// http1Transport returns a clone of the transport that only negotiates HTTP/1.1.
+func http1Transport(t *http.Transport) *http.Transport {
+
+	t = t.Clone()
+	t.ForceAttemptHTTP2 = false
+	t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.NextProtos = []string{"http/1.1"}
+
+	return t
+}
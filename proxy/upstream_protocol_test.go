@@ -0,0 +1,87 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestReverseProxy_ServeHTTP_upstreamProtocol(t *testing.T) {
+
+	t.Parallel()
+
+	protoHandler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(request.Proto))
+	})
+
+	tlsUpstream := httptest.NewUnstartedServer(protoHandler)
+	tlsUpstream.EnableHTTP2 = true
+	tlsUpstream.StartTLS()
+	defer tlsUpstream.Close()
+
+	h2cUpstream := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+	defer h2cUpstream.Close()
+
+	baseTransport := tlsUpstream.Client().Transport.(*http.Transport)
+
+	for _, test := range []struct {
+		name        string
+		protocol    UpstreamProtocol
+		upstream    *httptest.Server
+		clientMajor int
+		expected    string
+	}{
+		{"http1", UpstreamProtocolHTTP1, tlsUpstream, 2, "HTTP/1.1"},
+		{"h2", UpstreamProtocolH2, tlsUpstream, 1, "HTTP/2.0"},
+		{"h2_cleartext", UpstreamProtocolH2, h2cUpstream, 2, "HTTP/1.1"},
+		{"h2c", UpstreamProtocolH2C, h2cUpstream, 1, "HTTP/2.0"},
+		{"h2c_tls", UpstreamProtocolH2C, tlsUpstream, 1, "HTTP/2.0"},
+		{"mirror_http1", UpstreamProtocolMirror, tlsUpstream, 1, "HTTP/1.1"},
+		{"mirror_http2", UpstreamProtocolMirror, tlsUpstream, 2, "HTTP/2.0"},
+	} {
+		test := test
+		t.Run(test.name, func(subTest *testing.T) {
+
+			p := &ReverseProxy{Transport: baseTransport, UpstreamProtocol: test.protocol}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = strings.TrimPrefix(strings.TrimPrefix(test.upstream.URL, "https://"), "http://")
+			req.ProtoMajor = test.clientMajor
+			if test.upstream == tlsUpstream {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != http.StatusOK {
+				subTest.Fatalf("expected status code %d, but received %d", http.StatusOK, recorder.Code)
+			}
+			if body := recorder.Body.String(); body != test.expected {
+				subTest.Fatalf("expected upstream protocol %s, but received %s", test.expected, body)
+			}
+		})
+	}
+}
+
+func TestUpstreamProtocol_Validate(t *testing.T) {
+
+	t.Parallel()
+
+	if err := UpstreamProtocolMirror.Validate(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+
+	err := UpstreamProtocol("spdy").Validate()
+	if err == nil || !ERRUpstreamProtocol.Err().Match(err.(*ProxyError)) {
+		t.Fatalf("expected error %s, but received %v", ERRUpstreamProtocol, err)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+	netproxy "golang.org/x/net/proxy"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// Error upstream proxy url, or bypass pattern could not be parsed
+const ERRUpstreamProxy = ErrorStr("invalid upstream proxy")
+
+// Error upstream proxy refused, or failed the tunnel to the target
+const ERRUpstreamProxyConnect = ErrorStr("upstream proxy connect failed")
+
+// UpstreamProxy chains upstream requests through a parent proxy. URL is an http://, or https:// proxy, tunneled with
+// CONNECT, or a socks5:// proxy, with optional user:password credentials. Hosts matching Bypass, or NoProxy are
+// connected directly.
+type UpstreamProxy struct {
+	URL string `json:"url"`
+
+	// Bypass are PAC shExpMatch style patterns, where * matches any characters, and ? matches one. Patterns are
+	// matched against the host, or against the full url when the pattern contains ://.
+	Bypass []string `json:"bypass"`
+
+	// NoProxy are NO_PROXY environment style entries, host names matching the name, and its subdomains, .domain
+	// suffixes, ips, cidr ranges, and host:port. Loopback addresses are always connected directly.
+	NoProxy []string `json:"no_proxy"`
+
+	proxyURL *url.URL
+	bypass   []*regexp.Regexp
+	noProxy  func(*url.URL) (*url.URL, error)
+}
+
+// compile parses the proxy url, and bypass rules.
+func (u *UpstreamProxy) compile() error {
+
+	proxyURL, err := url.Parse(u.URL)
+	if err != nil {
+		return ERRUpstreamProxy.Err().WithError(err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return ERRUpstreamProxy.Err().WithReason("unsupported scheme %s", proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return ERRUpstreamProxy.Err().WithReason("missing host in %s", u.URL)
+	}
+	if proxyURL.Port() == "" {
+		proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), defaultProxyPort(proxyURL.Scheme))
+	}
+	u.proxyURL = proxyURL
+
+	u.bypass = nil
+	for _, pattern := range u.Bypass {
+		re, err := globRegexp(strings.ToLower(pattern))
+		if err != nil {
+			return ERRUpstreamProxy.Err().WithReason("bypass pattern %s, %s", pattern, err.Error())
+		}
+		u.bypass = append(u.bypass, re)
+	}
+
+	u.noProxy = (&httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    strings.Join(u.NoProxy, ","),
+	}).ProxyFunc()
+
+	return nil
+}
+
+// defaultProxyPort returns the port used for a proxy url without one, matching http.Transport.
+func defaultProxyPort(scheme string) string {
+
+	switch scheme {
+	case "https":
+		return "443"
+	case "socks5", "socks5h":
+		return "1080"
+	}
+
+	return "80"
+}
+
+// Transport returns a clone of http.DefaultTransport that sends requests through the proxy.
+func (u *UpstreamProxy) Transport() (*http.Transport, error) {
+
+	if err := u.compile(); err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = u.Proxy
+
+	return transport, nil
+}
+
+// Proxy returns the proxy url for the request, or nil when the target host is bypassed. It is used as
+// http.Transport.Proxy.
+func (u *UpstreamProxy) Proxy(req *http.Request) (*url.URL, error) {
+
+	proxyURL, err := u.proxyFor(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL == nil {
+		log.WithField("host", req.URL.Host).Debug("upstream proxy bypassed")
+	}
+
+	return proxyURL, nil
+}
+
+// proxyFor returns the proxy url for a target, or nil when the target is bypassed.
+func (u *UpstreamProxy) proxyFor(target *url.URL) (*url.URL, error) {
+
+	host := strings.ToLower(target.Hostname())
+	fullURL := strings.ToLower(target.String())
+	for _, re := range u.bypass {
+		if re.MatchString(host) || (strings.Contains(re.String(), "://") && re.MatchString(fullURL)) {
+			return nil, nil
+		}
+	}
+
+	return u.noProxy(target)
+}
+
+// contextDialer is a dial function, such as http.Transport.DialContext, that implements the golang.org/x/net/proxy
+// dialer interfaces.
+type contextDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+
+	return d(context.Background(), network, addr)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	return d(ctx, network, addr)
+}
+
+// upstreamProxyDialer returns a dial function that connects with the DialContext, and through the proxy of an
+// http.Transport, for transports without proxy support, such as http2.Transport.
+func upstreamProxyDialer(transport *http.Transport) func(ctx context.Context, scheme, addr string) (net.Conn, error) {
+
+	dial := contextDialer((&net.Dialer{}).DialContext)
+	if transport.DialContext != nil {
+		dial = transport.DialContext
+	}
+
+	return func(ctx context.Context, scheme, addr string) (net.Conn, error) {
+
+		if transport.Proxy == nil {
+			return dial(ctx, "tcp", addr)
+		}
+
+		req := &http.Request{URL: &url.URL{Scheme: scheme, Host: addr}, Header: http.Header{}}
+		proxyURL, err := transport.Proxy(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		return dialUpstreamProxy(ctx, dial, proxyURL, addr)
+	}
+}
+
+// dialUpstreamProxy connects to addr through the proxy, with a CONNECT tunnel for http, and https proxies. A nil
+// proxy url connects directly.
+func dialUpstreamProxy(ctx context.Context, dial contextDialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+
+	if proxyURL == nil {
+		return dial(ctx, "tcp", addr)
+	}
+
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		socksDialer, err := netproxy.FromURL(proxyURL, dial)
+		if err != nil {
+			return nil, ERRUpstreamProxy.Err().WithError(err)
+		}
+		return socksDialer.(netproxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+
+	conn, err := dial(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err = connectReq.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, ERRUpstreamProxyConnect.Err().WithError(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, connectReq)
+	if err != nil {
+		_ = conn.Close()
+		return nil, ERRUpstreamProxyConnect.Err().WithError(err)
+	}
+	// The body of a successful CONNECT is the tunnel, and is not closed
+	if res.StatusCode != http.StatusOK {
+		_ = res.Body.Close()
+		_ = conn.Close()
+		return nil, ERRUpstreamProxyConnect.Err().WithReason("%s returned %s", proxyURL.Host, res.Status)
+	}
+
+	// Tunnel bytes sent with the response, such as a server first greeting, are already in the reader
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn reads the connection through the reader, which holds bytes read past the CONNECT response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+
+	return c.reader.Read(p)
+}
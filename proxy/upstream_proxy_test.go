@@ -0,0 +1,277 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUpstreamProxy_proxyFor(t *testing.T) {
+
+	t.Parallel()
+
+	upstreamProxy := &UpstreamProxy{
+		URL:     "http://proxy.example.com",
+		Bypass:  []string{"*.internal.example.com", "intranet?", "https://docs.example.com/*"},
+		NoProxy: []string{".corp.example.com", "10.0.0.0/8", "direct.example.com"},
+	}
+	if err := upstreamProxy.compile(); err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	if upstreamProxy.proxyURL.Host != "proxy.example.com:80" {
+		t.Fatalf("expected default port 80, but received %s", upstreamProxy.proxyURL.Host)
+	}
+
+	for _, test := range []struct {
+		target  string
+		proxied bool
+	}{
+		{"https://www.example.com/", true},
+		{"https://app.INTERNAL.example.com/", false},
+		{"http://intranet1/", false},
+		{"http://intranet10/", true},
+		{"https://docs.example.com/guide", false},
+		{"http://docs.example.com/guide", true},
+		{"https://git.corp.example.com/", false},
+		{"http://10.1.2.3:8080/", false},
+		{"https://sub.direct.example.com/", false},
+		{"http://127.0.0.1/", false},
+	} {
+		target, _ := url.Parse(test.target)
+		proxyURL, err := upstreamProxy.proxyFor(target)
+		if err != nil {
+			t.Fatalf("expected no error, received %s", err.Error())
+		}
+		if (proxyURL != nil) != test.proxied {
+			t.Fatalf("expected %s proxied %t, but received %v", test.target, test.proxied, proxyURL)
+		}
+	}
+
+	for _, invalid := range []string{"ftp://proxy.example.com", "http://", "://"} {
+		err := (&UpstreamProxy{URL: invalid}).compile()
+		if err == nil || !ERRUpstreamProxy.Err().Match(err.(*ProxyError)) {
+			t.Fatalf("expected error %s for %s, but received %v", ERRUpstreamProxy, invalid, err)
+		}
+	}
+}
+
+func TestReverseProxy_ServeHTTP_upstreamProxy(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(request.Proto))
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	upstreamAddr := upstream.Listener.Addr().String()
+
+	var connects int32
+	connectProxy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodConnect || request.Host != "example.com:443" {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if request.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			writer.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		atomic.AddInt32(&connects, 1)
+		testTunnel(t, writer, upstreamAddr)
+	}))
+	defer connectProxy.Close()
+
+	socksProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, %s", err.Error())
+	}
+	defer func() { _ = socksProxy.Close() }()
+	go testSOCKS5Server(socksProxy, upstreamAddr)
+
+	connectURL := strings.Replace(connectProxy.URL, "http://", "http://user:pass@", 1)
+	badAuthURL := strings.Replace(connectProxy.URL, "http://", "http://user:wrong@", 1)
+	socksURL := "socks5://" + socksProxy.Addr().String()
+
+	for _, test := range []struct {
+		name     string
+		proxyURL string
+		protocol UpstreamProtocol
+		status   int
+		expected string
+	}{
+		{"connect", connectURL, UpstreamProtocolAuto, http.StatusOK, "HTTP/2.0"},
+		{"connect_http1", connectURL, UpstreamProtocolHTTP1, http.StatusOK, "HTTP/1.1"},
+		{"connect_h2", connectURL, UpstreamProtocolH2, http.StatusOK, "HTTP/2.0"},
+		{"connect_auth_failed", badAuthURL, UpstreamProtocolAuto, http.StatusInternalServerError, ""},
+		{"socks5", socksURL, UpstreamProtocolAuto, http.StatusOK, "HTTP/2.0"},
+		{"socks5_h2", socksURL, UpstreamProtocolH2, http.StatusOK, "HTTP/2.0"},
+	} {
+		test := test
+		t.Run(test.name, func(subTest *testing.T) {
+
+			transport, err := (&UpstreamProxy{URL: test.proxyURL}).Transport()
+			if err != nil {
+				subTest.Fatalf("expected no error, received %s", err.Error())
+			}
+			transport.TLSClientConfig = upstream.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+			p := &ReverseProxy{Transport: transport, UpstreamProtocol: test.protocol}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "example.com"
+			req.TLS = &tls.ConnectionState{}
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+
+			if recorder.Code != test.status {
+				subTest.Fatalf("expected status code %d, but received %d", test.status, recorder.Code)
+			}
+			if test.expected != "" && recorder.Body.String() != test.expected {
+				subTest.Fatalf("expected upstream protocol %s, but received %s", test.expected, recorder.Body.String())
+			}
+		})
+	}
+
+	if atomic.LoadInt32(&connects) == 0 {
+		t.Fatalf("expected requests to tunnel through the connect proxy")
+	}
+}
+
+func TestDialUpstreamProxy_buffered(t *testing.T) {
+
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, %s", err.Error())
+	}
+	defer func() { _ = listener.Close() }()
+
+	// The proxy sends the response, and the first tunnel bytes from a server that speaks first, in one write
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n220 smtp.example.com ready\r\n"))
+	}()
+
+	proxyURL := &url.URL{Scheme: "http", Host: listener.Addr().String()}
+	conn, err := dialUpstreamProxy(context.Background(), (&net.Dialer{}).DialContext, proxyURL, "smtp.example.com:25")
+	if err != nil {
+		t.Fatalf("expected no error, received %s", err.Error())
+	}
+	defer func() { _ = conn.Close() }()
+
+	greeting, err := ioutil.ReadAll(conn)
+	if err != nil || string(greeting) != "220 smtp.example.com ready\r\n" {
+		t.Fatalf("expected the server greeting read through the tunnel, but received %q, %v", greeting, err)
+	}
+}
+
+// testTunnel answers a CONNECT request, and relays the client connection to addr.
+func testTunnel(t *testing.T, writer http.ResponseWriter, addr string) {
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	writer.WriteHeader(http.StatusOK)
+	conn, buf, err := writer.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Errorf("hijack failed, %s", err.Error())
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(target, buf)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(conn, target)
+	_ = conn.Close()
+}
+
+// testSOCKS5Server accepts unauthenticated socks5 connect requests, and relays every connection to addr regardless of
+// the requested target.
+func testSOCKS5Server(listener net.Listener, addr string) {
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(conn net.Conn) {
+			defer func() { _ = conn.Close() }()
+
+			// greeting, version, and methods
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte{5, 0})
+
+			// request, version, command, reserved, address type, address, and port
+			request := make([]byte, 4)
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			var addrLength int
+			switch request[3] {
+			case 1:
+				addrLength = net.IPv4len
+			case 4:
+				addrLength = net.IPv6len
+			case 3:
+				length := make([]byte, 1)
+				if _, err := io.ReadFull(conn, length); err != nil {
+					return
+				}
+				addrLength = int(length[0])
+			}
+			if _, err := io.ReadFull(conn, make([]byte, addrLength+2)); err != nil {
+				return
+			}
+
+			target, err := net.Dial("tcp", addr)
+			if err != nil {
+				_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer func() { _ = target.Close() }()
+
+			reply := []byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0}
+			binary.BigEndian.PutUint16(reply[8:], uint16(target.LocalAddr().(*net.TCPAddr).Port))
+			_, _ = conn.Write(reply)
+
+			go func() {
+				_, _ = io.Copy(target, conn)
+				_ = target.Close()
+			}()
+			_, _ = io.Copy(conn, target)
+		}(conn)
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/jmizell/GoMITMProxy/proxy/log"
+)
+
+// Error websocket frame could not be read, or exceeds maxWebSocketFrameLength
+const ERRWebSocketFrame = ErrorStr("invalid websocket frame")
+
+// Error client connection cannot be taken over for a websocket
+const ERRWebSocketHijack = ErrorStr("websocket hijack failed")
+
+// maxWebSocketFrameLength is the largest websocket frame payload the proxy will buffer
+const maxWebSocketFrameLength = 32 << 20
+
+// WebSocketDirection is the direction a websocket frame is relayed in
+type WebSocketDirection string
+
+const (
+	// WebSocketClientToServer frames are sent by the client to the upstream server
+	WebSocketClientToServer WebSocketDirection = "client_to_server"
+
+	// WebSocketServerToClient frames are sent by the upstream server to the client
+	WebSocketServerToClient WebSocketDirection = "server_to_client"
+)
+
+// WebSocketOpcode is the frame type defined in RFC 6455
+type WebSocketOpcode byte
+
+const (
+	WebSocketContinuation WebSocketOpcode = 0x0
+	WebSocketText         WebSocketOpcode = 0x1
+	WebSocketBinary       WebSocketOpcode = 0x2
+	WebSocketClose        WebSocketOpcode = 0x8
+	WebSocketPing         WebSocketOpcode = 0x9
+	WebSocketPong         WebSocketOpcode = 0xa
+)
+
+// String returns the lower case name of the opcode for logging.
+func (o WebSocketOpcode) String() string {
+
+	switch o {
+	case WebSocketContinuation:
+		return "continuation"
+	case WebSocketText:
+		return "text"
+	case WebSocketBinary:
+		return "binary"
+	case WebSocketClose:
+		return "close"
+	case WebSocketPing:
+		return "ping"
+	case WebSocketPong:
+		return "pong"
+	}
+
+	return fmt.Sprintf("opcode%d", o)
+}
+
+// WebSocketFrame is a single websocket frame relayed by ReverseProxy. Payload is always unmasked. A WebSocketHook may
+// change Payload, or set Drop to discard the frame.
+type WebSocketFrame struct {
+	Request   *http.Request      // The upgrade request of the connection
+	Direction WebSocketDirection // Direction the frame is relayed in
+	Fin       bool               // Final frame of a message
+	Rsv       byte               // Reserved bits, RSV1 is the high bit of the three
+	Opcode    WebSocketOpcode    // Frame type
+	Payload   []byte             // Unmasked frame payload
+	Drop      bool               // Discard the frame instead of relaying it
+
+	masked  bool
+	maskKey [4]byte
+}
+
+// WebSocketHook is called for every websocket frame before it is relayed.
+type WebSocketHook func(frame *WebSocketFrame)
+
+// isWebSocketUpgrade returns true for an HTTP/1.1 websocket upgrade request.
+func isWebSocketUpgrade(req *http.Request) bool {
+
+	return headerHasToken(req.Header, "Connection", "upgrade") && headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken returns true when a comma separated header contains the token, ignoring case.
+func headerHasToken(header http.Header, key, token string) bool {
+
+	for _, value := range header[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// webSocketTransport returns a transport that only negotiates HTTP/1.1, as the upgrade cannot be sent over HTTP/2.
+// Transports other than *http.Transport are returned unchanged.
+func webSocketTransport(transport http.RoundTripper) http.RoundTripper {
+
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		return transport
+	}
+
+	return http1Transport(t)
+}
+
+// serveWebSocket completes the client upgrade with the upstream switching protocols response, and relays frames in
+// both directions until either side closes the connection.
+func (p *ReverseProxy) serveWebSocket(resp http.ResponseWriter, req *http.Request, upstream *http.Response) error {
+
+	upstreamConn, ok := upstream.Body.(io.ReadWriteCloser)
+	if !ok {
+		return ERRWebSocketHijack.Err().WithReason("upstream response body is not writable")
+	}
+	defer func() { _ = upstreamConn.Close() }()
+
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		return ERRWebSocketHijack.Err().WithReason("response writer does not support hijacking")
+	}
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		return ERRWebSocketHijack.Err().WithError(err)
+	}
+	defer func() { _ = clientConn.Close() }()
+
+	if _, err = fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", upstream.Status); err != nil {
+		return err
+	}
+	if err = upstream.Header.Write(clientBuf); err != nil {
+		return err
+	}
+	if _, err = clientBuf.WriteString("\r\n"); err != nil {
+		return err
+	}
+	if err = clientBuf.Flush(); err != nil {
+		return err
+	}
+
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			_ = clientConn.Close()
+			_ = upstreamConn.Close()
+		})
+	}
+
+	done := make(chan struct{}, 2)
+	relay := func(dst io.Writer, src *bufio.Reader, direction WebSocketDirection) {
+		defer func() { done <- struct{}{} }()
+		defer closeBoth()
+		if err := p.relayWebSocket(dst, src, req, direction); err != nil && err != io.EOF {
+			log.WithError(err).WithField("url", req.URL.String()).Debug("websocket relay closed")
+		}
+	}
+	go relay(upstreamConn, clientBuf.Reader, WebSocketClientToServer)
+	go relay(clientConn, bufio.NewReader(upstreamConn), WebSocketServerToClient)
+	<-done
+	<-done
+
+	return nil
+}
+
+// relayWebSocket reads frames from src, passes each frame to WebSocketHook, and writes them to dst. Each complete
+// message is logged, with continuation frames joined to the first frame of the message.
+func (p *ReverseProxy) relayWebSocket(dst io.Writer, src *bufio.Reader, req *http.Request, direction WebSocketDirection) error {
+
+	var message []byte
+	var messageLength int
+	var messageOpcode WebSocketOpcode
+	for {
+
+		frame, err := readWebSocketFrame(src)
+		if err != nil {
+			return err
+		}
+		frame.Request = req
+		frame.Direction = direction
+
+		if p.WebSocketHook != nil {
+			p.WebSocketHook(frame)
+		}
+
+		switch {
+		case frame.Opcode >= WebSocketClose:
+			p.logWebSocketMessage(req, direction, frame.Opcode, len(frame.Payload), frame.Payload, frame.Drop)
+		case frame.Opcode != WebSocketContinuation:
+			messageOpcode = frame.Opcode
+			message, messageLength = nil, 0
+			fallthrough
+		default:
+			messageLength += len(frame.Payload)
+			if room := log.WebSocketPayloadLimit - len(message); room > 0 {
+				if room > len(frame.Payload) {
+					room = len(frame.Payload)
+				}
+				message = append(message, frame.Payload[:room]...)
+			}
+		}
+		if frame.Opcode < WebSocketClose && frame.Fin {
+			p.logWebSocketMessage(req, direction, messageOpcode, messageLength, message, frame.Drop)
+			message, messageLength = nil, 0
+		}
+
+		if frame.Drop {
+			continue
+		}
+		if err = writeWebSocketFrame(dst, frame); err != nil {
+			return err
+		}
+	}
+}
+
+// logWebSocketMessage logs a relayed message, with the payload captured up to log.WebSocketPayloadLimit.
+func (p *ReverseProxy) logWebSocketMessage(req *http.Request, direction WebSocketDirection, opcode WebSocketOpcode, length int, payload []byte, dropped bool) {
+
+	logMsg := log.WithWebSocketMessage(req.URL.String(), string(direction), opcode.String(), length, payload)
+	if user := proxyUser(req); user != "" {
+		logMsg.WithUser(user)
+	}
+	if dropped {
+		logMsg.WithField("dropped", true)
+	}
+	logMsg.Info("")
+}
+
+// readWebSocketFrame reads a single frame, unmasking the payload.
+func readWebSocketFrame(r io.Reader) (*WebSocketFrame, error) {
+
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	frame := &WebSocketFrame{
+		Fin:    header[0]&0x80 != 0,
+		Rsv:    (header[0] >> 4) & 0x7,
+		Opcode: WebSocketOpcode(header[0] & 0xf),
+		masked: header[1]&0x80 != 0,
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketFrameLength {
+		return nil, ERRWebSocketFrame.Err().WithReason("frame length %d exceeds %d", length, maxWebSocketFrameLength)
+	}
+
+	if frame.masked {
+		if _, err := io.ReadFull(r, frame.maskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	frame.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return nil, err
+	}
+	if frame.masked {
+		maskWebSocketPayload(frame.Payload, frame.maskKey)
+	}
+
+	return frame, nil
+}
+
+// writeWebSocketFrame writes the frame, masking the payload with the original key when the frame was read masked.
+func writeWebSocketFrame(w io.Writer, frame *WebSocketFrame) error {
+
+	header := make([]byte, 2, 14)
+	if frame.Fin {
+		header[0] = 0x80
+	}
+	header[0] |= (frame.Rsv&0x7)<<4 | byte(frame.Opcode)&0xf
+
+	length := len(frame.Payload)
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	payload := frame.Payload
+	if frame.masked {
+		header[1] |= 0x80
+		header = append(header, frame.maskKey[:]...)
+		payload = append([]byte{}, frame.Payload...)
+		maskWebSocketPayload(payload, frame.maskKey)
+	}
+
+	if _, err := w.Write(append(header, payload...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// maskWebSocketPayload applies the RFC 6455 masking key to the payload in place. Masking is its own inverse.
+func maskWebSocketPayload(payload []byte, key [4]byte) {
+
+	for i := range payload {
+		payload[i] ^= key[i%4]
+	}
+}
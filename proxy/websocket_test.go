@@ -0,0 +1,215 @@
+// Copyright 2019 The Jeremy Mizell. All rights reserved.
+// Use of this source code is governed by a GPLv3 license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestWebSocketFrame_readWrite(t *testing.T) {
+
+	t.Parallel()
+
+	for _, length := range []int{0, 125, 126, 65535, 65536} {
+		for _, masked := range []bool{false, true} {
+
+			frame := &WebSocketFrame{
+				Fin:     true,
+				Opcode:  WebSocketBinary,
+				Payload: bytes.Repeat([]byte{'x'}, length),
+				masked:  masked,
+				maskKey: [4]byte{1, 2, 3, 4},
+			}
+
+			buf := &bytes.Buffer{}
+			if err := writeWebSocketFrame(buf, frame); err != nil {
+				t.Fatalf("expected no error writing frame, received %s", err.Error())
+			}
+
+			read, err := readWebSocketFrame(buf)
+			if err != nil {
+				t.Fatalf("expected no error reading frame, received %s", err.Error())
+			}
+			if !read.Fin || read.Opcode != WebSocketBinary || read.masked != masked {
+				t.Fatalf("expected frame header to match, but received %+v", read)
+			}
+			if !bytes.Equal(read.Payload, frame.Payload) {
+				t.Fatalf("expected payload of length %d to match, but received length %d", length, len(read.Payload))
+			}
+		}
+	}
+}
+
+func TestReverseProxy_ServeHTTP_webSocket(t *testing.T) {
+
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+
+		if req.Header.Get("Sec-WebSocket-Extensions") != "" {
+			t.Errorf("expected extensions to be removed, but received %s", req.Header.Get("Sec-WebSocket-Extensions"))
+		}
+
+		conn, buf, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed, %s", err.Error())
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = buf.Flush()
+
+		// echo each frame back to the client unmasked
+		for {
+			frame, err := readWebSocketFrame(buf)
+			if err != nil {
+				return
+			}
+			frame.masked = false
+			if err = writeWebSocketFrame(conn, frame); err != nil {
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	hooked := make(chan WebSocketDirection, 4)
+	proxyServer := httptest.NewServer(&ReverseProxy{
+		WebSocketHook: func(frame *WebSocketFrame) {
+			if extensions := frame.Request.Header.Get("Sec-WebSocket-Extensions"); extensions != "permessage-deflate" {
+				t.Errorf("expected the client request unchanged, but received extensions %q", extensions)
+			}
+			hooked <- frame.Direction
+			if frame.Direction == WebSocketClientToServer {
+				frame.Payload = append(frame.Payload, '!')
+			}
+		},
+	})
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+	if err != nil {
+		t.Fatalf("failed to connect to proxy, %s", err.Error())
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "GET /socket HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n", strings.TrimPrefix(upstream.URL, "http://"))
+	if err != nil {
+		t.Fatalf("failed to write upgrade request, %s", err.Error())
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("failed to read upgrade response, %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status code %d, but received %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	err = writeWebSocketFrame(conn, &WebSocketFrame{
+		Fin:     true,
+		Opcode:  WebSocketText,
+		Payload: []byte("hello"),
+		masked:  true,
+		maskKey: [4]byte{9, 8, 7, 6},
+	})
+	if err != nil {
+		t.Fatalf("failed to write frame, %s", err.Error())
+	}
+
+	frame, err := readWebSocketFrame(reader)
+	if err != nil {
+		t.Fatalf("failed to read frame, %s", err.Error())
+	}
+	if string(frame.Payload) != "hello!" {
+		t.Fatalf("expected payload hello!, but received %s", frame.Payload)
+	}
+
+	for _, expected := range []WebSocketDirection{WebSocketClientToServer, WebSocketServerToClient} {
+		if direction := <-hooked; direction != expected {
+			t.Fatalf("expected hook direction %s, but received %s", expected, direction)
+		}
+	}
+}
+
+func TestTLSServer_ListenAndServe_webSocketHTTP2(t *testing.T) {
+
+	t.Parallel()
+
+	certs := &Certs{}
+	if _, _, err := certs.GenerateCAPair(); err != nil {
+		t.Fatalf("failed to generate ca, %s", err.Error())
+	}
+
+	srv := &TLSServer{ListenAddr: "127.0.0.1", Certs: certs}
+	ready := make(chan bool, 1)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe(ready, &ReverseProxy{})
+	}()
+
+	select {
+	case <-ready:
+	case err := <-serverErr:
+		t.Fatalf("tls server failed to start, %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for tls server")
+	}
+	defer func() { _ = srv.Shutdown() }()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(certs.caCert)
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", srv.GetPort()), &tls.Config{
+		RootCAs:    rootCAs,
+		ServerName: "socket.test",
+		NextProtos: []string{http2.NextProtoTLS},
+	})
+	if err != nil {
+		t.Fatalf("failed to connect to tls server, %s", err.Error())
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatalf("failed to write client preface, %s", err.Error())
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err = framer.WriteSettings(); err != nil {
+		t.Fatalf("failed to write settings, %s", err.Error())
+	}
+
+	// Websockets over HTTP/2 are not supported, so the server must not advertise RFC 8441 extended CONNECT, and
+	// clients upgrade over HTTP/1.1 instead
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read server settings, %s", err.Error())
+		}
+		settings, ok := frame.(*http2.SettingsFrame)
+		if !ok || settings.IsAck() {
+			continue
+		}
+		if value, ok := settings.Value(http2.SettingEnableConnectProtocol); ok && value != 0 {
+			t.Fatalf("expected extended connect not advertised, but received SETTINGS_ENABLE_CONNECT_PROTOCOL %d", value)
+		}
+		break
+	}
+}